@@ -13,7 +13,9 @@ func main() {
 		Usage: "Tool to upload local files to an aqua server.",
 		Commands: []*cli.Command{
 			aqcli.UploadCommand,
+			aqcli.PasteCommand,
 			aqcli.GenerateCommand,
+			aqcli.TokenCommand,
 		},
 	}
 
@@ -1,14 +1,20 @@
 package main
 
 import (
+	"context"
 	"github.com/gin-gonic/gin"
 	"github.com/go-co-op/gocron"
 	"github.com/joho/godotenv"
+	"github.com/superioz/aqua/internal/config"
 	"github.com/superioz/aqua/internal/handler"
 	"github.com/superioz/aqua/internal/metrics"
 	"github.com/superioz/aqua/pkg/env"
 	"github.com/superioz/aqua/pkg/middleware"
 	"k8s.io/klog"
+	"net/http"
+	"os"
+	"os/signal"
+	"syscall"
 	"time"
 )
 
@@ -27,12 +33,67 @@ func main() {
 
 	// handler for receiving uploaded files
 	uh := handler.NewUploadHandler()
+
+	// limit the requests per token or per client ip
+	rl := middleware.NewRateLimiter()
+	rl.OnReject = func(limit *middleware.RateLimit) {
+		metrics.IncRequestsRateLimited(limit.Kind)
+	}
+	r.Use(rl.RateLimit(uh.GetRateLimit))
+
 	r.POST("/upload", uh.Upload)
+	r.POST("/paste", uh.Paste)
+
+	// reload the auth config on changes and on SIGHUP,
+	// so that tokens can be changed without a restart.
+	if env.BoolOrDefault("AUTH_CONFIG_WATCH", true) {
+		stopWatch, err := uh.WatchAuthConfig()
+		if err != nil {
+			klog.Warningf("Could not watch auth config: %v", err)
+		} else {
+			defer stopWatch()
+		}
+	}
+	go func() {
+		hup := make(chan os.Signal, 1)
+		signal.Notify(hup, syscall.SIGHUP)
+		for range hup {
+			klog.Infoln("Received SIGHUP, reloading auth config ...")
+			_ = uh.ReloadAuthConfig()
+		}
+	}()
+
+	// handlers for resumable uploads via the tus protocol
+	r.OPTIONS("/tus/", uh.TusOptions)
+	r.POST("/tus/", uh.TusCreate)
+	r.HEAD("/tus/:id", uh.TusHead)
+	r.PATCH("/tus/:id", uh.TusPatch)
+	r.DELETE("/tus/:id", uh.TusDelete)
+
+	// admin API for managing the stored files
+	if env.BoolOrDefault("ADMIN_API_ENABLED", true) {
+		ah := handler.NewAdminHandler(uh.FileStorage)
+		admin := r.Group("/api/admin", uh.RequireAdmin())
+		admin.GET("/files", ah.ListFiles)
+		admin.DELETE("/files", ah.DeleteFiles)
+		admin.GET("/files/:id", ah.GetFile)
+		admin.PATCH("/files/:id", ah.UpdateFile)
+		admin.DELETE("/files/:id", ah.DeleteFile)
+		admin.GET("/scrub", ah.ScrubStatus)
+		admin.POST("/scrub", ah.Scrub)
+		admin.GET("/reconcile", ah.ReconcileStatus)
+		admin.POST("/reconcile", ah.Reconcile)
+	}
 
 	// scheduler to do the cleanup every x minutes
 	s := gocron.NewScheduler(time.UTC)
 	_, err = s.Every(env.IntOrDefault("FILE_EXPIRATION_CYCLE", 15)).Minutes().StartImmediately().Do(func() {
-		err = uh.FileStorage.Cleanup()
+		err := uh.FileStorage.Cleanup()
+		if err != nil {
+			klog.Errorln(err)
+		}
+
+		err = uh.PartialUploads.Cleanup()
 		if err != nil {
 			klog.Errorln(err)
 		}
@@ -40,17 +101,94 @@ func main() {
 	if err != nil {
 		klog.Fatalf("could not start cleanup scheduler: %v", err)
 	}
+
+	// scrub every x hours, as it has to read every stored file
+	if scrubInterval := env.IntOrDefault("SCRUB_INTERVAL", 0); scrubInterval > 0 {
+		_, err = s.Every(scrubInterval).Hours().WaitForSchedule().Do(func() {
+			_, err := uh.FileStorage.Scrub(env.BoolOrDefault("SCRUB_QUARANTINE", false))
+			if err != nil {
+				klog.Errorln(err)
+			}
+		})
+		if err != nil {
+			klog.Fatalf("could not start scrub scheduler: %v", err)
+		}
+	}
 	s.StartAsync()
 
+	// find differences between the physical files and the metadata, e.g.
+	// after a crash. Runs in the background, as it has to list all files.
+	if env.BoolOrDefault("RECONCILE_ON_STARTUP", true) {
+		go func() {
+			_, err := uh.FileStorage.Reconcile(env.StringOrDefault("RECONCILE_POLICY", config.EnvDefaultReconcilePolicy))
+			if err != nil {
+				klog.Errorln(err)
+			}
+		}()
+	}
+
 	if env.BoolOrDefault("FILE_SERVING_ENABLED", true) {
-		r.GET("/:file", handler.HandleStaticFiles())
-		r.HEAD("/:file", handler.HandleStaticFiles())
+		// the password of protected files can be guessed
+		// otherwise, so the attempts are limited per file.
+		pl := rl.RateLimit(handler.GetPasswordRateLimit)
+
+		r.GET("/:file", pl, handler.HandleStaticFiles(uh.FileStorage))
+		r.HEAD("/:file", pl, handler.HandleStaticFiles(uh.FileStorage))
+
+		// the password prompt of protected files posts to this
+		r.POST("/:file", pl, handler.HandleStaticFiles(uh.FileStorage))
+
+		if env.BoolOrDefault("PREVIEW_ENABLED", true) {
+			r.GET("/v/:file", handler.HandlePreview(uh.FileStorage))
+		}
+		if env.BoolOrDefault("PASTE_VIEW_ENABLED", true) {
+			r.GET("/p/:file", pl, handler.HandlePasteView(uh.FileStorage))
+			r.POST("/p/:file", pl, handler.HandlePasteView(uh.FileStorage))
+		}
 	}
 
+	// deletion via the key returned on upload. The GET variant exists,
+	// because tools like ShareX simply open the deletion url in the browser,
+	// which shows a confirmation page that posts to the POST variant.
+	r.DELETE("/:file", uh.DeleteFile)
+	r.GET("/:file/delete", uh.ConfirmDeletion)
+	r.POST("/:file/delete", uh.DeleteFile)
+
 	// finally, start the metrics server as well
 	if env.BoolOrDefault("METRICS_ENABLED", true) {
 		go metrics.StartMetricsServer()
 	}
 
-	_ = r.Run(":8765")
+	srv := &http.Server{
+		Addr:    ":8765",
+		Handler: r,
+	}
+	go func() {
+		err := srv.ListenAndServe()
+		if err != nil && err != http.ErrServerClosed {
+			klog.Fatalf("could not start server: %v", err)
+		}
+	}()
+
+	// wait for the signal to shut down, so that we can
+	// finish the running requests and close the meta database cleanly.
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+	<-ctx.Done()
+
+	klog.Infoln("Shutting down ...")
+	s.Stop()
+
+	shutdownCtx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	err = srv.Shutdown(shutdownCtx)
+	if err != nil {
+		klog.Errorf("Could not shut down server gracefully: %v", err)
+	}
+
+	err = uh.FileStorage.Close()
+	if err != nil {
+		klog.Errorf("Could not close file storage: %v", err)
+	}
+	klog.Flush()
 }
@@ -1,9 +1,11 @@
 package aqcli
 
 import (
+	"bufio"
 	"bytes"
 	"encoding/json"
 	"fmt"
+	"github.com/superioz/aqua/internal/config"
 	"github.com/superioz/aqua/internal/request"
 	"github.com/superioz/aqua/pkg/shttp"
 	"github.com/urfave/cli/v2"
@@ -11,7 +13,9 @@ import (
 	"io/ioutil"
 	"math/rand"
 	"net/http"
+	"net/url"
 	"os"
+	"path/filepath"
 	"strings"
 	"time"
 )
@@ -27,6 +31,10 @@ var GenerateCommand = &cli.Command{
 			Value:   32,
 			Usage:   "Length of the token",
 		},
+		&cli.StringFlag{
+			Name:  "id",
+			Usage: "Id the token starts with, which is needed if the token is hashed",
+		},
 	},
 	Action: func(c *cli.Context) error {
 		size := c.Int("length")
@@ -34,7 +42,66 @@ var GenerateCommand = &cli.Command{
 			return cli.Exit("You cannot generate a token with this length. Must be >=2.", 1)
 		}
 
-		fmt.Println(generateToken(size))
+		token := generateToken(size)
+		if id := c.String("id"); id != "" {
+			if strings.Contains(id, config.TokenIdSeparator) {
+				return cli.Exit(fmt.Sprintf("The id must not contain %q.", config.TokenIdSeparator), 1)
+			}
+			token = id + config.TokenIdSeparator + token
+		}
+		fmt.Println(token)
+		return nil
+	},
+}
+
+var TokenCommand = &cli.Command{
+	Name:  "token",
+	Usage: "Generates and hashes auth tokens",
+	Subcommands: []*cli.Command{
+		GenerateCommand,
+		TokenHashCommand,
+	},
+}
+
+var TokenHashCommand = &cli.Command{
+	Name:      "hash",
+	Usage:     "Hashes a token, so that it doesn't have to be stored in plain text inside the auth.yml",
+	ArgsUsage: "[token]",
+	Flags: []cli.Flag{
+		&cli.StringFlag{
+			Name:    "algorithm",
+			Aliases: []string{"a"},
+			Value:   config.HashAlgorithmArgon2id,
+			Usage:   "Algorithm to hash the token with (argon2id or bcrypt)",
+		},
+	},
+	Action: func(c *cli.Context) error {
+		// read the token from stdin if not given, so
+		// that it doesn't end up in the shell history.
+		token := c.Args().First()
+		if token == "" {
+			line, err := bufio.NewReader(os.Stdin).ReadString('\n')
+			if err != nil && err != io.EOF {
+				return fmt.Errorf("could not read token: %v", err)
+			}
+			token = strings.TrimSpace(line)
+		}
+		if token == "" {
+			return cli.Exit("You have to provide a token to hash.", 1)
+		}
+
+		// the id is needed to find the hash again
+		i := strings.Index(token, config.TokenIdSeparator)
+		if i <= 0 {
+			return cli.Exit(fmt.Sprintf("The token has to start with its id, e.g. alice%s<token>.", config.TokenIdSeparator), 1)
+		}
+
+		hash, err := config.HashToken(token, c.String("algorithm"))
+		if err != nil {
+			return cli.Exit(fmt.Sprintf("Could not hash token: %v", err), 1)
+		}
+
+		fmt.Printf("- token: '%s'\n  id: '%s'\n", hash, token[:i])
 		return nil
 	},
 }
@@ -74,6 +141,25 @@ var UploadCommand = &cli.Command{
 			Value:   -1,
 			Usage:   "Time in seconds when the file should expire. -1 = never.",
 		},
+		&cli.IntFlag{
+			Name:  "max-downloads",
+			Value: 0,
+			Usage: "Amount of downloads after which the file is deleted. 1 = burn after reading, 0 = unlimited.",
+		},
+		&cli.StringFlag{
+			Name:  "password",
+			Usage: "Password that is needed to download the file",
+		},
+		&cli.IntFlag{
+			Name:  "resumable-threshold",
+			Value: 16,
+			Usage: "Files larger than this (in MB) are uploaded resumable in chunks. -1 = never.",
+		},
+		&cli.IntFlag{
+			Name:  "chunk-size",
+			Value: 4,
+			Usage: "Size of a single chunk of a resumable upload in MB",
+		},
 	},
 	Action: func(c *cli.Context) error {
 		paths := c.Args().Slice()
@@ -90,6 +176,13 @@ var UploadCommand = &cli.Command{
 
 		token := c.String("token")
 		expires := c.Int("expires")
+		maxDownloads := c.Int("max-downloads")
+		password := c.String("password")
+		threshold := int64(c.Int("resumable-threshold")) * sizeMegaByte
+		chunkSize := int64(c.Int("chunk-size")) * sizeMegaByte
+		if chunkSize <= 0 {
+			return cli.Exit("The chunk size must be at least 1MB.", 1)
+		}
 
 		for _, path := range paths {
 			file, err := os.Open(path)
@@ -98,24 +191,115 @@ var UploadCommand = &cli.Command{
 				return fmt.Errorf("could not open file: %v", err)
 			}
 
-			id, err := doPostRequest(host, token, file, &request.RequestMetadata{
-				Expiration: int64(expires),
-			})
+			stat, err := file.Stat()
+			if err != nil {
+				return fmt.Errorf("could not open file: %v", err)
+			}
+
+			metadata := &request.RequestMetadata{
+				Expiration:   int64(expires),
+				MaxDownloads: int64(maxDownloads),
+				Password:     password,
+			}
+
+			var id string
+			if threshold >= 0 && stat.Size() > threshold {
+				id, err = doTusUpload(host, token, file, metadata, chunkSize)
+			} else {
+				id, err = doPostRequest(host, token, file, metadata)
+			}
 			if err != nil {
 				// one of the file does not exist
 				return fmt.Errorf("could not upload file %s: %v", path, err)
 			}
 			file.Close()
 
-			fmt.Printf("Uploaded file %s to %s/%s", path, host, id)
+			fmt.Printf("Uploaded file %s to %s/%s\n", path, host, id)
+		}
+
+		return nil
+	},
+}
+
+var PasteCommand = &cli.Command{
+	Name:  "paste",
+	Usage: "Uploads the text from stdin as paste to the aqua server",
+	Flags: []cli.Flag{
+		&cli.StringFlag{
+			Name:  "host",
+			Usage: "Specifies to which host to upload to",
+			Value: "http://localhost:8765",
+		},
+		&cli.StringFlag{
+			Name:    "token",
+			Aliases: []string{"t"},
+			Usage:   "Token used for authorization",
+		},
+		&cli.StringFlag{
+			Name:    "language",
+			Aliases: []string{"l"},
+			Usage:   "Language of the paste for the syntax highlighting, e.g. go or yaml",
+		},
+		&cli.IntFlag{
+			Name:    "expires",
+			Aliases: []string{"e"},
+			Value:   -1,
+			Usage:   "Time in seconds when the paste should expire. -1 = never.",
+		},
+		&cli.IntFlag{
+			Name:  "max-downloads",
+			Value: 0,
+			Usage: "Amount of downloads after which the paste is deleted. 1 = burn after reading, 0 = unlimited.",
+		},
+		&cli.StringFlag{
+			Name:  "password",
+			Usage: "Password that is needed to view the paste",
+		},
+	},
+	Action: func(c *cli.Context) error {
+		host := c.String("host")
+		if !strings.HasPrefix(host, "http") {
+			// defaults to https
+			host = "https://" + host
+		}
+
+		text, err := ioutil.ReadAll(os.Stdin)
+		if err != nil {
+			return fmt.Errorf("could not read stdin: %v", err)
+		}
+		if len(text) == 0 {
+			return cli.Exit("You have to provide the text to paste via stdin", 1)
+		}
+
+		metadata := &request.RequestMetadata{
+			Expiration:   int64(c.Int("expires")),
+			MaxDownloads: int64(c.Int("max-downloads")),
+			Password:     c.String("password"),
+		}
+
+		viewUrl, err := doPasteRequest(host, c.String("token"), text, c.String("language"), metadata)
+		if err != nil {
+			return fmt.Errorf("could not upload paste: %v", err)
 		}
 
+		fmt.Println(viewUrl)
 		return nil
 	},
 }
 
+const (
+	sizeMegaByte = 1 << (10 * 2)
+
+	// tusMaxRetries is the amount of times a chunk is
+	// retried in a row, before the upload is cancelled.
+	tusMaxRetries = 5
+)
+
 type postResponse struct {
-	Id string
+	FileName string `json:"fileName"`
+
+	// ViewUrl is only returned for pastes.
+	ViewUrl string `json:"viewUrl"`
 }
 
 func doPostRequest(host string, token string, file *os.File, metadata *request.RequestMetadata) (string, error) {
@@ -153,5 +337,74 @@ func doPostRequest(host string, token string, file *os.File, metadata *request.R
 	if err != nil {
 		return "", err
 	}
-	return resp.Id, nil
+	return resp.FileName, nil
+}
+
+// doPasteRequest uploads the text as paste and returns
+// the url of the page that shows it.
+func doPasteRequest(host string, token string, text []byte, language string, metadata *request.RequestMetadata) (string, error) {
+	md, err := json.Marshal(metadata)
+	if err != nil {
+		return "", err
+	}
+
+	req, err := http.NewRequest(http.MethodPost, host+"/paste?language="+url.QueryEscape(language), bytes.NewReader(text))
+	if err != nil {
+		return "", err
+	}
+	req.Header.Set("Authorization", "Bearer "+token)
+	req.Header.Set("Content-Type", "text/plain; charset=utf-8")
+	req.Header.Set("Aqua-Metadata", string(md))
+
+	client := &http.Client{
+		Timeout: 30 * time.Second,
+	}
+
+	res, err := client.Do(req)
+	if err != nil {
+		return "", err
+	}
+	defer res.Body.Close()
+	if res.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("bad status code: %d", res.StatusCode)
+	}
+
+	var resp postResponse
+	err = json.NewDecoder(res.Body).Decode(&resp)
+	if err != nil {
+		return "", err
+	}
+	return resp.ViewUrl, nil
+}
+
+// doTusUpload uploads the file in chunks via the tus protocol, so that
+// a failed request does not mean that the whole file has to be uploaded again.
+func doTusUpload(host string, token string, file *os.File, metadata *request.RequestMetadata, chunkSize int64) (string, error) {
+	md, err := json.Marshal(metadata)
+	if err != nil {
+		return "", err
+	}
+
+	mime, err := shttp.DetectFileType(file)
+	if err != nil {
+		return "", err
+	}
+
+	client := &http.Client{
+		Timeout: 30 * time.Second,
+	}
+
+	res, err := shttp.TusUpload(client, host+"/tus/", file, map[string]string{
+		"filename": filepath.Base(file.Name()),
+		"filetype": mime,
+		"metadata": string(md),
+	}, map[string]string{
+		"Authorization": "Bearer " + token,
+	}, chunkSize, tusMaxRetries)
+	if err != nil {
+		return "", err
+	}
+	res.Body.Close()
+
+	return res.Header.Get(shttp.HeaderFileName), nil
 }
@@ -4,30 +4,139 @@ import (
 	"gopkg.in/yaml.v2"
 	"io/ioutil"
 	"os"
+	"sync"
 )
 
 const (
 	ExpireNever = -1
 
-	EnvDefaultFileStoragePath = "/var/lib/aqua/files/"
-	EnvDefaultMetaDbPath      = "/var/lib/aqua/"
+	EnvDefaultFileStorageType        = FileStorageTypeLocal
+	EnvDefaultFileStoragePath        = "/var/lib/aqua/files/"
+	EnvDefaultMetaDbType             = MetaDbTypeSqlite
+	EnvDefaultMetaDbPath             = "/var/lib/aqua/"
+	EnvDefaultS3PartSize             = 16
+	EnvDefaultTusUploadPath          = "/var/lib/aqua/uploads/"
+	EnvDefaultTusExpiration          = 24 * 60 * 60
+	EnvDefaultFileTypePolicy         = FileTypePolicyReject
+	EnvDefaultRateLimitIpBurst       = 20
+	EnvDefaultRateLimitVerifyRpm     = 10
+	EnvDefaultRateLimitVerifyBurst   = 5
+	EnvDefaultRateLimitPasswordRpm   = 10
+	EnvDefaultRateLimitPasswordBurst = 10
+	EnvDefaultFileCacheMaxAge        = 24 * 60 * 60
+	EnvDefaultReconcilePolicy        = ReconcilePolicyLeave
+	EnvDefaultReconcileExpiration    = 7 * 24 * 60 * 60
+	EnvDefaultReconcileTempGrace     = 24 * 60 * 60
+	EnvDefaultThumbnailSizes         = "128,256,512"
+	EnvDefaultThumbnailMaxPixels     = 50 * 1000 * 1000
+	EnvDefaultThumbnailConcurrency   = 2
+	EnvDefaultStripMetadataMaxPixels = 100 * 1000 * 1000
+
+	FileStorageTypeLocal = "local"
+	FileStorageTypeS3    = "s3"
+
+	MetaDbTypeSqlite   = "sqlite"
+	MetaDbTypePostgres = "postgres"
+
+	FileTypePolicyReject  = "reject"
+	FileTypePolicyCorrect = "correct"
+	FileTypePolicyTrust   = "trust"
+
+	ReconcilePolicyAdopt  = "adopt"
+	ReconcilePolicyDelete = "delete"
+	ReconcilePolicyLeave  = "leave"
 )
 
 type AuthConfig struct {
 	ValidTokens []*TokenConfig `yaml:"validTokens"`
+
+	// AdminTokens grant access to the admin API. They
+	// can not be used for uploading files.
+	AdminTokens []*AdminTokenConfig `yaml:"adminTokens"`
+
+	// verified caches tokens that matched a hashed token,
+	// because verifying the hash is slow on purpose.
+	// It maps the sha256 of the token to its *Auth.
+	verified sync.Map
+
+	// failed caches tokens that did not match the hashed
+	// token with their id, so that they are not verified again.
+	failed tokenSet
+
+	// hashed maps the ids of the hashed tokens to their entry,
+	// so that only a single hash has to be verified per token.
+	hashed map[string]*hashedToken
+}
+
+// Auth is the result of checking the token of a request.
+type Auth struct {
+	// Token is the config of a valid upload token, nil otherwise.
+	Token *TokenConfig
+
+	// Admin is true for valid admin tokens.
+	Admin bool
 }
 
 type TokenConfig struct {
+	// Token is either the plain token or a hash of it,
+	// see HashToken for the supported formats.
 	Token string
 
+	// Id identifies the token in the metadata of the uploaded files,
+	// so that the token itself doesn't have to be stored. It is needed
+	// for hashed tokens and tokens with limits. Files uploaded with a
+	// token without id don't belong to any token.
+	Id string `yaml:"id"`
+
 	// All file types that one can upload via this token.
 	// If empty, all file types are allowed.
 	ValidFileTypes []string `yaml:"fileTypes"`
+
+	// The following limits are disabled if they are zero.
+
+	// MaxFileSize is the maximum size of a single file in megabytes.
+	MaxFileSize int64 `yaml:"maxFileSize"`
+
+	// MaxStorage is the maximum size of all stored files in megabytes.
+	MaxStorage int64 `yaml:"maxStorage"`
+
+	// MaxFiles is the maximum amount of stored files.
+	MaxFiles int64 `yaml:"maxFiles"`
+
+	// MaxExpiration is the maximum expiration of a file in seconds.
+	// If set, files that never expire are not allowed.
+	MaxExpiration int64 `yaml:"maxExpiration"`
+
+	// RateLimit limits the requests made with this token.
+	// If nil, the token is not limited.
+	RateLimit *RateLimitConfig `yaml:"rateLimit"`
+
+	// StripMetadata decides if metadata like EXIF is removed from
+	// uploaded images. If nil, STRIP_METADATA decides.
+	StripMetadata *bool `yaml:"stripMetadata"`
+}
+
+type RateLimitConfig struct {
+	// RequestsPerMinute is the average amount of allowed requests.
+	RequestsPerMinute float64 `yaml:"requestsPerMinute"`
+
+	// Burst is the amount of requests that can be made at once.
+	Burst int `yaml:"burst"`
+}
+
+type AdminTokenConfig struct {
+	// Token is either the plain token or a hash of it,
+	// see TokenConfig.Token.
+	Token string
+
+	// Id is needed to find hashed tokens, see TokenConfig.Id.
+	Id string `yaml:"id"`
 }
 
 func NewEmptyAuthConfig() *AuthConfig {
 	return &AuthConfig{
 		ValidTokens: []*TokenConfig{},
+		AdminTokens: []*AdminTokenConfig{},
 	}
 }
 
@@ -37,6 +146,10 @@ func FromData(data []byte) (*AuthConfig, error) {
 	if err != nil {
 		return nil, err
 	}
+	err = ac.indexTokens()
+	if err != nil {
+		return nil, err
+	}
 	return &ac, nil
 }
 
@@ -55,27 +168,29 @@ func FromLocalFile(path string) (*AuthConfig, error) {
 }
 
 func (ac *AuthConfig) HasToken(token string) bool {
-	for _, validToken := range ac.ValidTokens {
-		if validToken.Token == token {
-			return true
-		}
-	}
-	return false
+	return ac.Authenticate(token).Token != nil
+}
+
+// GetToken returns the config of given token
+// or nil, if the token is not valid.
+func (ac *AuthConfig) GetToken(token string) *TokenConfig {
+	return ac.Authenticate(token).Token
 }
 
-func (ac *AuthConfig) CanUpload(token string, filetype string) bool {
-	for _, validToken := range ac.ValidTokens {
-		if validToken.Token == token {
-			ft := validToken.ValidFileTypes
-			if len(ft) == 0 {
-				return true
-			}
-
-			for _, s := range ft {
-				if s == filetype {
-					return true
-				}
-			}
+func (ac *AuthConfig) HasAdminToken(token string) bool {
+	return ac.Authenticate(token).Admin
+}
+
+// CanUpload returns if files of given type can be uploaded with the token.
+func (tc *TokenConfig) CanUpload(filetype string) bool {
+	ft := tc.ValidFileTypes
+	if len(ft) == 0 {
+		return true
+	}
+
+	for _, s := range ft {
+		if s == filetype {
+			return true
 		}
 	}
 	return false
@@ -0,0 +1,315 @@
+package config
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"golang.org/x/crypto/argon2"
+	"golang.org/x/crypto/bcrypt"
+	"runtime"
+	"strings"
+	"sync"
+)
+
+const (
+	HashAlgorithmArgon2id = "argon2id"
+	HashAlgorithmBcrypt   = "bcrypt"
+
+	// the argon2id parameters, as recommended by OWASP
+	argon2Memory  = 19 * 1024
+	argon2Time    = 2
+	argon2Threads = 1
+	argon2KeyLen  = 32
+	argon2SaltLen = 16
+
+	bcryptCost = 12
+
+	// TokenIdSeparator separates the id of a hashed token from the rest
+	// of the token, e.g. `alice.L1dLUm12!Lb%7Nz1ep4h5Vo`.
+	TokenIdSeparator = "."
+
+	// maxFailedTokens is the amount of invalid tokens, that are
+	// remembered so that their hash doesn't have to be verified again.
+	maxFailedTokens = 4096
+)
+
+var (
+	errInvalidHash = errors.New("invalid token hash")
+
+	// noAuth is the result for every invalid token.
+	noAuth = &Auth{}
+
+	// verifySlots limits how many hashes are verified at once, as
+	// every argon2id verification needs its own memory.
+	verifySlots = make(chan struct{}, runtime.NumCPU())
+)
+
+// hashedToken is a hashed entry of the auth config.
+type hashedToken struct {
+	hash string
+	auth *Auth
+}
+
+// HashToken hashes the token with given algorithm, so that it can be put
+// into the auth config instead of the plain token. The hash contains the
+// algorithm, its parameters and a random salt.
+func HashToken(token string, algorithm string) (string, error) {
+	switch algorithm {
+	case HashAlgorithmArgon2id:
+		salt := make([]byte, argon2SaltLen)
+		_, err := rand.Read(salt)
+		if err != nil {
+			return "", err
+		}
+
+		key := argon2.IDKey([]byte(token), salt, argon2Time, argon2Memory, argon2Threads, argon2KeyLen)
+		return fmt.Sprintf("$argon2id$v=%d$m=%d,t=%d,p=%d$%s$%s", argon2.Version, argon2Memory, argon2Time, argon2Threads,
+			base64.RawStdEncoding.EncodeToString(salt), base64.RawStdEncoding.EncodeToString(key)), nil
+	case HashAlgorithmBcrypt:
+		hash, err := bcrypt.GenerateFromPassword([]byte(token), bcryptCost)
+		if err != nil {
+			return "", err
+		}
+		return string(hash), nil
+	default:
+		return "", fmt.Errorf("unknown hash algorithm %s", algorithm)
+	}
+}
+
+// isHashedToken returns if the configured token is a hash
+// instead of the plain token.
+func isHashedToken(configured string) bool {
+	return strings.HasPrefix(configured, "$argon2id$") || isBcryptHash(configured)
+}
+
+func isBcryptHash(configured string) bool {
+	return strings.HasPrefix(configured, "$2a$") || strings.HasPrefix(configured, "$2b$") || strings.HasPrefix(configured, "$2y$")
+}
+
+// matchToken checks if the token matches the configured token,
+// which is either a hash or the plain token for legacy configs.
+// Every comparison is done in constant time.
+func matchToken(configured string, token string) bool {
+	if token == "" || configured == "" {
+		return false
+	}
+
+	switch {
+	case strings.HasPrefix(configured, "$argon2id$"):
+		ok, err := matchArgon2id(configured, token)
+		return err == nil && ok
+	case isBcryptHash(configured):
+		return bcrypt.CompareHashAndPassword([]byte(configured), []byte(token)) == nil
+	default:
+		// hash both, so that the comparison does not
+		// leak the length of the configured token.
+		a := sha256.Sum256([]byte(configured))
+		b := sha256.Sum256([]byte(token))
+		return subtle.ConstantTimeCompare(a[:], b[:]) == 1
+	}
+}
+
+// matchArgon2id checks the token against an argon2id hash in the
+// format `$argon2id$v=19$m=19456,t=2,p=1$<salt>$<key>`.
+func matchArgon2id(hash string, token string) (bool, error) {
+	parts := strings.Split(hash, "$")
+	if len(parts) != 6 {
+		return false, errInvalidHash
+	}
+
+	var version int
+	_, err := fmt.Sscanf(parts[2], "v=%d", &version)
+	if err != nil || version != argon2.Version {
+		return false, errInvalidHash
+	}
+
+	var memory, time uint32
+	var threads uint8
+	_, err = fmt.Sscanf(parts[3], "m=%d,t=%d,p=%d", &memory, &time, &threads)
+	if err != nil {
+		return false, errInvalidHash
+	}
+
+	salt, err := base64.RawStdEncoding.DecodeString(parts[4])
+	if err != nil {
+		return false, errInvalidHash
+	}
+	key, err := base64.RawStdEncoding.DecodeString(parts[5])
+	if err != nil {
+		return false, errInvalidHash
+	}
+
+	other := argon2.IDKey([]byte(token), salt, time, memory, threads, uint32(len(key)))
+	return subtle.ConstantTimeCompare(key, other) == 1, nil
+}
+
+// tokenCacheKey returns the key under which a verified token is cached.
+// The plain token itself is never kept in memory longer than a request.
+func tokenCacheKey(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
+
+// indexTokens checks the ids of the tokens and indexes the hashed tokens
+// by their id. Hashed tokens need an id, as it is the only way to find
+// the hash that has to be verified. Tokens with limits need an id, as
+// their usage is tracked by it.
+func (ac *AuthConfig) indexTokens() error {
+	ac.hashed = map[string]*hashedToken{}
+	ids := map[string]bool{}
+	add := func(configured string, id string, auth *Auth) error {
+		if strings.Contains(id, TokenIdSeparator) {
+			return fmt.Errorf("token id %q must not contain %q", id, TokenIdSeparator)
+		}
+		if id != "" && ids[id] {
+			return fmt.Errorf("token id %q is not unique", id)
+		}
+		ids[id] = true
+
+		if !isHashedToken(configured) {
+			return nil
+		}
+		if id == "" {
+			return errors.New("hashed tokens need an id")
+		}
+		ac.hashed[id] = &hashedToken{hash: configured, auth: auth}
+		return nil
+	}
+
+	for _, tc := range ac.ValidTokens {
+		if tc.Id == "" && tc.hasLimits() {
+			return errors.New("tokens with limits need an id")
+		}
+		err := add(tc.Token, tc.Id, &Auth{Token: tc})
+		if err != nil {
+			return err
+		}
+	}
+	for _, atc := range ac.AdminTokens {
+		err := add(atc.Token, atc.Id, &Auth{Admin: true})
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// hasLimits returns if any limit is configured for the token.
+func (tc *TokenConfig) hasLimits() bool {
+	return tc.MaxFileSize > 0 || tc.MaxStorage > 0 || tc.MaxFiles > 0 || tc.MaxExpiration > 0 || tc.RateLimit != nil
+}
+
+// Lookup returns the result for the token, if it is known without
+// verifying a hash: the token is empty, a plain token, has been verified
+// before or there is no hashed token with its id. Otherwise, the token
+// has to be checked with Authenticate.
+func (ac *AuthConfig) Lookup(token string) (*Auth, bool) {
+	if token == "" {
+		return noAuth, true
+	}
+
+	cacheKey := tokenCacheKey(token)
+	if auth, ok := ac.verified.Load(cacheKey); ok {
+		return auth.(*Auth), true
+	}
+	if ac.failed.contains(cacheKey) {
+		return noAuth, true
+	}
+
+	if auth := ac.matchPlainTokens(token); auth != nil {
+		return auth, true
+	}
+	if ac.findHashedToken(token) == nil {
+		return noAuth, true
+	}
+	return nil, false
+}
+
+// Authenticate checks the token against the tokens of the config. At most
+// one hash is verified, which is the one with the id of the token.
+func (ac *AuthConfig) Authenticate(token string) *Auth {
+	if auth, ok := ac.Lookup(token); ok {
+		return auth
+	}
+
+	ht := ac.findHashedToken(token)
+	verifySlots <- struct{}{}
+	ok := matchToken(ht.hash, token)
+	<-verifySlots
+
+	cacheKey := tokenCacheKey(token)
+	if !ok {
+		ac.failed.add(cacheKey)
+		return noAuth
+	}
+	ac.verified.Store(cacheKey, ht.auth)
+	return ht.auth
+}
+
+// matchPlainTokens returns the result for the token, if it
+// matches one of the plain tokens, otherwise nil.
+func (ac *AuthConfig) matchPlainTokens(token string) *Auth {
+	var auth *Auth
+	for _, tc := range ac.ValidTokens {
+		if !isHashedToken(tc.Token) && matchToken(tc.Token, token) {
+			auth = &Auth{Token: tc}
+			break
+		}
+	}
+	for _, atc := range ac.AdminTokens {
+		if !isHashedToken(atc.Token) && matchToken(atc.Token, token) {
+			if auth == nil {
+				auth = &Auth{}
+			}
+			auth.Admin = true
+			break
+		}
+	}
+	return auth
+}
+
+// findHashedToken returns the hashed token with the id, that
+// the token starts with, or nil if there is none.
+func (ac *AuthConfig) findHashedToken(token string) *hashedToken {
+	i := strings.Index(token, TokenIdSeparator)
+	if i <= 0 {
+		return nil
+	}
+	return ac.hashed[token[:i]]
+}
+
+// tokenSet is a set of token cache keys with a maximum size.
+// If it is full, the oldest key is removed first.
+type tokenSet struct {
+	mu   sync.Mutex
+	keys map[string]bool
+	ring []string
+	next int
+}
+
+func (ts *tokenSet) contains(key string) bool {
+	ts.mu.Lock()
+	defer ts.mu.Unlock()
+	return ts.keys[key]
+}
+
+func (ts *tokenSet) add(key string) {
+	ts.mu.Lock()
+	defer ts.mu.Unlock()
+
+	if ts.keys == nil {
+		ts.keys = map[string]bool{}
+		ts.ring = make([]string, maxFailedTokens)
+	}
+	if ts.keys[key] {
+		return
+	}
+	delete(ts.keys, ts.ring[ts.next])
+	ts.ring[ts.next] = key
+	ts.keys[key] = true
+	ts.next = (ts.next + 1) % len(ts.ring)
+}
@@ -0,0 +1,157 @@
+package config
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+)
+
+func TestAuthenticate(t *testing.T) {
+	argonHash, err := HashToken("alice.secret", HashAlgorithmArgon2id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	bcryptHash, err := HashToken("bob.secret", HashAlgorithmBcrypt)
+	if err != nil {
+		t.Fatal(err)
+	}
+	adminHash, err := HashToken("admin.secret", HashAlgorithmArgon2id)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ac, err := FromData([]byte(fmt.Sprintf(`
+validTokens:
+- token: plain
+  fileTypes:
+  - image/png
+- token: '%s'
+  id: alice
+- token: '%s'
+  id: bob
+adminTokens:
+- token: plain-admin
+- token: '%s'
+  id: admin
+`, argonHash, bcryptHash, adminHash)))
+	if err != nil {
+		t.Fatalf("FromData() error = %v", err)
+	}
+
+	tests := []struct {
+		token string
+		want  string
+		admin bool
+	}{
+		{"plain", "plain", false},
+		{"alice.secret", argonHash, false},
+		{"bob.secret", bcryptHash, false},
+		{"plain-admin", "", true},
+		{"admin.secret", "", true},
+		{"", "", false},
+		{"plai", "", false},
+		{"alice.wrong", "", false},
+		{"bob.wrong", "", false},
+		{"carol.secret", "", false},
+		// the hash itself is not a token
+		{argonHash, "", false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.token, func(t *testing.T) {
+			// the second time, the result comes from the cache
+			for i := 0; i < 2; i++ {
+				auth := ac.Authenticate(tt.token)
+				token := ""
+				if auth.Token != nil {
+					token = auth.Token.Token
+				}
+				if token != tt.want || auth.Admin != tt.admin {
+					t.Errorf("Authenticate() = token %q and admin %v, want token %q and admin %v", token, auth.Admin, tt.want, tt.admin)
+				}
+			}
+		})
+	}
+
+	if !ac.GetToken("plain").CanUpload("image/png") || ac.GetToken("plain").CanUpload("image/gif") {
+		t.Errorf("file types of the token are not respected")
+	}
+	if !ac.GetToken("alice.secret").CanUpload("image/gif") {
+		t.Errorf("token without file types can not upload everything")
+	}
+}
+
+func TestLookup(t *testing.T) {
+	hash, err := HashToken("alice.secret", HashAlgorithmArgon2id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ac, err := FromData([]byte(fmt.Sprintf("validTokens:\n- token: plain\n- token: '%s'\n  id: alice\n", hash)))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// only the hash of a token with known id has to be verified
+	for token, known := range map[string]bool{"plain": true, "unknown": true, "carol.secret": true, "alice.secret": false} {
+		if _, ok := ac.Lookup(token); ok != known {
+			t.Errorf("Lookup(%s) known = %v, want %v", token, ok, known)
+		}
+	}
+
+	ac.Authenticate("alice.secret")
+	ac.Authenticate("alice.wrong")
+	if auth, ok := ac.Lookup("alice.secret"); !ok || auth.Token == nil {
+		t.Errorf("Lookup() of verified token = %+v, %v, want the token", auth, ok)
+	}
+	if auth, ok := ac.Lookup("alice.wrong"); !ok || auth.Token != nil {
+		t.Errorf("Lookup() of failed token = %+v, %v, want no token", auth, ok)
+	}
+}
+
+func TestFromDataInvalidIds(t *testing.T) {
+	tests := map[string]string{
+		"hashed without id":     "validTokens:\n- token: '$2a$12$abcdefghijklmnopqrstuv'\n",
+		"limits without id":     "validTokens:\n- token: plain\n  maxFiles: 10\n",
+		"duplicate id":          "validTokens:\n- token: a\n  id: same\nadminTokens:\n- token: b\n  id: same\n",
+		"id with separator":     "validTokens:\n- token: a\n  id: a.b\n",
+		"admin hash without id": "adminTokens:\n- token: '$argon2id$v=19$m=19456,t=2,p=1$c2FsdA$a2V5'\n",
+	}
+	for name, data := range tests {
+		t.Run(name, func(t *testing.T) {
+			_, err := FromData([]byte(data))
+			if err == nil {
+				t.Errorf("FromData() succeeded")
+			}
+		})
+	}
+}
+
+func TestHashToken(t *testing.T) {
+	for _, algorithm := range []string{HashAlgorithmArgon2id, HashAlgorithmBcrypt} {
+		hash, err := HashToken("id.token", algorithm)
+		if err != nil {
+			t.Fatalf("HashToken(%s) error = %v", algorithm, err)
+		}
+		if !isHashedToken(hash) || strings.Contains(hash, "token") {
+			t.Errorf("HashToken(%s) = %s, which is not a hash", algorithm, hash)
+		}
+		if !matchToken(hash, "id.token") || matchToken(hash, "id.other") {
+			t.Errorf("hash of %s does not match the token", algorithm)
+		}
+
+		// every hash has its own salt
+		again, _ := HashToken("id.token", algorithm)
+		if again == hash {
+			t.Errorf("HashToken(%s) returned the same hash twice", algorithm)
+		}
+	}
+
+	_, err := HashToken("id.token", "md5")
+	if err == nil {
+		t.Errorf("HashToken() with unknown algorithm succeeded")
+	}
+	for _, hash := range []string{"$argon2id$", "$argon2id$v=19$m=1,t=1,p=1$!!!$!!!", "$2a$12$short"} {
+		if matchToken(hash, "id.token") {
+			t.Errorf("invalid hash %q matched", hash)
+		}
+	}
+}
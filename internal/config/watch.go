@@ -0,0 +1,80 @@
+package config
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"github.com/fsnotify/fsnotify"
+	"io/ioutil"
+	"k8s.io/klog"
+	"path/filepath"
+	"time"
+)
+
+// watchDebounce is the time we wait after a change, because
+// editors and Kubernetes often touch a file multiple times in a row.
+const watchDebounce = 500 * time.Millisecond
+
+// WatchFile calls onChange whenever the content of the file at given path changes.
+//
+// Not the file itself but its directory is watched, because Kubernetes mounts
+// ConfigMaps as symlinks, which are swapped atomically on an update. The file
+// itself never changes in that case, it is replaced.
+//
+// The returned function stops the watcher.
+func WatchFile(path string, onChange func()) (func(), error) {
+	watcher, err := fsnotify.NewWatcher()
+	if err != nil {
+		return nil, err
+	}
+
+	err = watcher.Add(filepath.Dir(path))
+	if err != nil {
+		watcher.Close()
+		return nil, err
+	}
+
+	lastSum := fileSum(path)
+	go func() {
+		var debounce <-chan time.Time
+		for {
+			select {
+			case _, ok := <-watcher.Events:
+				if !ok {
+					return
+				}
+				// every event in the directory could be a
+				// symlink swap, so we can't filter by name.
+				debounce = time.After(watchDebounce)
+			case err, ok := <-watcher.Errors:
+				if !ok {
+					return
+				}
+				klog.Warningf("Error while watching %s: %v", path, err)
+			case <-debounce:
+				debounce = nil
+
+				sum := fileSum(path)
+				if sum == nil || bytes.Equal(sum, lastSum) {
+					continue
+				}
+				lastSum = sum
+				onChange()
+			}
+		}
+	}()
+
+	return func() {
+		watcher.Close()
+	}, nil
+}
+
+// fileSum returns the checksum of the file's content
+// or nil, if it could not be read.
+func fileSum(path string) []byte {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil
+	}
+	sum := sha256.Sum256(data)
+	return sum[:]
+}
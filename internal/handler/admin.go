@@ -0,0 +1,338 @@
+package handler
+
+import (
+	"errors"
+	"github.com/gin-gonic/gin"
+	"github.com/superioz/aqua/internal/config"
+	"github.com/superioz/aqua/internal/metrics"
+	"github.com/superioz/aqua/internal/storage"
+	"github.com/superioz/aqua/pkg/env"
+	"k8s.io/klog"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+)
+
+const (
+	defaultPerPage = 50
+	maxPerPage     = 1000
+)
+
+// AdminHandler implements the admin API for managing the stored files.
+// Every request has to be authorized with an admin token, see RequireAdmin.
+type AdminHandler struct {
+	FileStorage *storage.FileStorage
+
+	// mu guards the runs of the scrub and the reconciliation,
+	// which are started via the API and run in the background.
+	mu        sync.Mutex
+	scrub     adminRun
+	reconcile adminRun
+}
+
+// adminRun is the state of the last scrub or reconciliation
+// started via the API.
+type adminRun struct {
+	Running    bool   `json:"running"`
+	StartedAt  int64  `json:"startedAt"`
+	FinishedAt int64  `json:"finishedAt"`
+	Error      string `json:"error,omitempty"`
+
+	// Report is the report of the last finished run.
+	Report interface{} `json:"report"`
+}
+
+// start marks the run as running. The mutex has to be held by the caller.
+func (r *adminRun) start() {
+	*r = adminRun{Running: true, StartedAt: time.Now().Unix(), Report: r.Report}
+}
+
+// finish stores the result of the run. The mutex has to be held by the caller.
+func (r *adminRun) finish(report interface{}, err error) {
+	r.Running = false
+	r.FinishedAt = time.Now().Unix()
+	if err != nil {
+		r.Error = err.Error()
+		return
+	}
+	r.Report = report
+}
+
+func NewAdminHandler(fs *storage.FileStorage) *AdminHandler {
+	return &AdminHandler{FileStorage: fs}
+}
+
+// RequireAdmin is the middleware, which only lets requests
+// through that contain a valid admin token.
+func (h *UploadHandler) RequireAdmin() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		if !h.authenticate(c).Admin {
+			c.AbortWithStatusJSON(http.StatusUnauthorized, gin.H{"msg": "the token is not valid"})
+			return
+		}
+		c.Next()
+	}
+}
+
+// ListFiles returns the stored files page by page. The files can be filtered
+// by `mimeType`, `uploadedAfter` and `uploadedBefore` (unix time) and `expired`.
+func (h *AdminHandler) ListFiles(c *gin.Context) {
+	page, err := queryInt(c, "page", 1)
+	if err != nil || page < 1 {
+		c.JSON(http.StatusBadRequest, gin.H{"msg": "page is not valid"})
+		return
+	}
+	perPage, err := queryInt(c, "perPage", defaultPerPage)
+	if err != nil || perPage < 1 || perPage > maxPerPage {
+		c.JSON(http.StatusBadRequest, gin.H{"msg": "perPage is not valid"})
+		return
+	}
+
+	filter := &storage.FileFilter{
+		MimeType: c.Query("mimeType"),
+		KeyId:    c.Query("keyId"),
+		Limit:    int(perPage),
+		Offset:   int((page - 1) * perPage),
+	}
+	filter.UploadedAfter, err = queryInt(c, "uploadedAfter", 0)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"msg": "uploadedAfter is not valid"})
+		return
+	}
+	filter.UploadedBefore, err = queryInt(c, "uploadedBefore", 0)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"msg": "uploadedBefore is not valid"})
+		return
+	}
+	if e := c.Query("expired"); e != "" {
+		expired, err := strconv.ParseBool(e)
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"msg": "expired is not valid"})
+			return
+		}
+		filter.Expired = &expired
+	}
+
+	files, total, err := h.FileStorage.ListFiles(filter)
+	if err != nil {
+		klog.Error(err)
+		c.JSON(http.StatusInternalServerError, gin.H{"msg": "could not list files"})
+		return
+	}
+	if files == nil {
+		files = []*storage.StoredFile{}
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"files":   files,
+		"total":   total,
+		"page":    page,
+		"perPage": perPage,
+	})
+}
+
+// GetFile returns the metadata of a single file.
+func (h *AdminHandler) GetFile(c *gin.Context) {
+	sf, err := h.FileStorage.GetFile(c.Param("id"))
+	if err != nil {
+		klog.Error(err)
+		c.JSON(http.StatusInternalServerError, gin.H{"msg": "could not get file"})
+		return
+	}
+	if sf == nil {
+		c.JSON(http.StatusNotFound, gin.H{"msg": "file does not exist"})
+		return
+	}
+	c.JSON(http.StatusOK, sf)
+}
+
+type updateFileRequest struct {
+	// Expiration in seconds from now on, like on upload.
+	Expiration *int64 `json:"expiration"`
+}
+
+// UpdateFile changes the expiration of a file.
+func (h *AdminHandler) UpdateFile(c *gin.Context) {
+	var req updateFileRequest
+	err := c.ShouldBindJSON(&req)
+	if err != nil || req.Expiration == nil || (*req.Expiration < 0 && *req.Expiration != config.ExpireNever) {
+		c.JSON(http.StatusBadRequest, gin.H{"msg": "expiration is not valid"})
+		return
+	}
+
+	sf, err := h.FileStorage.SetExpiration(c.Param("id"), *req.Expiration)
+	if err != nil {
+		klog.Error(err)
+		c.JSON(http.StatusInternalServerError, gin.H{"msg": "could not update file"})
+		return
+	}
+	if sf == nil {
+		c.JSON(http.StatusNotFound, gin.H{"msg": "file does not exist"})
+		return
+	}
+
+	klog.Infof("Changed expiration of file %s to %d", sf.Id, sf.ExpiresAt)
+	c.JSON(http.StatusOK, sf)
+}
+
+// DeleteFile deletes a single file.
+func (h *AdminHandler) DeleteFile(c *gin.Context) {
+	id := c.Param("id")
+	ok, err := h.FileStorage.DeleteFile(id)
+	if err != nil {
+		klog.Error(err)
+		c.JSON(http.StatusInternalServerError, gin.H{"msg": "could not delete file"})
+		return
+	}
+	if !ok {
+		c.JSON(http.StatusNotFound, gin.H{"msg": "file does not exist"})
+		return
+	}
+
+	klog.Infof("Deleted file %s via admin API", id)
+	metrics.IncFilesDeleted()
+	c.JSON(http.StatusOK, gin.H{"msg": "file has been deleted"})
+}
+
+type bulkDeleteRequest struct {
+	Ids []string `json:"ids"`
+}
+
+// DeleteFiles deletes all files with the given ids and
+// returns which of them have been deleted.
+func (h *AdminHandler) DeleteFiles(c *gin.Context) {
+	var req bulkDeleteRequest
+	err := c.ShouldBindJSON(&req)
+	if err != nil || len(req.Ids) == 0 {
+		c.JSON(http.StatusBadRequest, gin.H{"msg": "ids are not valid"})
+		return
+	}
+
+	deleted := []string{}
+	notFound := []string{}
+	for _, id := range req.Ids {
+		ok, err := h.FileStorage.DeleteFile(id)
+		if err != nil {
+			klog.Error(err)
+			c.JSON(http.StatusInternalServerError, gin.H{
+				"msg":     "could not delete file " + id,
+				"deleted": deleted,
+			})
+			return
+		}
+		if !ok {
+			notFound = append(notFound, id)
+			continue
+		}
+
+		klog.Infof("Deleted file %s via admin API", id)
+		metrics.IncFilesDeleted()
+		deleted = append(deleted, id)
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"deleted":  deleted,
+		"notFound": notFound,
+	})
+}
+
+// Scrub starts to check the content of all stored files against their digest
+// in the background, see ScrubStatus for the report. Corrupt files are
+// quarantined, if `quarantine` or SCRUB_QUARANTINE is true.
+func (h *AdminHandler) Scrub(c *gin.Context) {
+	quarantine := env.BoolOrDefault("SCRUB_QUARANTINE", false)
+	if q := c.Query("quarantine"); q != "" {
+		b, err := strconv.ParseBool(q)
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"msg": "quarantine is not valid"})
+			return
+		}
+		quarantine = b
+	}
+
+	// the run can only finish after the lock has been released
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	err := h.FileStorage.StartScrub(quarantine, func(report *storage.ScrubReport, err error) {
+		if err != nil {
+			klog.Errorf("Could not scrub files: %v", err)
+		}
+		h.mu.Lock()
+		defer h.mu.Unlock()
+		h.scrub.finish(report, err)
+	})
+	if errors.Is(err, storage.ErrScrubRunning) {
+		c.JSON(http.StatusConflict, gin.H{"msg": err.Error()})
+		return
+	}
+	if err != nil {
+		klog.Error(err)
+		c.JSON(http.StatusInternalServerError, gin.H{"msg": "could not scrub files"})
+		return
+	}
+	h.scrub.start()
+	c.JSON(http.StatusAccepted, gin.H{"msg": "scrub has been started"})
+}
+
+// ScrubStatus returns if a scrub started via the API is running
+// and the report of the last one.
+func (h *AdminHandler) ScrubStatus(c *gin.Context) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	c.JSON(http.StatusOK, h.scrub)
+}
+
+// Reconcile starts to compare the physical files with the metadata in the
+// background, see ReconcileStatus for the report. The `policy` defaults
+// to RECONCILE_POLICY.
+func (h *AdminHandler) Reconcile(c *gin.Context) {
+	policy := c.Query("policy")
+	if policy == "" {
+		policy = env.StringOrDefault("RECONCILE_POLICY", config.EnvDefaultReconcilePolicy)
+	}
+
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	err := h.FileStorage.StartReconcile(policy, func(report *storage.ReconcileReport, err error) {
+		if err != nil {
+			klog.Errorf("Could not reconcile files: %v", err)
+		}
+		h.mu.Lock()
+		defer h.mu.Unlock()
+		h.reconcile.finish(report, err)
+	})
+	if errors.Is(err, storage.ErrUnknownReconcilePolicy) {
+		c.JSON(http.StatusBadRequest, gin.H{"msg": "policy is not valid"})
+		return
+	}
+	if errors.Is(err, storage.ErrReconcileRunning) {
+		c.JSON(http.StatusConflict, gin.H{"msg": err.Error()})
+		return
+	}
+	if err != nil {
+		klog.Error(err)
+		c.JSON(http.StatusInternalServerError, gin.H{"msg": "could not reconcile files"})
+		return
+	}
+	h.reconcile.start()
+	c.JSON(http.StatusAccepted, gin.H{"msg": "reconciliation has been started"})
+}
+
+// ReconcileStatus returns if a reconciliation started via
+// the API is running and the report of the last one.
+func (h *AdminHandler) ReconcileStatus(c *gin.Context) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	c.JSON(http.StatusOK, h.reconcile)
+}
+
+// queryInt returns the query parameter as integer
+// or the default, if it is not set.
+func queryInt(c *gin.Context, key string, def int64) (int64, error) {
+	s := c.Query(key)
+	if s == "" {
+		return def, nil
+	}
+	return strconv.ParseInt(s, 10, 64)
+}
@@ -0,0 +1,48 @@
+package handler
+
+import (
+	"encoding/json"
+	"github.com/superioz/aqua/internal/storage"
+	"net/http"
+	"testing"
+	"time"
+)
+
+func TestAdminScrub(t *testing.T) {
+	uh := newTestUploadHandler(t, testTusAuthConfig)
+	r := newTestRouter(uh)
+	ah := NewAdminHandler(uh.FileStorage)
+	r.GET("/api/admin/scrub", ah.ScrubStatus)
+	r.POST("/api/admin/scrub", ah.Scrub)
+	uploadFile(t, r, "content")
+
+	w := serve(r, http.MethodPost, "/api/admin/scrub", nil, nil)
+	if w.Code != http.StatusAccepted {
+		t.Fatalf("scrub returned %d: %s", w.Code, w.Body.String())
+	}
+
+	// the scrub runs in the background
+	var status struct {
+		Running bool                 `json:"running"`
+		Report  *storage.ScrubReport `json:"report"`
+	}
+	for i := 0; i < 100; i++ {
+		w = serve(r, http.MethodGet, "/api/admin/scrub", nil, nil)
+		err := json.Unmarshal(w.Body.Bytes(), &status)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !status.Running {
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if status.Running || status.Report == nil || status.Report.Checked != 1 {
+		t.Errorf("scrub status = %s, want the report of 1 checked blob", w.Body.String())
+	}
+
+	w = serve(r, http.MethodPost, "/api/admin/scrub?quarantine=maybe", nil, nil)
+	if w.Code != http.StatusBadRequest {
+		t.Errorf("scrub with invalid quarantine returned %d, want 400", w.Code)
+	}
+}
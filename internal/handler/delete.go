@@ -0,0 +1,106 @@
+package handler
+
+import (
+	"fmt"
+	"github.com/gin-gonic/gin"
+	"github.com/superioz/aqua/internal/metrics"
+	"github.com/superioz/aqua/internal/storage"
+	"html/template"
+	"k8s.io/klog"
+	"net/http"
+	"net/url"
+
+	_ "embed"
+)
+
+//go:embed templates/delete.html
+var deletePageHtml string
+
+var deletePage = template.Must(template.New("delete").Parse(deletePageHtml))
+
+// DeleteFile deletes the requested file, if the deletion key
+// that was returned on upload is given via query, header or form.
+func (h *UploadHandler) DeleteFile(c *gin.Context) {
+	sf, ok := h.getFileToDelete(c)
+	if !ok {
+		return
+	}
+
+	ok, err := h.FileStorage.DeleteFile(sf.Id)
+	if err != nil {
+		klog.Error(err)
+		c.JSON(http.StatusInternalServerError, gin.H{"msg": "could not delete file"})
+		return
+	}
+	if !ok {
+		// deleted by someone else in the meantime
+		c.JSON(http.StatusNotFound, gin.H{"msg": "file does not exist"})
+		return
+	}
+
+	klog.Infof("Deleted file %s via deletion key", sf.Id)
+	metrics.IncFilesDeleted()
+	c.JSON(http.StatusOK, gin.H{"msg": "file has been deleted"})
+}
+
+// ConfirmDeletion shows a page, that deletes the file only after the
+// deletion has been confirmed. Otherwise, everything that merely opens
+// the deletion url (e.g. link previews) would delete the file.
+func (h *UploadHandler) ConfirmDeletion(c *gin.Context) {
+	_, ok := h.getFileToDelete(c)
+	if !ok {
+		return
+	}
+
+	c.Header("Cache-Control", "no-store")
+	c.Header("Content-Type", "text/html; charset=utf-8")
+	c.Status(http.StatusOK)
+	err := deletePage.Execute(c.Writer, gin.H{
+		"Action":   c.Request.URL.Path,
+		"FileName": c.Param("file"),
+		"Key":      getDeletionKey(c),
+	})
+	if err != nil {
+		klog.Error(err)
+	}
+}
+
+// getFileToDelete returns the requested file, if the deletion key is valid.
+func (h *UploadHandler) getFileToDelete(c *gin.Context) (*storage.StoredFile, bool) {
+	sf, err := h.FileStorage.GetFile(getFileId(c))
+	if err != nil {
+		klog.Error(err)
+		c.JSON(http.StatusInternalServerError, gin.H{"msg": "could not get file"})
+		return nil, false
+	}
+	if sf == nil {
+		c.JSON(http.StatusNotFound, gin.H{"msg": "file does not exist"})
+		return nil, false
+	}
+	if !sf.CheckDeletionKey(getDeletionKey(c)) {
+		c.JSON(http.StatusForbidden, gin.H{"msg": "the deletion key is not valid"})
+		return nil, false
+	}
+	return sf, true
+}
+
+// getDeletionKey returns the deletion key given by the
+// query, the header or the form of the confirmation page.
+func getDeletionKey(c *gin.Context) string {
+	if key := c.Query("key"); key != "" {
+		return key
+	}
+	if key := c.GetHeader(HeaderDeletionKey); key != "" {
+		return key
+	}
+	if c.Request.Method == http.MethodPost {
+		return c.PostForm("key")
+	}
+	return ""
+}
+
+// getDeletionUrl returns the url, which deletes the file
+// after the deletion has been confirmed.
+func getDeletionUrl(c *gin.Context, sf *storage.StoredFile) string {
+	return fmt.Sprintf("%s/%s/delete?key=%s", getPublicUrl(c), sf.Id, url.QueryEscape(sf.DeletionKey))
+}
@@ -1,64 +1,105 @@
 package handler
 
 import (
+	"errors"
 	"fmt"
 	"github.com/gin-gonic/gin"
 	"github.com/superioz/aqua/internal/config"
 	"github.com/superioz/aqua/internal/metrics"
 	"github.com/superioz/aqua/internal/mime"
 	"github.com/superioz/aqua/internal/request"
+	"github.com/superioz/aqua/internal/sanitize"
 	"github.com/superioz/aqua/internal/storage"
 	"github.com/superioz/aqua/pkg/env"
+	"io"
 	"k8s.io/klog"
 	"mime/multipart"
 	"net/http"
-	"os"
 	"strings"
+	"sync/atomic"
 )
 
 const (
 	SizeMegaByte = 1 << (10 * 2)
+
+	// HeaderDeletionKey can contain the deletion key
+	// of a file, instead of the query parameter.
+	HeaderDeletionKey = "Aqua-Deletion-Key"
+
+	// HeaderFileDigest contains the hex encoded SHA-256
+	// of a file, after its upload has been completed.
+	HeaderFileDigest = "Aqua-File-Digest"
 )
 
 type UploadHandler struct {
-	AuthConfig  *config.AuthConfig
 	FileStorage *storage.FileStorage
 
+	// PartialUploads contains the resumable uploads,
+	// that have not been completed yet.
+	PartialUploads *storage.PartialUploadStore
+
 	// excluded as per defined by the environment variable
 	// FILE_EXTENSIONS_EXCEPT
 	exclMimeTypes []string
+
+	// authConfig contains the current *config.AuthConfig. It is swapped
+	// atomically on reload, so that running requests are not affected.
+	authConfig atomic.Value
+
+	tokenQuotas tokenQuotas
 }
 
 func NewUploadHandler() *UploadHandler {
 	handler := &UploadHandler{}
-	handler.ReloadAuthConfig()
+	err := handler.ReloadAuthConfig()
+	if err != nil {
+		// this is not good, but the system still works.
+		// nobody can upload a file though.
+		handler.authConfig.Store(config.NewEmptyAuthConfig())
+	}
 
 	handler.FileStorage = storage.NewFileStorage()
+	handler.PartialUploads = storage.NewPartialUploadStore(env.StringOrDefault("TUS_UPLOAD_PATH", config.EnvDefaultTusUploadPath))
 	handler.exclMimeTypes = env.ListOrDefault("FILE_EXTENSIONS_EXCLUDED", []string{"image/png", "image/jpeg"})
 	return handler
 }
 
+// AuthConfig returns the currently loaded auth config.
+func (h *UploadHandler) AuthConfig() *config.AuthConfig {
+	return h.authConfig.Load().(*config.AuthConfig)
+}
+
 // ReloadAuthConfig reloads the auth.yml config from the local file system.
-func (h *UploadHandler) ReloadAuthConfig() {
-	path := env.StringOrDefault("AUTH_CONFIG_PATH", "/etc/aqua/auth.yml")
+// If the config can't be loaded, the previous config stays active.
+func (h *UploadHandler) ReloadAuthConfig() error {
+	path := getAuthConfigPath()
 	ac, err := config.FromLocalFile(path)
 	if err != nil {
-		// this is not good, but the system still works.
-		// nobody can upload a file though.
-		klog.Warningf("Could not open auth config at %s: %v", path, err)
-		h.AuthConfig = config.NewEmptyAuthConfig()
-	} else {
-		klog.Infof("Loaded %d valid tokens", len(ac.ValidTokens))
-		h.AuthConfig = ac
+		klog.Warningf("Could not load auth config at %s: %v", path, err)
+		return err
 	}
+
+	klog.Infof("Loaded %d valid tokens", len(ac.ValidTokens))
+	h.authConfig.Store(ac)
+	return nil
 }
 
-func (h *UploadHandler) Upload(c *gin.Context) {
-	// get token for auth
-	// empty string, if not given
-	token := getToken(c)
+// WatchAuthConfig reloads the auth config whenever the file changes.
+// The returned function stops watching.
+func (h *UploadHandler) WatchAuthConfig() (func(), error) {
+	return config.WatchFile(getAuthConfigPath(), func() {
+		klog.Infoln("Auth config has changed, reloading ...")
+		_ = h.ReloadAuthConfig()
+	})
+}
 
-	if !h.AuthConfig.HasToken(token) {
+func getAuthConfigPath() string {
+	return env.StringOrDefault("AUTH_CONFIG_PATH", "/etc/aqua/auth.yml")
+}
+
+func (h *UploadHandler) Upload(c *gin.Context) {
+	tc := h.authenticate(c).Token
+	if tc == nil {
 		c.JSON(http.StatusUnauthorized, gin.H{"msg": "the token is not valid"})
 		return
 	}
@@ -84,44 +125,95 @@ func (h *UploadHandler) Upload(c *gin.Context) {
 		c.Status(http.StatusLengthRequired)
 		return
 	}
-	if c.Request.ContentLength > int64(env.IntOrDefault("FILE_MAX_SIZE", 100))*SizeMegaByte {
-		c.JSON(http.StatusRequestEntityTooLarge, gin.H{"msg": "content size must not exceed 50mb"})
+	if c.Request.ContentLength > maxFileSize() {
+		c.JSON(http.StatusRequestEntityTooLarge, gin.H{"msg": fmt.Sprintf("content size must not exceed %dmb", maxFileSize()/SizeMegaByte)})
+		return
+	}
+
+	of, err := file.Open()
+	if err != nil {
+		klog.Error(err)
+		c.JSON(http.StatusInternalServerError, gin.H{"msg": "could not open file"})
+		return
+	}
+	defer of.Close()
+
+	ct, err := resolveContentType(getContentType(file), of)
+	if err != nil {
+		c.JSON(http.StatusUnsupportedMediaType, gin.H{"msg": err.Error()})
 		return
 	}
 
-	ct := getContentType(file)
 	if !mime.IsValid(ct) {
 		c.JSON(http.StatusBadRequest, gin.H{"msg": "content type of file is not valid"})
 		return
 	}
 
-	if !h.AuthConfig.CanUpload(token, ct) {
+	if !tc.CanUpload(ct) {
 		c.JSON(http.StatusForbidden, gin.H{"msg": "you can not upload a file with this content type"})
 		return
 	}
 
-	mb := float64(c.Request.ContentLength) / 1024 / 1024
-	klog.Infof("Received valid upload request (type: %s, size: %.3fmb)", ct, mb)
+	metadata := request.GetMetadata(form)
+	if len(metadata.Password) > storage.MaxPasswordLength {
+		c.JSON(http.StatusBadRequest, gin.H{"msg": fmt.Sprintf("password must not exceed %d bytes", storage.MaxPasswordLength)})
+		return
+	}
 
-	of, err := file.Open()
+	release, err := h.checkLimits(tc, file.Size, metadata.Expiration)
+	if le, ok := err.(*limitError); ok {
+		c.JSON(le.status, gin.H{"msg": le.msg})
+		return
+	}
 	if err != nil {
 		klog.Error(err)
-		c.JSON(http.StatusInternalServerError, gin.H{"msg": "could not open file"})
+		c.JSON(http.StatusInternalServerError, gin.H{"msg": "could not check limits"})
 		return
 	}
-	defer of.Close()
+	defer release()
+
+	mb := float64(file.Size) / 1024 / 1024
+	klog.Infof("Received valid upload request (type: %s, size: %.3fmb)", ct, mb)
 
-	metadata := request.GetMetadata(form)
 	rff := &request.RequestFormFile{
 		File:          of,
 		ContentType:   ct,
-		ContentLength: c.Request.ContentLength,
+		ContentLength: file.Size,
 	}
 
-	sf, err := h.FileStorage.StoreFile(rff, metadata.Expiration)
+	sf, storedName, err := h.storeFile(rff, metadata, tc, "")
+	if msg, ok := getSanitizeError(err); ok {
+		c.JSON(http.StatusUnprocessableEntity, gin.H{"msg": msg})
+		return
+	}
 	if err != nil {
 		klog.Error(err)
 		c.JSON(http.StatusInternalServerError, gin.H{"msg": "could not store file"})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"fileName":    storedName,
+		"digest":      sf.Digest,
+		"deletionKey": sf.DeletionKey,
+		"deletionUrl": getDeletionUrl(c, sf),
+	})
+}
+
+// storeFile stores the validated file and returns it together
+// with the name under which the file can be accessed. The language
+// is only given for pastes, see storage.StoredFile.Language.
+func (h *UploadHandler) storeFile(rff *request.RequestFormFile, metadata *request.RequestMetadata, tc *config.TokenConfig, language string) (*storage.StoredFile, string, error) {
+	sf, err := h.FileStorage.StoreFile(rff, &storage.StoreOptions{
+		Expiration:    metadata.Expiration,
+		TokenId:       tc.Id,
+		MaxDownloads:  metadata.MaxDownloads,
+		Password:      metadata.Password,
+		StripMetadata: shouldStripMetadata(tc),
+		Language:      language,
+	})
+	if err != nil {
+		return nil, "", err
 	}
 
 	expiresIn := "never"
@@ -138,8 +230,57 @@ func (h *UploadHandler) Upload(c *gin.Context) {
 	if env.BoolOrDefault("FILE_EXTENSIONS_RESPONSE", true) && !h.isExtensionExcluded(sf.MimeType) {
 		storedName = fmt.Sprintf("%s.%s", storedName, mime.GetExtension(sf.MimeType))
 	}
+	return sf, storedName, nil
+}
+
+// shouldStripMetadata returns if metadata has to be removed from
+// images uploaded with given token.
+func shouldStripMetadata(tc *config.TokenConfig) bool {
+	if tc.StripMetadata != nil {
+		return *tc.StripMetadata
+	}
+	return env.BoolOrDefault("STRIP_METADATA", false)
+}
+
+// getSanitizeError returns the message for the client, if the file
+// could not be stored because it could not be sanitized.
+func getSanitizeError(err error) (string, bool) {
+	if errors.Is(err, sanitize.ErrMalformed) {
+		return "the file could not be sanitized, as it is malformed", true
+	}
+	if errors.Is(err, sanitize.ErrImageTooLarge) {
+		return "the metadata could not be removed, as the image is too large", true
+	}
+	return "", false
+}
+
+// getPublicUrl returns the url under which the server is reachable. Uses
+// SERVER_PUBLIC_URL if set, otherwise it is derived from the request.
+func getPublicUrl(c *gin.Context) string {
+	if publicUrl, ok := env.String("SERVER_PUBLIC_URL"); ok && publicUrl != "" {
+		return strings.TrimSuffix(publicUrl, "/")
+	}
 
-	c.JSON(http.StatusOK, gin.H{"fileName": storedName})
+	scheme := "http"
+	if c.Request.TLS != nil {
+		scheme = "https"
+	}
+	if proto := c.GetHeader("X-Forwarded-Proto"); proto != "" {
+		scheme = proto
+	}
+	return scheme + "://" + c.Request.Host
+}
+
+// getFileId returns the id of the requested file.
+func getFileId(c *gin.Context) string {
+	fileName := c.Param("file")
+
+	// the file name could contain the extension
+	// we split it and ship it.
+	if strings.Contains(fileName, ".") {
+		fileName = strings.Split(fileName, ".")[0]
+	}
+	return fileName
 }
 
 // isExtensionExcluded returns if the given mime type
@@ -154,6 +295,57 @@ func (h *UploadHandler) isExtensionExcluded(mimeType string) bool {
 	return false
 }
 
+// maxFileSize returns the maximum size of an
+// uploaded file in bytes.
+func maxFileSize() int64 {
+	return int64(env.IntOrDefault("FILE_MAX_SIZE", 100)) * SizeMegaByte
+}
+
+var (
+	errContentTypeMismatch = errors.New("content type of file does not match its content")
+	errContentTypeUnknown  = errors.New("content type of file could not be detected")
+)
+
+// resolveContentType compares the declared content type with the type
+// detected from the first bytes of the file. What happens on a mismatch is
+// decided by FILE_TYPE_POLICY:
+//
+// - reject: the file is rejected
+// - correct: the detected type is used instead
+// - trust: the declared type is used, i.e. no detection at all
+//
+// The file is reset to its start afterwards.
+func resolveContentType(declared string, f io.ReadSeeker) (string, error) {
+	policy := env.StringOrDefault("FILE_TYPE_POLICY", config.EnvDefaultFileTypePolicy)
+	if policy == config.FileTypePolicyTrust {
+		return declared, nil
+	}
+
+	head := make([]byte, mime.HeaderSize)
+	n, err := io.ReadFull(f, head)
+	if err != nil && err != io.ErrUnexpectedEOF && err != io.EOF {
+		return "", err
+	}
+	_, err = f.Seek(0, io.SeekStart)
+	if err != nil {
+		return "", err
+	}
+
+	detected := mime.Detect(head[:n])
+	if mime.Matches(declared, detected) {
+		return declared, nil
+	}
+	klog.Infof("Declared content type %s does not match detected type %q", declared, detected)
+
+	if policy == config.FileTypePolicyCorrect {
+		if detected == "" {
+			return "", errContentTypeUnknown
+		}
+		return detected, nil
+	}
+	return "", errContentTypeMismatch
+}
+
 // workaround for file Content-Type headers
 // which contain multiple values such as "...; charset=utf-8"
 func getContentType(f *multipart.FileHeader) string {
@@ -166,6 +358,22 @@ func getContentType(f *multipart.FileHeader) string {
 	return c
 }
 
+// authContextKey is the key of the *config.Auth in the context.
+const authContextKey = "aqua.auth"
+
+// authenticate returns the result of checking the token of the request.
+// The token is only checked once per request, the result is kept in the
+// context, so that the same config is used for the whole request, even
+// if it is reloaded in the meantime.
+func (h *UploadHandler) authenticate(c *gin.Context) *config.Auth {
+	if auth, ok := c.Get(authContextKey); ok {
+		return auth.(*config.Auth)
+	}
+	auth := h.AuthConfig().Authenticate(getToken(c))
+	c.Set(authContextKey, auth)
+	return auth
+}
+
 func getToken(c *gin.Context) string {
 	// try to get the Bearer token, because it's the standard
 	// for authorization
@@ -178,30 +386,3 @@ func getToken(c *gin.Context) string {
 	spl := strings.Split(bearerToken, "Bearer ")
 	return spl[1]
 }
-
-// HandleStaticFiles takes the files inside the configured file storage
-// path and serves them to the client.
-func HandleStaticFiles() gin.HandlerFunc {
-	fileStoragePath := env.StringOrDefault("FILE_STORAGE_PATH", config.EnvDefaultFileStoragePath)
-
-	return func(c *gin.Context) {
-		fileName := c.Param("file")
-
-		// the file name could contain the extension
-		// we split it and ship it.
-		if strings.Contains(fileName, ".") {
-			fileName = strings.Split(fileName, ".")[0]
-		}
-
-		fullPath := fileStoragePath + fileName
-
-		f, err := os.Open(fullPath)
-		if err != nil {
-			c.Status(http.StatusNotFound)
-			return
-		}
-		f.Close()
-
-		c.File(fullPath)
-	}
-}
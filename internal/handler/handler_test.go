@@ -0,0 +1,113 @@
+package handler
+
+import (
+	"bytes"
+	"github.com/gin-gonic/gin"
+	"io"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"net/textproto"
+	"os"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+const testToken = "test-token"
+
+// newTestUploadHandler creates an upload handler that stores everything
+// in a temporary directory, with given content of the auth.yml.
+func newTestUploadHandler(t *testing.T, authConfig string) *UploadHandler {
+	gin.SetMode(gin.TestMode)
+	dir := t.TempDir()
+
+	err := os.WriteFile(dir+"/auth.yml", []byte(authConfig), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Setenv("AUTH_CONFIG_PATH", dir+"/auth.yml")
+	t.Setenv("FILE_STORAGE_PATH", dir+"/files/")
+	t.Setenv("FILE_META_DB_PATH", dir+"/")
+	t.Setenv("TUS_UPLOAD_PATH", dir+"/uploads/")
+
+	uh := NewUploadHandler()
+	t.Cleanup(func() { uh.FileStorage.Close() })
+	return uh
+}
+
+// newTestRouter registers the upload routes of the handler.
+func newTestRouter(uh *UploadHandler) *gin.Engine {
+	r := gin.New()
+	r.POST("/upload", uh.Upload)
+	r.POST("/tus/", uh.TusCreate)
+	r.HEAD("/tus/:id", uh.TusHead)
+	r.PATCH("/tus/:id", uh.TusPatch)
+	r.DELETE("/tus/:id", uh.TusDelete)
+	r.GET("/:file", HandleStaticFiles(uh.FileStorage))
+	return r
+}
+
+// serve sends the request with the test token to the router.
+func serve(r http.Handler, method string, path string, body io.Reader, headers map[string]string) *httptest.ResponseRecorder {
+	req := httptest.NewRequest(method, path, body)
+	req.Header.Set("Authorization", "Bearer "+testToken)
+	for k, v := range headers {
+		req.Header.Set(k, v)
+	}
+	w := httptest.NewRecorder()
+	r.ServeHTTP(w, req)
+	return w
+}
+
+// uploadFile uploads a text file with given content via the form upload.
+func uploadFile(t *testing.T, r http.Handler, content string) *httptest.ResponseRecorder {
+	t.Helper()
+	return uploadFileWithMetadata(t, r, content, "")
+}
+
+// uploadFileWithMetadata uploads a text file with given
+// content and the metadata as JSON, if it is not empty.
+func uploadFileWithMetadata(t *testing.T, r http.Handler, content string, metadata string) *httptest.ResponseRecorder {
+	t.Helper()
+
+	var body bytes.Buffer
+	mw := multipart.NewWriter(&body)
+	header := textproto.MIMEHeader{}
+	header.Set("Content-Disposition", `form-data; name="file"; filename="file.txt"`)
+	header.Set("Content-Type", "text/plain")
+	part, err := mw.CreatePart(header)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, _ = part.Write([]byte(content))
+	if metadata != "" {
+		_ = mw.WriteField("metadata", metadata)
+	}
+	err = mw.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return serve(r, http.MethodPost, "/upload", &body, map[string]string{
+		"Content-Type":   mw.FormDataContentType(),
+		"Content-Length": strconv.Itoa(body.Len()),
+	})
+}
+
+// assertStoredContent checks the content of the file
+// with given name, which may contain an extension.
+func assertStoredContent(t *testing.T, uh *UploadHandler, name string, want string) {
+	t.Helper()
+
+	_, f, err := uh.FileStorage.OpenFile(strings.Split(name, ".")[0])
+	if err != nil {
+		t.Fatalf("could not open stored file %s: %v", name, err)
+	}
+	defer f.Close()
+
+	got, err := io.ReadAll(f)
+	if err != nil || string(got) != want {
+		t.Errorf("stored file %s = %q, %v, want %q", name, got, err, want)
+	}
+}
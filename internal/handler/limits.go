@@ -0,0 +1,173 @@
+package handler
+
+import (
+	"fmt"
+	"github.com/gin-gonic/gin"
+	"github.com/superioz/aqua/internal/config"
+	"github.com/superioz/aqua/internal/storage"
+	"github.com/superioz/aqua/pkg/env"
+	"github.com/superioz/aqua/pkg/middleware"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+)
+
+const (
+	RateLimitKindToken    = "token"
+	RateLimitKindIp       = "ip"
+	RateLimitKindVerify   = "verify"
+	RateLimitKindPassword = "password"
+)
+
+// limitError is returned if an upload exceeds
+// one of the limits configured for its token.
+type limitError struct {
+	status int
+	msg    string
+}
+
+func (e *limitError) Error() string {
+	return e.msg
+}
+
+// tokenQuotas keeps track of the uploads, that have passed the quota of
+// their token but are not stored yet. Otherwise, parallel uploads could
+// all pass the check and exceed the quota together. The reservations only
+// exist inside of this process, parallel uploads to other instances
+// are not taken into account.
+type tokenQuotas struct {
+	quotas sync.Map
+}
+
+// tokenQuota is the reserved usage of a single token.
+type tokenQuota struct {
+	mu       sync.Mutex
+	reserved storage.TokenUsage
+}
+
+func (tq *tokenQuotas) get(tokenId string) *tokenQuota {
+	q, _ := tq.quotas.LoadOrStore(tokenId, &tokenQuota{})
+	return q.(*tokenQuota)
+}
+
+// checkLimits checks if a file with given size and expiration can be
+// uploaded with the token. Returns a *limitError if a limit is exceeded.
+//
+// If the token has a quota, the size of the file is reserved until the
+// returned function is called, which has to happen after the file has been
+// stored (or not). Until then, the file may count twice, which errs on the
+// safe side.
+func (h *UploadHandler) checkLimits(tc *config.TokenConfig, size int64, expiration int64) (func(), error) {
+	if tc.MaxFileSize > 0 && size > tc.MaxFileSize*SizeMegaByte {
+		return nil, &limitError{
+			status: http.StatusRequestEntityTooLarge,
+			msg:    fmt.Sprintf("content size must not exceed %dmb", tc.MaxFileSize),
+		}
+	}
+
+	if tc.MaxExpiration > 0 && (expiration == config.ExpireNever || expiration > tc.MaxExpiration) {
+		return nil, &limitError{
+			status: http.StatusForbidden,
+			msg:    fmt.Sprintf("expiration must not exceed %ds", tc.MaxExpiration),
+		}
+	}
+
+	if tc.MaxFiles <= 0 && tc.MaxStorage <= 0 {
+		return func() {}, nil
+	}
+
+	q := h.tokenQuotas.get(tc.Id)
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	usage, err := h.FileStorage.GetTokenUsage(tc.Id)
+	if err != nil {
+		return nil, err
+	}
+
+	if tc.MaxFiles > 0 && usage.Files+q.reserved.Files >= tc.MaxFiles {
+		return nil, &limitError{
+			status: http.StatusForbidden,
+			msg:    fmt.Sprintf("you can not store more than %d files", tc.MaxFiles),
+		}
+	}
+	if tc.MaxStorage > 0 && usage.Bytes+q.reserved.Bytes+size > tc.MaxStorage*SizeMegaByte {
+		return nil, &limitError{
+			status: http.StatusRequestEntityTooLarge,
+			msg:    fmt.Sprintf("you can not store more than %dmb in total", tc.MaxStorage),
+		}
+	}
+
+	q.reserved.Files++
+	q.reserved.Bytes += size
+	return func() {
+		q.mu.Lock()
+		defer q.mu.Unlock()
+		q.reserved.Files--
+		q.reserved.Bytes -= size
+	}, nil
+}
+
+// GetRateLimit returns the rate limit of the request. Requests with a valid
+// token are limited as configured for the token, admin requests are not limited
+// and every other request is limited per client IP by RATE_LIMIT_IP_RPM.
+//
+// Hashes are never verified here. Requests with a token that can only be
+// checked by verifying its hash are limited per client IP by RATE_LIMIT_VERIFY_RPM,
+// which is enabled by default, so that the slow verification can't be used to
+// exhaust the server.
+func (h *UploadHandler) GetRateLimit(c *gin.Context) *middleware.RateLimit {
+	auth, ok := h.AuthConfig().Lookup(getToken(c))
+	if !ok {
+		return &middleware.RateLimit{
+			Kind:      RateLimitKindVerify,
+			Key:       getClientIp(c),
+			PerMinute: float64(env.IntOrDefault("RATE_LIMIT_VERIFY_RPM", config.EnvDefaultRateLimitVerifyRpm)),
+			Burst:     env.IntOrDefault("RATE_LIMIT_VERIFY_BURST", config.EnvDefaultRateLimitVerifyBurst),
+		}
+	}
+
+	c.Set(authContextKey, auth)
+	if auth.Admin {
+		return nil
+	}
+	if tc := auth.Token; tc != nil {
+		if tc.RateLimit == nil {
+			return nil
+		}
+		return &middleware.RateLimit{
+			Kind:      RateLimitKindToken,
+			Key:       tc.Id,
+			PerMinute: tc.RateLimit.RequestsPerMinute,
+			Burst:     tc.RateLimit.Burst,
+		}
+	}
+
+	return &middleware.RateLimit{
+		Kind:      RateLimitKindIp,
+		Key:       getClientIp(c),
+		PerMinute: float64(env.IntOrDefault("RATE_LIMIT_IP_RPM", 0)),
+		Burst:     env.IntOrDefault("RATE_LIMIT_IP_BURST", config.EnvDefaultRateLimitIpBurst),
+	}
+}
+
+// getClientIp returns the ip address of the client. Behind a reverse proxy, the
+// header containing the original ip has to be configured via RATE_LIMIT_IP_HEADER,
+// otherwise every request would come from the proxy.
+func getClientIp(c *gin.Context) string {
+	if header, ok := env.String("RATE_LIMIT_IP_HEADER"); ok && header != "" {
+		// X-Forwarded-For contains a list of all proxies
+		// with the client being the first one.
+		ip := strings.TrimSpace(strings.Split(c.GetHeader(header), ",")[0])
+		if ip != "" {
+			return ip
+		}
+	}
+
+	ip, _, err := net.SplitHostPort(c.Request.RemoteAddr)
+	if err != nil {
+		return c.Request.RemoteAddr
+	}
+	return ip
+}
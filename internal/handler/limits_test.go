@@ -0,0 +1,189 @@
+package handler
+
+import (
+	"fmt"
+	"github.com/gin-gonic/gin"
+	"github.com/superioz/aqua/internal/config"
+	"github.com/superioz/aqua/pkg/middleware"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"sync"
+	"testing"
+)
+
+func TestCheckLimits(t *testing.T) {
+	uh := newTestUploadHandler(t, "")
+
+	tests := []struct {
+		name       string
+		tc         *config.TokenConfig
+		size       int64
+		expiration int64
+		want       int
+	}{
+		{"no limits", &config.TokenConfig{}, 1000 * SizeMegaByte, config.ExpireNever, 0},
+		{"file size", &config.TokenConfig{Id: "t", MaxFileSize: 1}, SizeMegaByte + 1, 60, http.StatusRequestEntityTooLarge},
+		{"max file size", &config.TokenConfig{Id: "t", MaxFileSize: 1}, SizeMegaByte, 60, 0},
+		{"expiration", &config.TokenConfig{Id: "t", MaxExpiration: 60}, 1, 61, http.StatusForbidden},
+		{"never expires", &config.TokenConfig{Id: "t", MaxExpiration: 60}, 1, config.ExpireNever, http.StatusForbidden},
+		{"max expiration", &config.TokenConfig{Id: "t", MaxExpiration: 60}, 1, 60, 0},
+		{"storage", &config.TokenConfig{Id: "t", MaxStorage: 1}, SizeMegaByte + 1, 60, http.StatusRequestEntityTooLarge},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			release, err := uh.checkLimits(tt.tc, tt.size, tt.expiration)
+			if tt.want == 0 {
+				if err != nil {
+					t.Fatalf("checkLimits() error = %v", err)
+				}
+				release()
+				return
+			}
+			le, ok := err.(*limitError)
+			if !ok || le.status != tt.want {
+				t.Errorf("checkLimits() error = %v, want status %d", err, tt.want)
+			}
+		})
+	}
+}
+
+func TestCheckLimitsReservation(t *testing.T) {
+	uh := newTestUploadHandler(t, "")
+	tc := &config.TokenConfig{Id: "t", MaxFiles: 2, MaxStorage: 1}
+
+	release1, err := uh.checkLimits(tc, 100, 60)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// the first file is not stored yet, but is counted nonetheless
+	_, err = uh.checkLimits(tc, SizeMegaByte-99, 60)
+	if _, ok := err.(*limitError); !ok {
+		t.Errorf("checkLimits() error = %v, want storage to be exceeded", err)
+	}
+	release2, err := uh.checkLimits(tc, 100, 60)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = uh.checkLimits(tc, 100, 60)
+	if _, ok := err.(*limitError); !ok {
+		t.Errorf("checkLimits() error = %v, want file count to be exceeded", err)
+	}
+
+	release1()
+	release2()
+	release, err := uh.checkLimits(tc, SizeMegaByte, 60)
+	if err != nil {
+		t.Errorf("checkLimits() after release error = %v", err)
+	} else {
+		release()
+	}
+}
+
+func TestUploadMaxFiles(t *testing.T) {
+	uh := newTestUploadHandler(t, `
+validTokens:
+- token: test-token
+  id: test
+  maxFiles: 3
+`)
+	r := newTestRouter(uh)
+
+	// parallel uploads must not pass the check together
+	var wg sync.WaitGroup
+	codes := make([]int, 10)
+	for i := range codes {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			codes[i] = uploadFile(t, r, fmt.Sprintf("file %d", i)).Code
+		}(i)
+	}
+	wg.Wait()
+
+	stored := 0
+	for _, code := range codes {
+		switch code {
+		case http.StatusOK:
+			stored++
+		case http.StatusForbidden:
+		default:
+			t.Errorf("upload returned %d", code)
+		}
+	}
+	if stored != 3 {
+		t.Errorf("%d files have been stored, want 3", stored)
+	}
+
+	usage, err := uh.FileStorage.GetTokenUsage("test")
+	if err != nil || usage.Files != 3 {
+		t.Errorf("GetTokenUsage() = %+v, %v, want 3 files", usage, err)
+	}
+	w := uploadFile(t, r, "another file")
+	if w.Code != http.StatusForbidden || !strings.Contains(w.Body.String(), "more than 3 files") {
+		t.Errorf("upload over quota = %d: %s", w.Code, w.Body.String())
+	}
+}
+
+func TestGetRateLimit(t *testing.T) {
+	t.Setenv("RATE_LIMIT_IP_RPM", "30")
+	hash, err := config.HashToken("hashed.secret", config.HashAlgorithmBcrypt)
+	if err != nil {
+		t.Fatal(err)
+	}
+	uh := newTestUploadHandler(t, fmt.Sprintf(`
+validTokens:
+- token: limited
+  id: limited
+  rateLimit:
+    requestsPerMinute: 10
+    burst: 5
+- token: unlimited
+- token: '%s'
+  id: hashed
+adminTokens:
+- token: admin
+`, hash))
+	verifyLimit := &middleware.RateLimit{
+		Kind:      RateLimitKindVerify,
+		Key:       "192.0.2.1",
+		PerMinute: config.EnvDefaultRateLimitVerifyRpm,
+		Burst:     config.EnvDefaultRateLimitVerifyBurst,
+	}
+
+	tests := []struct {
+		token string
+		want  *middleware.RateLimit
+	}{
+		{"limited", &middleware.RateLimit{Kind: RateLimitKindToken, Key: "limited", PerMinute: 10, Burst: 5}},
+		{"unlimited", nil},
+		{"admin", nil},
+		{"unknown", &middleware.RateLimit{Kind: RateLimitKindIp, Key: "192.0.2.1", PerMinute: 30, Burst: config.EnvDefaultRateLimitIpBurst}},
+		// the hash of every new string with a known id has to be verified
+		{"hashed.secret", verifyLimit},
+		{"hashed.wrong", verifyLimit},
+	}
+	for _, tt := range tests {
+		t.Run(tt.token, func(t *testing.T) {
+			c, _ := gin.CreateTestContext(httptest.NewRecorder())
+			c.Request = httptest.NewRequest(http.MethodPost, "/upload", nil)
+			c.Request.Header.Set("Authorization", "Bearer "+tt.token)
+
+			got := uh.GetRateLimit(c)
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("GetRateLimit() = %+v, want %+v", got, tt.want)
+			}
+		})
+	}
+
+	// the verified token is limited as configured for the token
+	uh.AuthConfig().Authenticate("hashed.secret")
+	c, _ := gin.CreateTestContext(httptest.NewRecorder())
+	c.Request = httptest.NewRequest(http.MethodPost, "/upload", nil)
+	c.Request.Header.Set("Authorization", "Bearer hashed.secret")
+	if got := uh.GetRateLimit(c); got != nil {
+		t.Errorf("GetRateLimit() of verified token = %+v, want nil", got)
+	}
+}
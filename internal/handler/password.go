@@ -0,0 +1,89 @@
+package handler
+
+import (
+	"github.com/gin-gonic/gin"
+	"github.com/superioz/aqua/internal/config"
+	"github.com/superioz/aqua/internal/storage"
+	"github.com/superioz/aqua/pkg/env"
+	"github.com/superioz/aqua/pkg/middleware"
+	"html/template"
+	"k8s.io/klog"
+	"net/http"
+	"strings"
+
+	_ "embed"
+)
+
+// HeaderFilePassword can contain the password of a
+// protected file, instead of the query parameter.
+const HeaderFilePassword = "Aqua-File-Password"
+
+//go:embed templates/password.html
+var passwordPageHtml string
+
+var passwordPage = template.Must(template.New("password").Parse(passwordPageHtml))
+
+// checkFilePassword returns if the request contains the password
+// of given file. If not, it responds with the password prompt for
+// browsers or an error for everyone else.
+func checkFilePassword(c *gin.Context, sf *storage.StoredFile) bool {
+	password := getFilePassword(c)
+	if sf.CheckPassword(password) {
+		return true
+	}
+
+	status := http.StatusUnauthorized
+	msg := "the file is protected by a password"
+	if password != "" {
+		status = http.StatusForbidden
+		msg = "the password is not valid"
+	}
+	c.Header("Cache-Control", "no-store")
+
+	if !strings.Contains(c.GetHeader("Accept"), "text/html") {
+		c.JSON(status, gin.H{"msg": msg})
+		return false
+	}
+
+	c.Status(status)
+	c.Header("Content-Type", "text/html; charset=utf-8")
+	err := passwordPage.Execute(c.Writer, gin.H{
+		"Action":   c.Request.URL.Path,
+		"FileName": c.Param("file"),
+		"Wrong":    password != "",
+	})
+	if err != nil {
+		klog.Error(err)
+	}
+	return false
+}
+
+// GetPasswordRateLimit returns the rate limit of the password attempts, which
+// are limited per file and client IP by RATE_LIMIT_PASSWORD_RPM, so that the
+// password of a file can't be guessed. Requests without a password are not limited.
+func GetPasswordRateLimit(c *gin.Context) *middleware.RateLimit {
+	if getFilePassword(c) == "" {
+		return nil
+	}
+	return &middleware.RateLimit{
+		Kind:      RateLimitKindPassword,
+		Key:       getFileId(c) + "/" + getClientIp(c),
+		PerMinute: float64(env.IntOrDefault("RATE_LIMIT_PASSWORD_RPM", config.EnvDefaultRateLimitPasswordRpm)),
+		Burst:     env.IntOrDefault("RATE_LIMIT_PASSWORD_BURST", config.EnvDefaultRateLimitPasswordBurst),
+	}
+}
+
+// getFilePassword returns the password given by the header,
+// the query or the form of the password prompt.
+func getFilePassword(c *gin.Context) string {
+	if password := c.GetHeader(HeaderFilePassword); password != "" {
+		return password
+	}
+	if password := c.Query("password"); password != "" {
+		return password
+	}
+	if c.Request.Method == http.MethodPost {
+		return c.PostForm("password")
+	}
+	return ""
+}
@@ -0,0 +1,300 @@
+package handler
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"github.com/alecthomas/chroma/v2"
+	"github.com/alecthomas/chroma/v2/formatters/html"
+	"github.com/alecthomas/chroma/v2/lexers"
+	"github.com/alecthomas/chroma/v2/styles"
+	"github.com/gin-gonic/gin"
+	"github.com/superioz/aqua/internal/mime"
+	"github.com/superioz/aqua/internal/request"
+	"github.com/superioz/aqua/internal/storage"
+	"html/template"
+	"io"
+	"k8s.io/klog"
+	"net/http"
+	"strings"
+	"unicode/utf8"
+
+	_ "embed"
+)
+
+const (
+	// HeaderMetadata contains the metadata of a paste as JSON,
+	// as the body contains the paste itself.
+	HeaderMetadata = "Aqua-Metadata"
+
+	// maxHighlightSize is the size up to which pastes are shown on
+	// the page, larger pastes are redirected to the raw file.
+	maxHighlightSize = 1 * SizeMegaByte
+
+	// pastePagePolicy is the Content-Security-Policy of the paste
+	// page, which only needs its inline styles.
+	pastePagePolicy = "default-src 'none'; style-src 'unsafe-inline'"
+)
+
+// pasteViewTypes are the types, that can be shown as paste.
+var pasteViewTypes = map[string]bool{
+	"text/plain":       true,
+	"text/csv":         true,
+	"application/json": true,
+}
+
+//go:embed templates/paste.html
+var pastePageHtml string
+
+var pastePage = template.Must(template.New("paste").Parse(pastePageHtml))
+
+var (
+	pasteFormatter = html.New(
+		html.WithClasses(true),
+		html.WithLineNumbers(true),
+		html.WithLinkableLineNumbers(true, "L"),
+		html.TabWidth(4),
+	)
+	pasteStyle = styles.Get("github")
+
+	// plaintextLexer is used if the language is unknown.
+	plaintextLexer = lexers.Get("plaintext")
+	pasteCSS       = getPasteCSS()
+)
+
+type pasteData struct {
+	FileName string
+	Language string
+	Size     string
+	Lines    int
+
+	// RawUrl is the path of the file itself.
+	RawUrl   string
+	Password bool
+
+	CSS  template.CSS
+	Code template.HTML
+}
+
+// Paste stores the raw body of the request as text/plain file. The
+// language of the paste can be given by the query parameter `language`,
+// which accepts the names, aliases and file extensions of the languages
+// known to the syntax highlighter. The metadata can be given as JSON by
+// the Aqua-Metadata header.
+func (h *UploadHandler) Paste(c *gin.Context) {
+	tc := h.authenticate(c).Token
+	if tc == nil {
+		c.JSON(http.StatusUnauthorized, gin.H{"msg": "the token is not valid"})
+		return
+	}
+
+	if c.Request.Header.Get("Content-Length") == "" {
+		c.Status(http.StatusLengthRequired)
+		return
+	}
+	if c.Request.ContentLength > maxFileSize() {
+		c.JSON(http.StatusRequestEntityTooLarge, gin.H{"msg": fmt.Sprintf("content size must not exceed %dmb", maxFileSize()/SizeMegaByte)})
+		return
+	}
+
+	if !tc.CanUpload(mime.TypeText) {
+		c.JSON(http.StatusForbidden, gin.H{"msg": "you can not upload a file with this content type"})
+		return
+	}
+
+	language := ""
+	if name := c.Query("language"); name != "" {
+		lexer := lexers.Get(name)
+		if lexer == nil {
+			c.JSON(http.StatusBadRequest, gin.H{"msg": "the language is not known"})
+			return
+		}
+		language = lexer.Config().Name
+	}
+
+	metadata := request.ParseMetadata(c.GetHeader(HeaderMetadata))
+	if len(metadata.Password) > storage.MaxPasswordLength {
+		c.JSON(http.StatusBadRequest, gin.H{"msg": fmt.Sprintf("password must not exceed %d bytes", storage.MaxPasswordLength)})
+		return
+	}
+
+	data, err := io.ReadAll(c.Request.Body)
+	if err != nil {
+		_ = c.Error(err)
+		return
+	}
+	if len(data) == 0 {
+		c.JSON(http.StatusBadRequest, gin.H{"msg": "the paste is empty"})
+		return
+	}
+	if !utf8.Valid(data) || bytes.IndexByte(data, 0) != -1 {
+		c.JSON(http.StatusUnsupportedMediaType, gin.H{"msg": "the paste must be UTF-8 encoded text"})
+		return
+	}
+	size := int64(len(data))
+
+	release, err := h.checkLimits(tc, size, metadata.Expiration)
+	if le, ok := err.(*limitError); ok {
+		c.JSON(le.status, gin.H{"msg": le.msg})
+		return
+	}
+	if err != nil {
+		klog.Error(err)
+		c.JSON(http.StatusInternalServerError, gin.H{"msg": "could not check limits"})
+		return
+	}
+	defer release()
+
+	klog.Infof("Received valid paste request (language: %q, size: %.3fmb)", language, float64(size)/1024/1024)
+
+	rff := &request.RequestFormFile{
+		File:          bytes.NewReader(data),
+		ContentType:   mime.TypeText,
+		ContentLength: size,
+	}
+
+	sf, storedName, err := h.storeFile(rff, metadata, tc, language)
+	if err != nil {
+		klog.Error(err)
+		c.JSON(http.StatusInternalServerError, gin.H{"msg": "could not store file"})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"fileName":    storedName,
+		"digest":      sf.Digest,
+		"deletionKey": sf.DeletionKey,
+		"deletionUrl": getDeletionUrl(c, sf),
+		"viewUrl":     fmt.Sprintf("%s/p/%s", getPublicUrl(c), storedName),
+	})
+}
+
+// HandlePasteView renders text files with syntax highlighting and line
+// numbers, which link to the line (e.g. `#L12`). The language is the one
+// given on upload, otherwise it is guessed from the content.
+//
+// Files with a download limit are not shown, as that would count as
+// download, files with a password only if the password is given. Files
+// larger than maxHighlightSize are redirected to the raw file.
+func HandlePasteView(fs *storage.FileStorage) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		sf, f, err := fs.OpenFile(getFileId(c))
+		if errors.Is(err, storage.ErrFileNotFound) {
+			c.Status(http.StatusNotFound)
+			return
+		}
+		if errors.Is(err, storage.ErrFileExpired) {
+			c.Status(http.StatusGone)
+			return
+		}
+		if err != nil {
+			klog.Error(err)
+			c.Status(http.StatusInternalServerError)
+			return
+		}
+		defer f.Close()
+
+		if sf.HasPassword() && !checkFilePassword(c, sf) {
+			return
+		}
+		if sf.MaxDownloads > 0 {
+			c.JSON(http.StatusBadRequest, gin.H{"msg": "files with a download limit can only be downloaded"})
+			return
+		}
+		if !pasteViewTypes[sf.MimeType] {
+			c.JSON(http.StatusUnsupportedMediaType, gin.H{"msg": "only text files can be shown"})
+			return
+		}
+
+		fileName := fmt.Sprintf("%s.%s", sf.Id, mime.GetExtension(sf.MimeType))
+		if sf.Size > maxHighlightSize {
+			c.Redirect(http.StatusSeeOther, "/"+fileName)
+			return
+		}
+
+		// the size is checked again, in case the file is not the one of the metadata
+		content, err := io.ReadAll(io.LimitReader(f, maxHighlightSize+1))
+		if err != nil {
+			klog.Error(err)
+			c.Status(http.StatusInternalServerError)
+			return
+		}
+		if len(content) > maxHighlightSize {
+			c.Redirect(http.StatusSeeOther, "/"+fileName)
+			return
+		}
+
+		lexer := getPasteLexer(sf, string(content))
+		code, err := highlightPaste(lexer, string(content))
+		if err != nil {
+			klog.Error(err)
+			c.Status(http.StatusInternalServerError)
+			return
+		}
+
+		data := &pasteData{
+			FileName: fileName,
+			Language: lexer.Config().Name,
+			Size:     formatSize(sf.Size),
+			Lines:    strings.Count(strings.TrimSuffix(string(content), "\n"), "\n") + 1,
+			RawUrl:   "/" + fileName,
+			Password: sf.HasPassword(),
+			CSS:      pasteCSS,
+			Code:     template.HTML(code),
+		}
+
+		c.Header("Content-Type", "text/html; charset=utf-8")
+		c.Header("Content-Security-Policy", pastePagePolicy)
+		c.Header("X-Content-Type-Options", "nosniff")
+		setCacheHeaders(c, sf)
+		c.Status(http.StatusOK)
+		err = pastePage.Execute(c.Writer, data)
+		if err != nil {
+			klog.Error(err)
+		}
+	}
+}
+
+// getPasteLexer returns the lexer of the language of the paste. Pastes
+// without language are analysed, which falls back to plain text.
+func getPasteLexer(sf *storage.StoredFile, content string) chroma.Lexer {
+	var lexer chroma.Lexer
+	if sf.Language != "" {
+		lexer = lexers.Get(sf.Language)
+	}
+	if lexer == nil && sf.MimeType != mime.TypeText {
+		lexer = lexers.MatchMimeType(sf.MimeType)
+	}
+	if lexer == nil {
+		lexer = lexers.Analyse(content)
+	}
+	if lexer == nil {
+		lexer = plaintextLexer
+	}
+	return lexer
+}
+
+// highlightPaste returns the content as highlighted HTML.
+func highlightPaste(lexer chroma.Lexer, content string) (string, error) {
+	it, err := chroma.Coalesce(lexer).Tokenise(nil, content)
+	if err != nil {
+		return "", err
+	}
+	var buf bytes.Buffer
+	err = pasteFormatter.Format(&buf, pasteStyle, it)
+	if err != nil {
+		return "", err
+	}
+	return buf.String(), nil
+}
+
+// getPasteCSS returns the classes of the highlighted code.
+func getPasteCSS() template.CSS {
+	var buf bytes.Buffer
+	err := pasteFormatter.WriteCSS(&buf, pasteStyle)
+	if err != nil {
+		// the code is still readable without
+		klog.Errorf("Could not write CSS of paste style: %v", err)
+	}
+	return template.CSS(buf.String())
+}
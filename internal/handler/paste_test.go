@@ -0,0 +1,50 @@
+package handler
+
+import (
+	"encoding/json"
+	"net/http"
+	"strings"
+	"testing"
+)
+
+func TestPasteView(t *testing.T) {
+	uh := newTestUploadHandler(t, testTusAuthConfig)
+	r := newTestRouter(uh)
+	r.GET("/p/:file", HandlePasteView(uh.FileStorage))
+
+	tests := []struct {
+		name     string
+		content  string
+		status   int
+		location bool
+	}{
+		{"small", "package main\n", http.StatusOK, false},
+		{"too large", strings.Repeat("a", maxHighlightSize+1), http.StatusSeeOther, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			w := uploadFile(t, r, tt.content)
+			if w.Code != http.StatusOK {
+				t.Fatalf("upload returned %d: %s", w.Code, w.Body.String())
+			}
+			var resp struct {
+				FileName string `json:"fileName"`
+			}
+			err := json.Unmarshal(w.Body.Bytes(), &resp)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			w = serve(r, http.MethodGet, "/p/"+resp.FileName, nil, nil)
+			if w.Code != tt.status {
+				t.Fatalf("view returned %d, want %d", w.Code, tt.status)
+			}
+			if location := w.Header().Get("Location"); tt.location && location != "/"+resp.FileName {
+				t.Errorf("view redirected to %q, want the raw file", location)
+			}
+			if !tt.location && !strings.Contains(w.Body.String(), `id="L1"`) {
+				t.Errorf("view does not contain the line numbers: %s", w.Body.String())
+			}
+		})
+	}
+}
@@ -0,0 +1,186 @@
+package handler
+
+import (
+	"fmt"
+	"github.com/gin-gonic/gin"
+	"github.com/superioz/aqua/internal/mime"
+	"github.com/superioz/aqua/internal/storage"
+	"html/template"
+	"k8s.io/klog"
+	"net/http"
+	"strings"
+	"time"
+
+	_ "embed"
+)
+
+// previewPagePolicy is the Content-Security-Policy of the preview
+// page, which only needs its inline styles and the file itself.
+const previewPagePolicy = "default-src 'none'; style-src 'unsafe-inline'; img-src 'self' data:; media-src 'self'"
+
+//go:embed templates/preview.html
+var previewPageHtml string
+
+var previewPage = template.Must(template.New("preview").Parse(previewPageHtml))
+
+type previewData struct {
+	FileName    string
+	MimeType    string
+	Description string
+
+	// Kind is image, video, audio or other.
+	Kind string
+
+	// Path is the path of the file, RawUrl and PreviewUrl
+	// the absolute urls of the file and the page.
+	Path       string
+	RawUrl     string
+	PreviewUrl string
+	Secure     bool
+
+	// Embed is false, if the file must not be shown on the page.
+	Embed  bool
+	Player bool
+	Width  int
+	Height int
+
+	Size          string
+	UploadedAt    string
+	ExpiresAt     string
+	ExpiresIn     string
+	Password      bool
+	DownloadsLeft int64
+}
+
+// HandlePreview renders a page for the file, that shows it together with
+// its metadata. The page contains OpenGraph and Twitter Card tags, so that
+// chat apps can show a preview of the file.
+//
+// Files with a password or a download limit are not shown, as that would
+// reveal the file or count as download. The page only links to them.
+func HandlePreview(fs *storage.FileStorage) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		sf, err := fs.GetFile(getFileId(c))
+		if err != nil {
+			klog.Error(err)
+			c.Status(http.StatusInternalServerError)
+			return
+		}
+		if sf == nil {
+			c.Status(http.StatusNotFound)
+			return
+		}
+		if sf.IsExpired() || sf.IsExhausted() {
+			c.Status(http.StatusGone)
+			return
+		}
+
+		data := getPreviewData(c, sf)
+		if data.Embed && (data.Kind == "image" || data.Kind == "video") {
+			data.Width, data.Height, err = fs.Dimensions(sf)
+			if err != nil {
+				// the page works without them
+				klog.Warningf("Could not get dimensions of file %s: %v", sf.Id, err)
+			}
+			data.Player = data.Kind == "video" && data.Secure && data.Width > 0
+		}
+
+		c.Header("Content-Type", "text/html; charset=utf-8")
+		c.Header("Content-Security-Policy", previewPagePolicy)
+		c.Header("X-Content-Type-Options", "nosniff")
+		c.Header("Cache-Control", "no-cache")
+		c.Status(http.StatusOK)
+		err = previewPage.Execute(c.Writer, data)
+		if err != nil {
+			klog.Error(err)
+		}
+	}
+}
+
+// getPreviewData returns everything the preview page shows about the file.
+func getPreviewData(c *gin.Context, sf *storage.StoredFile) *previewData {
+	fileName := fmt.Sprintf("%s.%s", sf.Id, mime.GetExtension(sf.MimeType))
+	publicUrl := getPublicUrl(c)
+
+	data := &previewData{
+		FileName:   fileName,
+		MimeType:   sf.MimeType,
+		Kind:       getPreviewKind(sf.MimeType),
+		Path:       "/" + fileName,
+		RawUrl:     publicUrl + "/" + fileName,
+		PreviewUrl: publicUrl + "/v/" + fileName,
+		Secure:     strings.HasPrefix(publicUrl, "https://"),
+		Embed:      !sf.HasPassword() && sf.MaxDownloads <= 0,
+		Size:       formatSize(sf.Size),
+		UploadedAt: formatTime(sf.UploadedAt),
+		Password:   sf.HasPassword(),
+	}
+	if sf.MaxDownloads > 0 {
+		data.DownloadsLeft = sf.MaxDownloads - sf.Downloads
+	}
+
+	description := []string{sf.MimeType, data.Size}
+	if sf.ExpiresAt >= 0 {
+		data.ExpiresAt = formatTime(sf.ExpiresAt)
+		data.ExpiresIn = "in " + formatDuration(time.Until(time.Unix(sf.ExpiresAt, 0)))
+		description = append(description, "expires "+data.ExpiresIn)
+	}
+	data.Description = strings.Join(description, ", ")
+	return data
+}
+
+// getPreviewKind returns how the file is shown on the preview page.
+func getPreviewKind(mimeType string) string {
+	switch {
+	case strings.HasPrefix(mimeType, "image/"):
+		return "image"
+	case mimeType == "video/mp4" || mimeType == "video/webm":
+		return "video"
+	case strings.HasPrefix(mimeType, "audio/"):
+		return "audio"
+	default:
+		return "other"
+	}
+}
+
+// formatSize returns the size in a human readable format, e.g. 1.5 MB.
+func formatSize(size int64) string {
+	if size < 1024 {
+		return fmt.Sprintf("%d B", size)
+	}
+	value := float64(size) / 1024
+	for _, unit := range []string{"KB", "MB", "GB"} {
+		if value < 1024 {
+			return fmt.Sprintf("%.1f %s", value, unit)
+		}
+		value /= 1024
+	}
+	return fmt.Sprintf("%.1f TB", value)
+}
+
+// formatDuration returns the duration in the largest fitting unit.
+func formatDuration(d time.Duration) string {
+	plural := func(n int, unit string) string {
+		if n == 1 {
+			return fmt.Sprintf("1 %s", unit)
+		}
+		return fmt.Sprintf("%d %ss", n, unit)
+	}
+	round := func(unit time.Duration) int {
+		return int((d + unit/2) / unit)
+	}
+	switch {
+	case d >= 24*time.Hour:
+		return plural(round(24*time.Hour), "day")
+	case d >= time.Hour:
+		return plural(round(time.Hour), "hour")
+	case d >= time.Minute:
+		return plural(round(time.Minute), "minute")
+	default:
+		return "less than a minute"
+	}
+}
+
+func formatTime(unix int64) string {
+	return time.Unix(unix, 0).UTC().Format("2006-01-02 15:04 UTC")
+}
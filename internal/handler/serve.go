@@ -0,0 +1,214 @@
+package handler
+
+import (
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"github.com/gin-gonic/gin"
+	"github.com/superioz/aqua/internal/config"
+	"github.com/superioz/aqua/internal/metrics"
+	"github.com/superioz/aqua/internal/sanitize"
+	"github.com/superioz/aqua/internal/storage"
+	"github.com/superioz/aqua/pkg/env"
+	"k8s.io/klog"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// HandleStaticFiles serves the stored files to the client. Only files
+// with metadata are served, expired files are gone immediately, even
+// if they have not been cleaned up yet.
+//
+// Range requests and conditional requests (If-None-Match, If-Modified-Since,
+// If-Range) are supported, the ETag and Last-Modified are derived from the
+// metadata of the file.
+//
+// Files with a password are only served if the password is given,
+// files with a download limit are deleted after their last download.
+// Images are served as thumbnail instead, if a size is given.
+func HandleStaticFiles(fs *storage.FileStorage) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		sf, f, err := fs.OpenFile(getFileId(c))
+		if errors.Is(err, storage.ErrFileNotFound) {
+			c.Status(http.StatusNotFound)
+			return
+		}
+		if errors.Is(err, storage.ErrFileExpired) {
+			c.Status(http.StatusGone)
+			return
+		}
+		if err != nil {
+			klog.Error(err)
+			c.Status(http.StatusInternalServerError)
+			return
+		}
+		defer f.Close()
+
+		if sf.HasPassword() && !checkFilePassword(c, sf) {
+			return
+		}
+		if c.Query("size") != "" {
+			serveThumbnail(c, fs, sf)
+			return
+		}
+
+		setFileHeaders(c, sf)
+		if sf.MaxDownloads <= 0 {
+			http.ServeContent(c.Writer, c.Request, "", time.Unix(sf.UploadedAt, 0), f)
+			return
+		}
+
+		// every download has to be a complete download of the file,
+		// otherwise the file could be read without being counted.
+		for _, h := range []string{"Range", "If-Range", "If-None-Match", "If-Modified-Since", "If-Match", "If-Unmodified-Since"} {
+			c.Request.Header.Del(h)
+		}
+
+		if c.Request.Method == http.MethodHead {
+			http.ServeContent(c.Writer, c.Request, "", time.Unix(sf.UploadedAt, 0), f)
+			return
+		}
+
+		sf, err = fs.RegisterDownload(sf)
+		if errors.Is(err, storage.ErrDownloadLimitReached) {
+			c.Status(http.StatusGone)
+			return
+		}
+		if err != nil {
+			klog.Error(err)
+			c.Status(http.StatusInternalServerError)
+			return
+		}
+
+		http.ServeContent(c.Writer, c.Request, "", time.Unix(sf.UploadedAt, 0), f)
+		if !sf.IsExhausted() {
+			return
+		}
+
+		f.Close()
+		_, err = fs.DeleteFile(sf.Id)
+		if err != nil {
+			// the cleanup will delete it later on
+			klog.Errorf("Could not delete file %s after last download: %v", sf.Id, err)
+			return
+		}
+		klog.Infof("Delete file %s (downloaded %d times)", sf.Id, sf.Downloads)
+		metrics.IncFilesExpired()
+	}
+}
+
+// activeContentPolicy is the Content-Security-Policy of files, that could
+// run scripts. Only inline styles and embedded images are allowed.
+const activeContentPolicy = "default-src 'none'; style-src 'unsafe-inline'; img-src data:; sandbox"
+
+// setFileHeaders sets the content type, the security headers, the
+// ETag, the digest and the caching headers of the file.
+func setFileHeaders(c *gin.Context, sf *storage.StoredFile) {
+	contentType := sf.MimeType
+	if strings.HasPrefix(contentType, "text/") {
+		contentType += "; charset=utf-8"
+	}
+	c.Header("Content-Type", contentType)
+	c.Header("X-Content-Type-Options", "nosniff")
+	if sanitize.IsActive(sf.MimeType) {
+		// files stored before the sanitization must not run anything either
+		c.Header("Content-Security-Policy", activeContentPolicy)
+	}
+	c.Header("ETag", getETag(sf))
+	if digest := getDigestHeader(sf); digest != "" {
+		c.Header("Digest", digest)
+	}
+	setCacheHeaders(c, sf)
+}
+
+// setCacheHeaders sets the caching headers of the file.
+func setCacheHeaders(c *gin.Context, sf *storage.StoredFile) {
+	if sf.HasPassword() || sf.MaxDownloads > 0 {
+		// nobody but aqua must be able to serve the file
+		c.Header("Cache-Control", "no-store")
+		return
+	}
+	c.Header("Cache-Control", getCacheControl(sf))
+	if sf.ExpiresAt >= 0 {
+		c.Header("Expires", time.Unix(sf.ExpiresAt, 0).UTC().Format(http.TimeFormat))
+	}
+}
+
+// serveThumbnail serves the thumbnail of the image, that fits into
+// the size given by the query parameter `size`.
+func serveThumbnail(c *gin.Context, fs *storage.FileStorage, sf *storage.StoredFile) {
+	if sf.MaxDownloads > 0 {
+		// the thumbnail would show the file without counting a download
+		c.JSON(http.StatusBadRequest, gin.H{"msg": "thumbnails are not available for files with a download limit"})
+		return
+	}
+
+	size, _ := strconv.Atoi(c.Query("size"))
+	f, err := fs.OpenThumbnail(sf, size)
+	if errors.Is(err, storage.ErrInvalidThumbnailSize) {
+		c.JSON(http.StatusBadRequest, gin.H{"msg": fmt.Sprintf("size must be one of %v", storage.ThumbnailSizes())})
+		return
+	}
+	if errors.Is(err, storage.ErrThumbnailUnsupported) {
+		klog.Infof("No thumbnail for file %s: %v", sf.Id, err)
+		c.JSON(http.StatusUnsupportedMediaType, gin.H{"msg": "no thumbnail available for this file"})
+		return
+	}
+	if errors.Is(err, storage.ErrFileNotFound) {
+		c.Status(http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		klog.Error(err)
+		c.Status(http.StatusInternalServerError)
+		return
+	}
+	defer f.Close()
+
+	c.Header("Content-Type", storage.ThumbnailMimeType(sf.MimeType))
+	c.Header("X-Content-Type-Options", "nosniff")
+	c.Header("ETag", strings.TrimSuffix(getETag(sf), `"`)+fmt.Sprintf(`-%d"`, size))
+	setCacheHeaders(c, sf)
+	http.ServeContent(c.Writer, c.Request, "", time.Unix(sf.UploadedAt, 0), f)
+}
+
+// getETag returns a strong ETag for the file, which is the digest of its
+// content. Files without digest never change either, so their id and
+// upload time are enough to identify them.
+func getETag(sf *storage.StoredFile) string {
+	if sf.Digest != "" {
+		return `"` + sf.Digest + `"`
+	}
+	sum := sha256.Sum256([]byte(fmt.Sprintf("%s-%d-%d", sf.Id, sf.UploadedAt, sf.Size)))
+	return `"` + hex.EncodeToString(sum[:16]) + `"`
+}
+
+// getDigestHeader returns the value of the Digest header (RFC 3230),
+// which contains the base64 encoded SHA-256 of the whole file.
+func getDigestHeader(sf *storage.StoredFile) string {
+	sum, err := hex.DecodeString(sf.Digest)
+	if err != nil || len(sum) != sha256.Size {
+		return ""
+	}
+	return "sha-256=" + base64.StdEncoding.EncodeToString(sum)
+}
+
+// getCacheControl returns how long the file may be cached, which
+// is FILE_CACHE_MAX_AGE but never longer than until the file expires.
+func getCacheControl(sf *storage.StoredFile) string {
+	maxAge := int64(env.IntOrDefault("FILE_CACHE_MAX_AGE", config.EnvDefaultFileCacheMaxAge))
+	if sf.ExpiresAt >= 0 {
+		remaining := sf.ExpiresAt - time.Now().Unix()
+		if remaining < maxAge {
+			maxAge = remaining
+		}
+	}
+	if maxAge <= 0 {
+		return "no-cache"
+	}
+	return fmt.Sprintf("public, max-age=%d", maxAge)
+}
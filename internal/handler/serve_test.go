@@ -0,0 +1,105 @@
+package handler
+
+import (
+	"encoding/json"
+	"github.com/gin-gonic/gin"
+	"github.com/superioz/aqua/internal/config"
+	"github.com/superioz/aqua/pkg/middleware"
+	"net/http"
+	"strings"
+	"testing"
+)
+
+func TestServeMaxDownloads(t *testing.T) {
+	uh := newTestUploadHandler(t, testTusAuthConfig)
+	r := newTestRouter(uh)
+
+	// without expiration, the file never expires
+	w := uploadFileWithMetadata(t, r, "burn after reading", `{"maxDownloads":1}`)
+	if w.Code != http.StatusOK {
+		t.Fatalf("upload returned %d: %s", w.Code, w.Body.String())
+	}
+	var resp struct {
+		FileName string `json:"fileName"`
+	}
+	err := json.Unmarshal(w.Body.Bytes(), &resp)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	w = serve(r, http.MethodGet, "/"+resp.FileName, nil, nil)
+	if w.Code != http.StatusOK || w.Body.String() != "burn after reading" {
+		t.Fatalf("first download = %d: %s, want 200 with the content", w.Code, w.Body.String())
+	}
+	// the file is deleted right after its last download
+	w = serve(r, http.MethodGet, "/"+resp.FileName, nil, nil)
+	if w.Code != http.StatusNotFound {
+		t.Errorf("second download = %d, want 404", w.Code)
+	}
+}
+
+func TestServeMaxDownloadsExhausted(t *testing.T) {
+	uh := newTestUploadHandler(t, testTusAuthConfig)
+	r := newTestRouter(uh)
+	w := uploadFileWithMetadata(t, r, "burn after reading", `{"maxDownloads":1}`)
+	var resp struct {
+		FileName string `json:"fileName"`
+	}
+	_ = json.Unmarshal(w.Body.Bytes(), &resp)
+
+	// e.g. downloaded by another instance, which could not delete it
+	sf, err := uh.FileStorage.GetFile(strings.Split(resp.FileName, ".")[0])
+	if err != nil || sf == nil || sf.ExpiresAt != config.ExpireNever {
+		t.Fatalf("GetFile() = %+v, %v, want a file that never expires", sf, err)
+	}
+	_, err = uh.FileStorage.RegisterDownload(sf)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	w = serve(r, http.MethodGet, "/"+resp.FileName, nil, nil)
+	if w.Code != http.StatusGone {
+		t.Errorf("download of exhausted file = %d, want 410", w.Code)
+	}
+}
+
+func TestServePasswordRateLimit(t *testing.T) {
+	t.Setenv("RATE_LIMIT_PASSWORD_RPM", "1")
+	t.Setenv("RATE_LIMIT_PASSWORD_BURST", "2")
+	uh := newTestUploadHandler(t, testTusAuthConfig)
+	r := gin.New()
+	r.POST("/upload", uh.Upload)
+	r.GET("/:file", middleware.NewRateLimiter().RateLimit(GetPasswordRateLimit), HandleStaticFiles(uh.FileStorage))
+
+	var names []string
+	for i := 0; i < 2; i++ {
+		w := uploadFileWithMetadata(t, r, "protected", `{"password":"secret"}`)
+		var resp struct {
+			FileName string `json:"fileName"`
+		}
+		err := json.Unmarshal(w.Body.Bytes(), &resp)
+		if err != nil || resp.FileName == "" {
+			t.Fatalf("upload returned %d: %s", w.Code, w.Body.String())
+		}
+		names = append(names, resp.FileName)
+	}
+
+	wrong := map[string]string{HeaderFilePassword: "wrong"}
+	for i, want := range []int{http.StatusForbidden, http.StatusForbidden, http.StatusTooManyRequests} {
+		w := serve(r, http.MethodGet, "/"+names[0], nil, wrong)
+		if w.Code != want {
+			t.Errorf("attempt %d = %d, want %d", i+1, w.Code, want)
+		}
+	}
+
+	// the attempts are limited per file
+	w := serve(r, http.MethodGet, "/"+names[1], nil, wrong)
+	if w.Code != http.StatusForbidden {
+		t.Errorf("attempt for other file = %d, want 403", w.Code)
+	}
+	// requests without a password are not limited
+	w = serve(r, http.MethodGet, "/"+names[0], nil, nil)
+	if w.Code != http.StatusUnauthorized {
+		t.Errorf("request without password = %d, want 401", w.Code)
+	}
+}
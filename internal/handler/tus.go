@@ -0,0 +1,393 @@
+package handler
+
+import (
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"github.com/gin-gonic/gin"
+	"github.com/superioz/aqua/internal/config"
+	"github.com/superioz/aqua/internal/mime"
+	"github.com/superioz/aqua/internal/request"
+	"github.com/superioz/aqua/internal/storage"
+	"github.com/superioz/aqua/pkg/env"
+	"k8s.io/klog"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// This file implements the tus resumable upload protocol in version 1.0.0
+// with the creation, expiration and termination extensions.
+// See https://tus.io/protocols/resumable-upload.html
+//
+// An upload is created with a POST request to /tus/ and afterwards
+// the content is sent in chunks via PATCH requests. When the last chunk
+// arrives, the file is stored like every other uploaded file. If that
+// fails, it can be tried again with an empty PATCH request at the end
+// of the upload.
+
+const (
+	TusVersion    = "1.0.0"
+	TusExtensions = "creation,expiration,termination"
+
+	HeaderTusResumable   = "Tus-Resumable"
+	HeaderTusVersion     = "Tus-Version"
+	HeaderTusExtension   = "Tus-Extension"
+	HeaderTusMaxSize     = "Tus-Max-Size"
+	HeaderUploadLength   = "Upload-Length"
+	HeaderUploadOffset   = "Upload-Offset"
+	HeaderUploadMetadata = "Upload-Metadata"
+	HeaderUploadExpires  = "Upload-Expires"
+
+	// HeaderFileName contains the name of the stored file,
+	// as soon as the upload is complete.
+	HeaderFileName = "Aqua-File-Name"
+
+	contentTypeOffsetOctetStream = "application/offset+octet-stream"
+)
+
+// TusOptions tells the client which features of the
+// protocol are supported by the server.
+func (h *UploadHandler) TusOptions(c *gin.Context) {
+	c.Header(HeaderTusResumable, TusVersion)
+	c.Header(HeaderTusVersion, TusVersion)
+	c.Header(HeaderTusExtension, TusExtensions)
+	c.Header(HeaderTusMaxSize, strconv.FormatInt(maxFileSize(), 10))
+	c.Status(http.StatusNoContent)
+}
+
+// TusCreate creates a new upload without any content.
+func (h *UploadHandler) TusCreate(c *gin.Context) {
+	token, ok := h.checkTusRequest(c)
+	if !ok {
+		return
+	}
+
+	length, err := strconv.ParseInt(c.GetHeader(HeaderUploadLength), 10, 64)
+	if err != nil || length <= 0 {
+		// empty files are never stored
+		c.JSON(http.StatusBadRequest, gin.H{"msg": "upload length is not valid"})
+		return
+	}
+	if length > maxFileSize() {
+		c.JSON(http.StatusRequestEntityTooLarge, gin.H{"msg": fmt.Sprintf("content size must not exceed %dmb", maxFileSize()/SizeMegaByte)})
+		return
+	}
+
+	um, err := parseUploadMetadata(c.GetHeader(HeaderUploadMetadata))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"msg": "upload metadata is not valid"})
+		return
+	}
+
+	ct := um["filetype"]
+	if !mime.IsValid(ct) {
+		c.JSON(http.StatusBadRequest, gin.H{"msg": "content type of file is not valid"})
+		return
+	}
+	tc := h.authenticate(c).Token
+	if !tc.CanUpload(ct) {
+		c.JSON(http.StatusForbidden, gin.H{"msg": "you can not upload a file with this content type"})
+		return
+	}
+
+	metadata := request.ParseMetadata(um["metadata"])
+	if len(metadata.Password) > storage.MaxPasswordLength {
+		c.JSON(http.StatusBadRequest, gin.H{"msg": fmt.Sprintf("password must not exceed %d bytes", storage.MaxPasswordLength)})
+		return
+	}
+
+	// the limits are checked again when the upload is complete,
+	// but that way the client knows beforehand.
+	release, err := h.checkLimits(tc, length, metadata.Expiration)
+	if le, ok := err.(*limitError); ok {
+		c.JSON(le.status, gin.H{"msg": le.msg})
+		return
+	}
+	if err != nil {
+		klog.Error(err)
+		c.JSON(http.StatusInternalServerError, gin.H{"msg": "could not check limits"})
+		return
+	}
+	// nothing is stored yet
+	release()
+
+	pu := &storage.PartialUpload{
+		Length:      length,
+		ContentType: ct,
+		Metadata:    metadata,
+		ExpiresAt:   time.Now().Unix() + int64(env.IntOrDefault("TUS_UPLOAD_EXPIRATION", config.EnvDefaultTusExpiration)),
+		Owner:       tokenOwner(token),
+	}
+	err = h.PartialUploads.Create(pu)
+	if err != nil {
+		klog.Error(err)
+		c.JSON(http.StatusInternalServerError, gin.H{"msg": "could not create upload"})
+		return
+	}
+	klog.Infof("Created resumable upload %s (type: %s, size: %.3fmb)", pu.Id, ct, float64(length)/SizeMegaByte)
+
+	c.Header("Location", strings.TrimSuffix(c.Request.URL.Path, "/")+"/"+pu.Id)
+	c.Header(HeaderUploadExpires, formatUploadExpires(pu))
+	c.Status(http.StatusCreated)
+}
+
+// TusHead returns the current offset of the upload, so that
+// the client knows where to resume.
+func (h *UploadHandler) TusHead(c *gin.Context) {
+	pu, ok := h.getPartialUpload(c)
+	if !ok {
+		return
+	}
+
+	c.Header("Cache-Control", "no-store")
+	c.Header(HeaderUploadOffset, strconv.FormatInt(pu.Offset, 10))
+	c.Header(HeaderUploadLength, strconv.FormatInt(pu.Length, 10))
+	c.Header(HeaderUploadExpires, formatUploadExpires(pu))
+	if pu.FileName != "" {
+		c.Header(HeaderFileName, pu.FileName)
+	}
+	c.Status(http.StatusOK)
+}
+
+// TusPatch appends the request body to the upload. If the whole
+// content has been received afterwards, the file will be stored.
+func (h *UploadHandler) TusPatch(c *gin.Context) {
+	if c.ContentType() != contentTypeOffsetOctetStream {
+		c.JSON(http.StatusUnsupportedMediaType, gin.H{"msg": "content type has to be " + contentTypeOffsetOctetStream})
+		return
+	}
+
+	offset, err := strconv.ParseInt(c.GetHeader(HeaderUploadOffset), 10, 64)
+	if err != nil || offset < 0 {
+		c.JSON(http.StatusBadRequest, gin.H{"msg": "upload offset is not valid"})
+		return
+	}
+
+	pu, ok := h.getPartialUpload(c)
+	if !ok {
+		return
+	}
+
+	err = h.PartialUploads.Lock(pu.Id)
+	if err != nil {
+		c.JSON(http.StatusConflict, gin.H{"msg": "upload is already in progress"})
+		return
+	}
+	defer h.PartialUploads.Unlock(pu.Id)
+
+	// get the upload again, as the offset could have been
+	// changed by a request that held the lock before us.
+	pu, err = h.PartialUploads.Get(pu.Id)
+	if err != nil {
+		klog.Error(err)
+		c.JSON(http.StatusInternalServerError, gin.H{"msg": "could not read upload"})
+		return
+	}
+	if pu.IsComplete() {
+		c.JSON(http.StatusForbidden, gin.H{"msg": "upload is already complete"})
+		return
+	}
+
+	err = h.PartialUploads.Append(pu, offset, c.Request.Body)
+	if errors.Is(err, storage.ErrOffsetMismatch) {
+		c.JSON(http.StatusConflict, gin.H{"msg": "upload offset does not match"})
+		return
+	}
+	if err != nil {
+		// the bytes that were received have been saved nonetheless
+		klog.Warningf("Could not append to upload %s: %v", pu.Id, err)
+		c.JSON(http.StatusInternalServerError, gin.H{"msg": "could not write to upload"})
+		return
+	}
+
+	c.Header(HeaderUploadOffset, strconv.FormatInt(pu.Offset, 10))
+	c.Header(HeaderUploadExpires, formatUploadExpires(pu))
+	if !pu.IsReceived() {
+		c.Status(http.StatusNoContent)
+		return
+	}
+
+	f, err := h.PartialUploads.Open(pu)
+	if err != nil {
+		klog.Error(err)
+		c.JSON(http.StatusInternalServerError, gin.H{"msg": "could not read upload"})
+		return
+	}
+	defer f.Close()
+
+	// now that we have the content, we can check
+	// if it really is what the client declared.
+	ct, err := resolveContentType(pu.ContentType, f)
+	if err != nil {
+		h.discardPartialUpload(pu)
+		c.JSON(http.StatusUnsupportedMediaType, gin.H{"msg": err.Error()})
+		return
+	}
+	tc := h.authenticate(c).Token
+	if !mime.IsValid(ct) || !tc.CanUpload(ct) {
+		h.discardPartialUpload(pu)
+		c.JSON(http.StatusForbidden, gin.H{"msg": "you can not upload a file with this content type"})
+		return
+	}
+
+	release, err := h.checkLimits(tc, pu.Length, pu.Metadata.Expiration)
+	if le, ok := err.(*limitError); ok {
+		h.discardPartialUpload(pu)
+		c.JSON(le.status, gin.H{"msg": le.msg})
+		return
+	}
+	if err != nil {
+		klog.Error(err)
+		c.JSON(http.StatusInternalServerError, gin.H{"msg": "could not check limits"})
+		return
+	}
+	defer release()
+
+	rff := &request.RequestFormFile{
+		File:          f,
+		ContentType:   ct,
+		ContentLength: pu.Length,
+	}
+	sf, storedName, err := h.storeFile(rff, pu.Metadata, tc, "")
+	if msg, ok := getSanitizeError(err); ok {
+		h.discardPartialUpload(pu)
+		c.JSON(http.StatusUnprocessableEntity, gin.H{"msg": msg})
+		return
+	}
+	if err != nil {
+		klog.Error(err)
+		c.JSON(http.StatusInternalServerError, gin.H{"msg": "could not store file"})
+		return
+	}
+
+	err = h.PartialUploads.Complete(pu, storedName)
+	if err != nil {
+		// the file is stored, so this is not critical
+		klog.Warningf("Could not complete upload %s: %v", pu.Id, err)
+	}
+
+	c.Header(HeaderFileName, storedName)
+	c.Header(HeaderDeletionKey, sf.DeletionKey)
+	c.Header(HeaderFileDigest, sf.Digest)
+	c.Status(http.StatusNoContent)
+}
+
+// TusDelete cancels the upload and removes everything
+// that has been uploaded so far.
+func (h *UploadHandler) TusDelete(c *gin.Context) {
+	pu, ok := h.getPartialUpload(c)
+	if !ok {
+		return
+	}
+
+	err := h.PartialUploads.Lock(pu.Id)
+	if err != nil {
+		c.JSON(http.StatusConflict, gin.H{"msg": "upload is already in progress"})
+		return
+	}
+	defer h.PartialUploads.Unlock(pu.Id)
+
+	err = h.PartialUploads.Delete(pu.Id)
+	if err != nil {
+		klog.Error(err)
+		c.JSON(http.StatusInternalServerError, gin.H{"msg": "could not delete upload"})
+		return
+	}
+	c.Status(http.StatusNoContent)
+}
+
+// discardPartialUpload deletes an upload whose content was rejected,
+// because resuming it would not change anything.
+func (h *UploadHandler) discardPartialUpload(pu *storage.PartialUpload) {
+	err := h.PartialUploads.Delete(pu.Id)
+	if err != nil {
+		klog.Warningf("Could not delete rejected upload %s: %v", pu.Id, err)
+	}
+}
+
+// checkTusRequest checks the protocol version and the authorization
+// of the request. Returns the token and if the request can be processed.
+func (h *UploadHandler) checkTusRequest(c *gin.Context) (string, bool) {
+	c.Header(HeaderTusResumable, TusVersion)
+
+	if c.GetHeader(HeaderTusResumable) != TusVersion {
+		c.Header(HeaderTusVersion, TusVersion)
+		c.Status(http.StatusPreconditionFailed)
+		return "", false
+	}
+
+	if h.authenticate(c).Token == nil {
+		c.JSON(http.StatusUnauthorized, gin.H{"msg": "the token is not valid"})
+		return "", false
+	}
+	return getToken(c), true
+}
+
+// getPartialUpload returns the upload of the request, if it
+// exists and belongs to the token of the request.
+func (h *UploadHandler) getPartialUpload(c *gin.Context) (*storage.PartialUpload, bool) {
+	token, ok := h.checkTusRequest(c)
+	if !ok {
+		return nil, false
+	}
+
+	pu, err := h.PartialUploads.Get(c.Param("id"))
+	if errors.Is(err, storage.ErrUploadNotFound) {
+		c.Status(http.StatusNotFound)
+		return nil, false
+	}
+	if err != nil {
+		klog.Error(err)
+		c.JSON(http.StatusInternalServerError, gin.H{"msg": "could not read upload"})
+		return nil, false
+	}
+
+	// expired uploads are deleted with the next cleanup
+	if pu.Owner != tokenOwner(token) || pu.ExpiresAt <= time.Now().Unix() {
+		c.Status(http.StatusNotFound)
+		return nil, false
+	}
+	return pu, true
+}
+
+// parseUploadMetadata parses the Upload-Metadata header, which
+// consists of comma-separated key value pairs with base64 encoded values.
+func parseUploadMetadata(header string) (map[string]string, error) {
+	um := map[string]string{}
+	if strings.TrimSpace(header) == "" {
+		return um, nil
+	}
+
+	for _, pair := range strings.Split(header, ",") {
+		spl := strings.Fields(pair)
+		if len(spl) == 0 || len(spl) > 2 {
+			return nil, fmt.Errorf("invalid metadata pair %q", pair)
+		}
+
+		value := ""
+		if len(spl) == 2 {
+			v, err := base64.StdEncoding.DecodeString(spl[1])
+			if err != nil {
+				return nil, err
+			}
+			value = string(v)
+		}
+		um[spl[0]] = value
+	}
+	return um, nil
+}
+
+func formatUploadExpires(pu *storage.PartialUpload) string {
+	return time.Unix(pu.ExpiresAt, 0).UTC().Format(http.TimeFormat)
+}
+
+// tokenOwner returns an identifier for the token,
+// so that the token itself doesn't have to be stored.
+func tokenOwner(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
@@ -0,0 +1,177 @@
+package handler
+
+import (
+	"encoding/base64"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+const testTusAuthConfig = `
+validTokens:
+- token: test-token
+  fileTypes:
+  - text/plain
+`
+
+// createTusUpload creates an upload with given length and returns its path.
+func createTusUpload(t *testing.T, r http.Handler, length int) string {
+	t.Helper()
+
+	w := serve(r, http.MethodPost, "/tus/", nil, map[string]string{
+		HeaderTusResumable:   TusVersion,
+		HeaderUploadLength:   strconv.Itoa(length),
+		HeaderUploadMetadata: "filetype " + base64.StdEncoding.EncodeToString([]byte("text/plain")),
+	})
+	if w.Code != http.StatusCreated {
+		t.Fatalf("create returned %d: %s", w.Code, w.Body.String())
+	}
+	location := w.Header().Get("Location")
+	if !strings.HasPrefix(location, "/tus/") {
+		t.Fatalf("create returned location %q", location)
+	}
+	return location
+}
+
+func patchTusUpload(r http.Handler, path string, offset int, content string) (int, http.Header) {
+	w := serve(r, http.MethodPatch, path, strings.NewReader(content), map[string]string{
+		HeaderTusResumable: TusVersion,
+		HeaderUploadOffset: strconv.Itoa(offset),
+		"Content-Type":     contentTypeOffsetOctetStream,
+	})
+	return w.Code, w.Header()
+}
+
+func headTusUpload(t *testing.T, r http.Handler, path string) http.Header {
+	t.Helper()
+
+	w := serve(r, http.MethodHead, path, nil, map[string]string{HeaderTusResumable: TusVersion})
+	if w.Code != http.StatusOK {
+		t.Fatalf("head returned %d", w.Code)
+	}
+	return w.Header()
+}
+
+func TestTusUpload(t *testing.T) {
+	uh := newTestUploadHandler(t, testTusAuthConfig)
+	r := newTestRouter(uh)
+	path := createTusUpload(t, r, 11)
+
+	status, header := patchTusUpload(r, path, 0, "hello ")
+	if status != http.StatusNoContent || header.Get(HeaderUploadOffset) != "6" {
+		t.Fatalf("first patch = %d with offset %s, want 204 with offset 6", status, header.Get(HeaderUploadOffset))
+	}
+
+	// the client lost the connection and asks where to resume
+	header = headTusUpload(t, r, path)
+	if header.Get(HeaderUploadOffset) != "6" || header.Get(HeaderUploadLength) != "11" {
+		t.Errorf("head = offset %s of %s, want 6 of 11", header.Get(HeaderUploadOffset), header.Get(HeaderUploadLength))
+	}
+	if status, _ = patchTusUpload(r, path, 0, "hello "); status != http.StatusConflict {
+		t.Errorf("patch with wrong offset = %d, want 409", status)
+	}
+
+	status, header = patchTusUpload(r, path, 6, "world")
+	name := header.Get(HeaderFileName)
+	if status != http.StatusNoContent || name == "" || header.Get(HeaderDeletionKey) == "" {
+		t.Fatalf("last patch = %d with file name %q, want 204 with file name", status, name)
+	}
+	assertStoredContent(t, uh, name, "hello world")
+
+	// the name can be requested again, if the response got lost
+	if header = headTusUpload(t, r, path); header.Get(HeaderFileName) != name {
+		t.Errorf("head returned file name %q, want %q", header.Get(HeaderFileName), name)
+	}
+	if status, _ = patchTusUpload(r, path, 11, ""); status != http.StatusForbidden {
+		t.Errorf("patch of complete upload = %d, want 403", status)
+	}
+}
+
+func TestTusUploadRetryStore(t *testing.T) {
+	uh := newTestUploadHandler(t, testTusAuthConfig)
+	r := newTestRouter(uh)
+	path := createTusUpload(t, r, 5)
+
+	// storing the file fails, as the folder can't be created
+	storagePath := os.Getenv("FILE_STORAGE_PATH")
+	err := os.WriteFile(strings.TrimSuffix(storagePath, "/"), nil, 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if status, _ := patchTusUpload(r, path, 0, "hello"); status != http.StatusInternalServerError {
+		t.Fatalf("patch with broken storage = %d, want 500", status)
+	}
+	header := headTusUpload(t, r, path)
+	if header.Get(HeaderUploadOffset) != "5" || header.Get(HeaderFileName) != "" {
+		t.Errorf("head = offset %s with file name %q, want offset 5 without name", header.Get(HeaderUploadOffset), header.Get(HeaderFileName))
+	}
+
+	// an empty patch at the end stores the received content again
+	err = os.Remove(strings.TrimSuffix(storagePath, "/"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	status, header := patchTusUpload(r, path, 5, "")
+	if status != http.StatusNoContent || header.Get(HeaderFileName) == "" {
+		t.Fatalf("retry = %d with file name %q, want 204 with file name", status, header.Get(HeaderFileName))
+	}
+	assertStoredContent(t, uh, header.Get(HeaderFileName), "hello")
+}
+
+func TestTusCreateInvalid(t *testing.T) {
+	uh := newTestUploadHandler(t, testTusAuthConfig)
+	r := newTestRouter(uh)
+	filetype := "filetype " + base64.StdEncoding.EncodeToString([]byte("text/plain"))
+
+	tests := []struct {
+		name    string
+		headers map[string]string
+		want    int
+	}{
+		{"empty", map[string]string{HeaderUploadLength: "0", HeaderUploadMetadata: filetype}, http.StatusBadRequest},
+		{"no length", map[string]string{HeaderUploadMetadata: filetype}, http.StatusBadRequest},
+		{"too large", map[string]string{HeaderUploadLength: strconv.FormatInt(maxFileSize()+1, 10), HeaderUploadMetadata: filetype}, http.StatusRequestEntityTooLarge},
+		{"file type", map[string]string{HeaderUploadLength: "5", HeaderUploadMetadata: "filetype " + base64.StdEncoding.EncodeToString([]byte("image/png"))}, http.StatusForbidden},
+		{"version", map[string]string{HeaderTusResumable: "0.2.0", HeaderUploadLength: "5", HeaderUploadMetadata: filetype}, http.StatusPreconditionFailed},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			headers := map[string]string{HeaderTusResumable: TusVersion}
+			for k, v := range tt.headers {
+				headers[k] = v
+			}
+			w := serve(r, http.MethodPost, "/tus/", nil, headers)
+			if w.Code != tt.want {
+				t.Errorf("create returned %d, want %d", w.Code, tt.want)
+			}
+		})
+	}
+}
+
+func TestTusUploadOtherToken(t *testing.T) {
+	uh := newTestUploadHandler(t, testTusAuthConfig+`
+- token: other-token
+`)
+	r := newTestRouter(uh)
+	path := createTusUpload(t, r, 5)
+
+	// uploads can't be found with other tokens
+	w := serve(r, http.MethodHead, path, nil, map[string]string{
+		HeaderTusResumable: TusVersion,
+		"Authorization":    "Bearer other-token",
+	})
+	if w.Code != http.StatusNotFound {
+		t.Errorf("head with other token = %d, want 404", w.Code)
+	}
+
+	w = serve(r, http.MethodDelete, path, nil, map[string]string{HeaderTusResumable: TusVersion})
+	if w.Code != http.StatusNoContent {
+		t.Fatalf("delete = %d, want 204", w.Code)
+	}
+	w = serve(r, http.MethodHead, path, nil, map[string]string{HeaderTusResumable: TusVersion})
+	if w.Code != http.StatusNotFound {
+		t.Errorf("head after delete = %d, want 404", w.Code)
+	}
+}
@@ -18,6 +18,21 @@ var (
 		Name: "aqua_files_expired_total",
 		Help: "The total number of files expired",
 	})
+
+	filesDeleted = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "aqua_files_deleted_total",
+		Help: "The total number of files deleted before they expired",
+	})
+
+	requestsRateLimited = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "aqua_requests_rate_limited_total",
+		Help: "The total number of requests rejected by the rate limit",
+	}, []string{"kind"})
+
+	blobsScrubbed = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "aqua_blobs_scrubbed_total",
+		Help: "The total number of stored blobs checked against their digest",
+	}, []string{"result"})
 )
 
 // StartMetricsServer starts the internal Prometheus metrics server
@@ -45,3 +60,15 @@ func IncFilesUploaded() {
 func IncFilesExpired() {
 	filesExpired.Inc()
 }
+
+func IncFilesDeleted() {
+	filesDeleted.Inc()
+}
+
+func IncRequestsRateLimited(kind string) {
+	requestsRateLimited.WithLabelValues(kind).Inc()
+}
+
+func IncBlobsScrubbed(result string) {
+	blobsScrubbed.WithLabelValues(result).Inc()
+}
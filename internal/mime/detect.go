@@ -0,0 +1,97 @@
+package mime
+
+import (
+	"bytes"
+	"github.com/h2non/filetype"
+	"unicode/utf8"
+)
+
+const (
+	// HeaderSize is the amount of bytes needed
+	// from the start of a file to detect its type.
+	HeaderSize = 512
+
+	TypeText = "text/plain"
+)
+
+var (
+	// textTypes are types, which can't be distinguished from plain
+	// text by their magic bytes.
+	textTypes = map[string]bool{
+		"application/json": true,
+		"image/svg+xml":    true,
+		"text/csv":         true,
+		"text/plain":       true,
+	}
+
+	// aliases maps the detected type to the types, that use
+	// the same container format and are therefore detected the same.
+	aliases = map[string][]string{
+		"audio/ogg":   {"audio/opus"},
+		"video/webm":  {"audio/webm"},
+		"video/x-m4v": {"video/mp4"},
+	}
+)
+
+// Detect returns the MIME type of a file by looking at its first bytes.
+// If no binary format matches, the content is checked heuristically for text.
+// Returns an empty string if the type is unknown.
+func Detect(head []byte) string {
+	kind, err := filetype.Match(head)
+	if err == nil && kind != filetype.Unknown {
+		return kind.MIME.Value
+	}
+
+	if isText(head) {
+		return TypeText
+	}
+	return ""
+}
+
+// Matches returns if the declared type is consistent
+// with the detected type of the content.
+func Matches(declared string, detected string) bool {
+	if declared == detected {
+		return true
+	}
+	if detected == TypeText && textTypes[declared] {
+		return true
+	}
+
+	for _, alias := range aliases[detected] {
+		if alias == declared {
+			return true
+		}
+	}
+	return false
+}
+
+// isText guesses if the content is text by checking that it is valid UTF-8
+// without NUL bytes and only very few control characters.
+func isText(head []byte) bool {
+	if len(head) == 0 {
+		return true
+	}
+	if bytes.IndexByte(head, 0) != -1 {
+		return false
+	}
+
+	// the header could cut a multibyte character in half
+	for i := 0; i < utf8.UTFMax && !utf8.Valid(head); i++ {
+		head = head[:len(head)-1]
+		if len(head) == 0 {
+			return false
+		}
+	}
+	if !utf8.Valid(head) {
+		return false
+	}
+
+	control := 0
+	for _, b := range head {
+		if b < 0x20 && b != '\n' && b != '\r' && b != '\t' && b != '\f' && b != 0x1b {
+			control++
+		}
+	}
+	return control*100 <= len(head)
+}
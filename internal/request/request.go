@@ -3,36 +3,51 @@ package request
 import (
 	"encoding/json"
 	"github.com/superioz/aqua/internal/config"
+	"io"
 	"mime/multipart"
 )
 
-var (
-	emptyRequestMetadata = &RequestMetadata{Expiration: config.ExpireNever}
-)
-
 // RequestFormFile is the metadata we get from the file
 // which is requested to be uploaded.
 type RequestFormFile struct {
-	File          multipart.File
+	File          io.Reader
 	ContentType   string
 	ContentLength int64
 }
 
 type RequestMetadata struct {
 	Expiration int64 `json:"expiration"`
+
+	// MaxDownloads is the amount of downloads after which the
+	// file gets deleted. Zero or less means unlimited.
+	MaxDownloads int64 `json:"maxDownloads"`
+
+	// Password that has to be given to download the file.
+	Password string `json:"password"`
+}
+
+// newRequestMetadata returns the metadata of a request without
+// any metadata, i.e. a file that never expires.
+func newRequestMetadata() *RequestMetadata {
+	return &RequestMetadata{Expiration: config.ExpireNever}
 }
 
 func GetMetadata(form *multipart.Form) *RequestMetadata {
 	metaRawList := form.Value["metadata"]
 	if len(metaRawList) == 0 {
-		return emptyRequestMetadata
+		return newRequestMetadata()
 	}
-	metaRaw := metaRawList[0]
+	return ParseMetadata(metaRawList[0])
+}
 
-	var metadata *RequestMetadata
-	err := json.Unmarshal([]byte(metaRaw), &metadata)
+// ParseMetadata parses the metadata from its raw JSON representation.
+// Fields that are missing keep their default, e.g. a file without
+// expiration never expires. Returns the default metadata if it is not valid.
+func ParseMetadata(metaRaw string) *RequestMetadata {
+	metadata := newRequestMetadata()
+	err := json.Unmarshal([]byte(metaRaw), metadata)
 	if err != nil {
-		return emptyRequestMetadata
+		return newRequestMetadata()
 	}
 	return metadata
 }
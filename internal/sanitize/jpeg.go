@@ -0,0 +1,152 @@
+package sanitize
+
+import (
+	"bytes"
+	"encoding/binary"
+	"image"
+	"image/jpeg"
+)
+
+const (
+	markerSOI   = 0xd8
+	markerEOI   = 0xd9
+	markerSOS   = 0xda
+	markerAPP0  = 0xe0
+	markerAPP1  = 0xe1
+	markerAPP2  = 0xe2
+	markerAPP14 = 0xee
+
+	// jpegQuality is used, if the image has to be encoded again.
+	jpegQuality = 90
+)
+
+// jpegSegment is a marker segment before the image data.
+type jpegSegment struct {
+	marker byte
+	raw    []byte
+}
+
+// keepJPEGSegment returns if the segment is needed to display the image.
+// All other application segments and comments are removed.
+func keepJPEGSegment(s jpegSegment) bool {
+	switch {
+	case s.marker == markerAPP0:
+		// JFIF
+		return true
+	case s.marker == markerAPP2:
+		return bytes.HasPrefix(s.raw[4:], []byte("ICC_PROFILE\x00"))
+	case s.marker == markerAPP14:
+		// Adobe, the color transform of the image data
+		return true
+	case s.marker >= markerAPP0 && s.marker <= 0xef, s.marker == 0xfe:
+		return false
+	default:
+		return true
+	}
+}
+
+func stripJPEG(data []byte, maxPixels int64) ([]byte, error) {
+	if len(data) < 2 || data[0] != 0xff || data[1] != markerSOI {
+		return nil, ErrMalformed
+	}
+
+	var segments []jpegSegment
+	orientation := orientationNormal
+	pos := 2
+	for {
+		// markers can be preceded by any amount of fill bytes
+		for pos+1 < len(data) && data[pos] == 0xff && data[pos+1] == 0xff {
+			pos++
+		}
+		if pos+1 >= len(data) || data[pos] != 0xff {
+			return nil, ErrMalformed
+		}
+		marker := data[pos+1]
+		if marker == markerSOS || marker == markerEOI {
+			break
+		}
+		if marker == 0x01 || (marker >= 0xd0 && marker <= 0xd7) {
+			// without length
+			segments = append(segments, jpegSegment{marker: marker, raw: data[pos : pos+2]})
+			pos += 2
+			continue
+		}
+
+		if pos+4 > len(data) {
+			return nil, ErrMalformed
+		}
+		end := pos + 2 + int(binary.BigEndian.Uint16(data[pos+2:]))
+		if end > len(data) || end < pos+4 {
+			return nil, ErrMalformed
+		}
+		s := jpegSegment{marker: marker, raw: data[pos:end]}
+		if marker == markerAPP1 && bytes.HasPrefix(s.raw[4:], []byte("Exif\x00\x00")) {
+			orientation = exifOrientation(s.raw[10:])
+		}
+		segments = append(segments, s)
+		pos = end
+	}
+
+	// the image data ends with the first EOI, everything after it
+	// (e.g. embedded previews with their own metadata) is dropped.
+	scan := data[pos:]
+	if i := bytes.Index(scan, []byte{0xff, markerEOI}); i >= 0 {
+		scan = scan[:i+2]
+	}
+
+	if orientation != orientationNormal {
+		return orientJPEG(data, segments, orientation, maxPixels)
+	}
+
+	var buf bytes.Buffer
+	buf.Write(data[:2])
+	for _, s := range segments {
+		if keepJPEGSegment(s) {
+			buf.Write(s.raw)
+		}
+	}
+	buf.Write(scan)
+	return buf.Bytes(), nil
+}
+
+// orientJPEG decodes the image, applies the orientation and encodes it
+// again. Only the JFIF segment and the color profile are kept, as the
+// other segments describe the old image data.
+func orientJPEG(data []byte, segments []jpegSegment, orientation int, maxPixels int64) ([]byte, error) {
+	cfg, err := jpeg.DecodeConfig(bytes.NewReader(data))
+	if err != nil {
+		return nil, ErrMalformed
+	}
+	err = checkPixels(cfg, maxPixels)
+	if err != nil {
+		return nil, err
+	}
+	img, err := jpeg.Decode(bytes.NewReader(data))
+	if err != nil {
+		return nil, ErrMalformed
+	}
+
+	var encoded bytes.Buffer
+	err = jpeg.Encode(&encoded, orient(img, orientation), &jpeg.Options{Quality: jpegQuality})
+	if err != nil {
+		return nil, err
+	}
+
+	var buf bytes.Buffer
+	buf.Write(encoded.Bytes()[:2])
+	for _, s := range segments {
+		if s.marker == markerAPP0 {
+			buf.Write(s.raw)
+		}
+	}
+	if _, cmyk := img.(*image.CMYK); !cmyk {
+		// the profile of a CMYK image doesn't fit its RGB version
+		for _, s := range segments {
+			if s.marker == markerAPP2 && keepJPEGSegment(s) {
+				buf.Write(s.raw)
+			}
+		}
+	}
+	buf.Write(encoded.Bytes()[2:])
+	return buf.Bytes(), nil
+}
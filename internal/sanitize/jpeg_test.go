@@ -0,0 +1,102 @@
+package sanitize
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"image/jpeg"
+	"testing"
+)
+
+// jpegSegmentBytes returns a segment with given marker and payload.
+func jpegSegmentBytes(marker byte, payload []byte) []byte {
+	segment := []byte{0xff, marker, 0, 0}
+	binary.BigEndian.PutUint16(segment[2:], uint16(len(payload)+2))
+	return append(segment, payload...)
+}
+
+// testJPEG returns the test image as JPEG with EXIF data, a comment
+// and a color profile right after the start of the image.
+func testJPEG(t *testing.T, orientation int) []byte {
+	var encoded bytes.Buffer
+	err := jpeg.Encode(&encoded, testImage(), &jpeg.Options{Quality: 100})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var buf bytes.Buffer
+	buf.Write(encoded.Bytes()[:2])
+	buf.Write(jpegSegmentBytes(markerAPP1, append([]byte("Exif\x00\x00"), exifData(orientation)...)))
+	buf.Write(jpegSegmentBytes(0xfe, testSecret))
+	buf.Write(jpegSegmentBytes(markerAPP2, []byte("ICC_PROFILE\x00\x01\x01profile")))
+	buf.Write(encoded.Bytes()[2:])
+	return buf.Bytes()
+}
+
+func TestStripJPEG(t *testing.T) {
+	data := append(testJPEG(t, orientationNormal), testSecret...)
+
+	stripped, err := StripMetadata(data, "image/jpeg", 1000)
+	if err != nil {
+		t.Fatalf("StripMetadata() error = %v", err)
+	}
+	if bytes.Contains(stripped, []byte("Exif")) || bytes.Contains(stripped, testSecret) {
+		t.Errorf("metadata has not been removed")
+	}
+	if !bytes.Contains(stripped, []byte("ICC_PROFILE")) {
+		t.Errorf("color profile has been removed")
+	}
+
+	// the image data is kept as it is
+	img, err := jpeg.Decode(bytes.NewReader(stripped))
+	if err != nil {
+		t.Fatalf("stripped image can't be decoded: %v", err)
+	}
+	if b := img.Bounds(); b.Dx() != 16 || b.Dy() != 8 {
+		t.Errorf("stripped image is %dx%d, want 16x8", b.Dx(), b.Dy())
+	}
+	if !bytes.HasSuffix(stripped, data[len(data)-len(testSecret)-100:len(data)-len(testSecret)]) {
+		t.Errorf("image data has been changed")
+	}
+}
+
+func TestStripJPEGOrientation(t *testing.T) {
+	stripped, err := StripMetadata(testJPEG(t, 6), "image/jpeg", 1000)
+	if err != nil {
+		t.Fatalf("StripMetadata() error = %v", err)
+	}
+	if bytes.Contains(stripped, []byte("Exif")) || bytes.Contains(stripped, testSecret) {
+		t.Errorf("metadata has not been removed")
+	}
+	if !bytes.Contains(stripped, []byte("ICC_PROFILE")) {
+		t.Errorf("color profile has been removed")
+	}
+
+	img, err := jpeg.Decode(bytes.NewReader(stripped))
+	if err != nil {
+		t.Fatalf("stripped image can't be decoded: %v", err)
+	}
+	assertRotated(t, img)
+
+	// the pixels have to be decoded to apply the orientation
+	_, err = StripMetadata(testJPEG(t, 6), "image/jpeg", 100)
+	if !errors.Is(err, ErrImageTooLarge) {
+		t.Errorf("StripMetadata() of large image error = %v, want ErrImageTooLarge", err)
+	}
+}
+
+func TestStripJPEGMalformed(t *testing.T) {
+	data := testJPEG(t, orientationNormal)
+	for name, malformed := range map[string][]byte{
+		"empty":         {},
+		"no jpeg":       []byte("GIF89a"),
+		"truncated":     data[:10],
+		"bad length":    append([]byte{0xff, markerSOI, 0xff, markerAPP0, 0x00, 0x01}, data[2:]...),
+		"missing start": data[2:],
+	} {
+		_, err := StripMetadata(malformed, "image/jpeg", 1000)
+		if !errors.Is(err, ErrMalformed) {
+			t.Errorf("StripMetadata(%s) error = %v, want ErrMalformed", name, err)
+		}
+	}
+}
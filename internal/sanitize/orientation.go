@@ -0,0 +1,104 @@
+package sanitize
+
+import (
+	"encoding/binary"
+	"image"
+	"image/draw"
+)
+
+const (
+	orientationNormal = 1
+	orientationTag    = 0x0112
+)
+
+// exifOrientation returns the orientation from the TIFF structure of
+// EXIF data or orientationNormal, if it is missing or invalid.
+func exifOrientation(tiff []byte) int {
+	if len(tiff) < 8 {
+		return orientationNormal
+	}
+
+	var order binary.ByteOrder
+	switch string(tiff[:2]) {
+	case "II":
+		order = binary.LittleEndian
+	case "MM":
+		order = binary.BigEndian
+	default:
+		return orientationNormal
+	}
+
+	offset := int64(order.Uint32(tiff[4:8]))
+	if offset+2 > int64(len(tiff)) {
+		return orientationNormal
+	}
+	entries := int64(order.Uint16(tiff[offset:]))
+	for i := int64(0); i < entries; i++ {
+		entry := offset + 2 + i*12
+		if entry+12 > int64(len(tiff)) {
+			break
+		}
+		// a single SHORT, stored in the value field itself
+		if order.Uint16(tiff[entry:]) != orientationTag || order.Uint16(tiff[entry+2:]) != 3 {
+			continue
+		}
+		o := int(order.Uint16(tiff[entry+8:]))
+		if o < 1 || o > 8 {
+			return orientationNormal
+		}
+		return o
+	}
+	return orientationNormal
+}
+
+// checkPixels returns ErrImageTooLarge if the image
+// has more than maxPixels pixels.
+func checkPixels(cfg image.Config, maxPixels int64) error {
+	if int64(cfg.Width)*int64(cfg.Height) > maxPixels {
+		return ErrImageTooLarge
+	}
+	return nil
+}
+
+// orient transforms the image according to the EXIF orientation, so
+// that it is displayed correctly without the orientation.
+func orient(img image.Image, orientation int) image.Image {
+	b := img.Bounds()
+	src := image.NewNRGBA(image.Rect(0, 0, b.Dx(), b.Dy()))
+	draw.Draw(src, src.Bounds(), img, b.Min, draw.Src)
+	if orientation == orientationNormal {
+		return src
+	}
+
+	w, h := b.Dx(), b.Dy()
+	dw, dh := w, h
+	if orientation >= 5 {
+		// rotated by 90 degrees
+		dw, dh = h, w
+	}
+
+	dst := image.NewNRGBA(image.Rect(0, 0, dw, dh))
+	for dy := 0; dy < dh; dy++ {
+		for dx := 0; dx < dw; dx++ {
+			var sx, sy int
+			switch orientation {
+			case 2: // mirrored horizontally
+				sx, sy = w-1-dx, dy
+			case 3: // rotated by 180 degrees
+				sx, sy = w-1-dx, h-1-dy
+			case 4: // mirrored vertically
+				sx, sy = dx, h-1-dy
+			case 5: // transposed
+				sx, sy = dy, dx
+			case 6: // rotated by 90 degrees clockwise
+				sx, sy = dy, h-1-dx
+			case 7: // transversed
+				sx, sy = w-1-dy, h-1-dx
+			case 8: // rotated by 90 degrees counterclockwise
+				sx, sy = w-1-dy, dx
+			}
+			copy(dst.Pix[dy*dst.Stride+dx*4:dy*dst.Stride+dx*4+4], src.Pix[sy*src.Stride+sx*4:])
+		}
+	}
+	return dst
+}
@@ -0,0 +1,128 @@
+package sanitize
+
+import (
+	"bytes"
+	"encoding/binary"
+	"image/png"
+)
+
+const pngSignature = "\x89PNG\r\n\x1a\n"
+
+// pngMetadataChunks are removed from PNGs. Textual chunks
+// also contain XMP (iTXt with the keyword XML:com.adobe.xmp).
+var pngMetadataChunks = map[string]bool{
+	"eXIf": true,
+	"tEXt": true,
+	"zTXt": true,
+	"iTXt": true,
+	"tIME": true,
+}
+
+// pngColorChunks are kept if the image has to be encoded
+// again, as they describe its colors and not its data.
+var pngColorChunks = map[string]bool{
+	"cHRM": true,
+	"gAMA": true,
+	"iCCP": true,
+	"sRGB": true,
+}
+
+// pngChunk is a single chunk including its length and CRC.
+type pngChunk struct {
+	typ string
+	raw []byte
+}
+
+func stripPNG(data []byte, maxPixels int64) ([]byte, error) {
+	if !bytes.HasPrefix(data, []byte(pngSignature)) {
+		return nil, ErrMalformed
+	}
+
+	var chunks []pngChunk
+	orientation := orientationNormal
+	pos := len(pngSignature)
+	for {
+		if pos+8 > len(data) {
+			return nil, ErrMalformed
+		}
+		length := int64(binary.BigEndian.Uint32(data[pos:]))
+		end := int64(pos) + 12 + length
+		if end > int64(len(data)) {
+			return nil, ErrMalformed
+		}
+		c := pngChunk{typ: string(data[pos+4 : pos+8]), raw: data[pos:end]}
+		if c.typ == "eXIf" {
+			orientation = exifOrientation(c.raw[8 : len(c.raw)-4])
+		}
+		chunks = append(chunks, c)
+		pos = int(end)
+
+		// everything after the end is dropped
+		if c.typ == "IEND" {
+			break
+		}
+	}
+
+	if orientation != orientationNormal {
+		return orientPNG(data, chunks, orientation, maxPixels)
+	}
+
+	var buf bytes.Buffer
+	buf.WriteString(pngSignature)
+	for _, c := range chunks {
+		if !pngMetadataChunks[c.typ] {
+			buf.Write(c.raw)
+		}
+	}
+	return buf.Bytes(), nil
+}
+
+// orientPNG decodes the image, applies the orientation
+// and encodes it again, keeping its color information.
+func orientPNG(data []byte, chunks []pngChunk, orientation int, maxPixels int64) ([]byte, error) {
+	cfg, err := png.DecodeConfig(bytes.NewReader(data))
+	if err != nil {
+		return nil, ErrMalformed
+	}
+	err = checkPixels(cfg, maxPixels)
+	if err != nil {
+		return nil, err
+	}
+	img, err := png.Decode(bytes.NewReader(data))
+	if err != nil {
+		return nil, ErrMalformed
+	}
+
+	var encoded bytes.Buffer
+	err = png.Encode(&encoded, orient(img, orientation))
+	if err != nil {
+		return nil, err
+	}
+
+	// the color chunks have to be before the image data,
+	// so they are put right after the header (IHDR).
+	headerEnd := len(pngSignature) + 12 + int(binary.BigEndian.Uint32(encoded.Bytes()[len(pngSignature):]))
+	var buf bytes.Buffer
+	buf.Write(encoded.Bytes()[:headerEnd])
+	for _, c := range chunks {
+		if !pngColorChunks[c.typ] {
+			continue
+		}
+		if c.typ == "iCCP" && isGrayPNG(chunks[0]) {
+			// the profile of a grayscale image doesn't fit its RGB version
+			continue
+		}
+		buf.Write(c.raw)
+	}
+	buf.Write(encoded.Bytes()[headerEnd:])
+	return buf.Bytes(), nil
+}
+
+// isGrayPNG returns if the color type in the header (IHDR) is grayscale.
+func isGrayPNG(header pngChunk) bool {
+	if header.typ != "IHDR" || len(header.raw) < 18 {
+		return false
+	}
+	colorType := header.raw[17]
+	return colorType == 0 || colorType == 4
+}
@@ -0,0 +1,103 @@
+package sanitize
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"hash/crc32"
+	"image/png"
+	"testing"
+)
+
+// pngChunkBytes returns a chunk with given type and data.
+func pngChunkBytes(typ string, data []byte) []byte {
+	chunk := make([]byte, 8+len(data)+4)
+	binary.BigEndian.PutUint32(chunk, uint32(len(data)))
+	copy(chunk[4:], typ)
+	copy(chunk[8:], data)
+	binary.BigEndian.PutUint32(chunk[8+len(data):], crc32.ChecksumIEEE(chunk[4:8+len(data)]))
+	return chunk
+}
+
+// testPNG returns the test image as PNG with EXIF data, a
+// text chunk and the gamma right after the header.
+func testPNG(t *testing.T, orientation int) []byte {
+	var encoded bytes.Buffer
+	err := png.Encode(&encoded, testImage())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	headerEnd := len(pngSignature) + 12 + 13
+	var buf bytes.Buffer
+	buf.Write(encoded.Bytes()[:headerEnd])
+	buf.Write(pngChunkBytes("gAMA", []byte{0, 0, 0xb1, 0x8f}))
+	buf.Write(pngChunkBytes("eXIf", exifData(orientation)))
+	buf.Write(pngChunkBytes("tEXt", append([]byte("Comment\x00"), testSecret...)))
+	buf.Write(encoded.Bytes()[headerEnd:])
+	return buf.Bytes()
+}
+
+func TestStripPNG(t *testing.T) {
+	data := append(testPNG(t, orientationNormal), testSecret...)
+
+	stripped, err := StripMetadata(data, "image/png", 1000)
+	if err != nil {
+		t.Fatalf("StripMetadata() error = %v", err)
+	}
+	if bytes.Contains(stripped, []byte("eXIf")) || bytes.Contains(stripped, testSecret) {
+		t.Errorf("metadata has not been removed")
+	}
+	if !bytes.Contains(stripped, []byte("gAMA")) {
+		t.Errorf("gamma has been removed")
+	}
+
+	img, err := png.Decode(bytes.NewReader(stripped))
+	if err != nil {
+		t.Fatalf("stripped image can't be decoded: %v", err)
+	}
+	if b := img.Bounds(); b.Dx() != 16 || b.Dy() != 8 {
+		t.Errorf("stripped image is %dx%d, want 16x8", b.Dx(), b.Dy())
+	}
+	assertColor(t, img, 2, 4, testRed)
+	assertColor(t, img, 13, 4, testBlue)
+}
+
+func TestStripPNGOrientation(t *testing.T) {
+	stripped, err := StripMetadata(testPNG(t, 6), "image/png", 1000)
+	if err != nil {
+		t.Fatalf("StripMetadata() error = %v", err)
+	}
+	if bytes.Contains(stripped, []byte("eXIf")) || bytes.Contains(stripped, testSecret) {
+		t.Errorf("metadata has not been removed")
+	}
+	if !bytes.Contains(stripped, []byte("gAMA")) {
+		t.Errorf("gamma has been removed")
+	}
+
+	img, err := png.Decode(bytes.NewReader(stripped))
+	if err != nil {
+		t.Fatalf("stripped image can't be decoded: %v", err)
+	}
+	assertRotated(t, img)
+
+	_, err = StripMetadata(testPNG(t, 6), "image/png", 100)
+	if !errors.Is(err, ErrImageTooLarge) {
+		t.Errorf("StripMetadata() of large image error = %v, want ErrImageTooLarge", err)
+	}
+}
+
+func TestStripPNGMalformed(t *testing.T) {
+	data := testPNG(t, orientationNormal)
+	for name, malformed := range map[string][]byte{
+		"empty":     {},
+		"no png":    []byte("GIF89a"),
+		"truncated": data[:len(data)-20],
+		"no end":    data[:len(data)-12],
+	} {
+		_, err := StripMetadata(malformed, "image/png", 1000)
+		if !errors.Is(err, ErrMalformed) {
+			t.Errorf("StripMetadata(%s) error = %v, want ErrMalformed", name, err)
+		}
+	}
+}
@@ -0,0 +1,47 @@
+package sanitize
+
+import (
+	"errors"
+	"fmt"
+)
+
+var (
+	ErrMalformed     = errors.New("file is malformed")
+	ErrImageTooLarge = errors.New("image is too large")
+)
+
+// IsActive returns if files of given type can contain content, that is
+// run by the browser, e.g. scripts. See SVG.
+func IsActive(mimeType string) bool {
+	switch mimeType {
+	case "image/svg+xml", "text/html", "application/xhtml+xml", "text/xml", "application/xml":
+		return true
+	default:
+		return false
+	}
+}
+
+// CanStripMetadata returns if StripMetadata supports files of given type.
+func CanStripMetadata(mimeType string) bool {
+	return mimeType == "image/jpeg" || mimeType == "image/png"
+}
+
+// StripMetadata removes everything from the image, that is not needed to
+// display it, especially EXIF and XMP metadata, which can contain the
+// location and the device a photo has been taken with. Color profiles
+// are kept.
+//
+// The image is only decoded and encoded again, if its EXIF orientation
+// has to be applied to the pixels before the EXIF data can be removed.
+// Images with more than maxPixels pixels are not decoded and
+// ErrImageTooLarge is returned instead.
+func StripMetadata(data []byte, mimeType string, maxPixels int64) ([]byte, error) {
+	switch mimeType {
+	case "image/jpeg":
+		return stripJPEG(data, maxPixels)
+	case "image/png":
+		return stripPNG(data, maxPixels)
+	default:
+		return nil, fmt.Errorf("can not strip metadata of %s", mimeType)
+	}
+}
@@ -0,0 +1,76 @@
+package sanitize
+
+import (
+	"bytes"
+	"encoding/binary"
+	"image"
+	"image/color"
+	"testing"
+)
+
+var (
+	testRed  = color.NRGBA{R: 255, A: 255}
+	testBlue = color.NRGBA{B: 255, A: 255}
+
+	// testSecret is put into the metadata, which has to be removed.
+	testSecret = []byte("52.5200N 13.4050E")
+)
+
+// testImage returns a 16x8 image, which is red on the left and blue on the right.
+func testImage() image.Image {
+	img := image.NewNRGBA(image.Rect(0, 0, 16, 8))
+	for y := 0; y < 8; y++ {
+		for x := 0; x < 16; x++ {
+			c := testRed
+			if x >= 8 {
+				c = testBlue
+			}
+			img.SetNRGBA(x, y, c)
+		}
+	}
+	return img
+}
+
+// exifData returns EXIF data in TIFF format with given orientation,
+// followed by the secret.
+func exifData(orientation int) []byte {
+	var buf bytes.Buffer
+	buf.WriteString("MM\x00\x2a")
+	_ = binary.Write(&buf, binary.BigEndian, uint32(8))
+
+	// a single entry with the orientation as SHORT
+	_ = binary.Write(&buf, binary.BigEndian, uint16(1))
+	_ = binary.Write(&buf, binary.BigEndian, []uint16{orientationTag, 3})
+	_ = binary.Write(&buf, binary.BigEndian, uint32(1))
+	_ = binary.Write(&buf, binary.BigEndian, []uint16{uint16(orientation), 0})
+	_ = binary.Write(&buf, binary.BigEndian, uint32(0))
+
+	buf.Write(testSecret)
+	return buf.Bytes()
+}
+
+// assertRotated checks that the test image has been rotated by 90 degrees
+// clockwise, i.e. it is red at the top and blue at the bottom.
+func assertRotated(t *testing.T, img image.Image) {
+	t.Helper()
+
+	if b := img.Bounds(); b.Dx() != 8 || b.Dy() != 16 {
+		t.Fatalf("rotated image is %dx%d, want 8x16", b.Dx(), b.Dy())
+	}
+	assertColor(t, img, 4, 2, testRed)
+	assertColor(t, img, 4, 13, testBlue)
+}
+
+// assertColor checks the color of the pixel, with a tolerance
+// for lossy formats.
+func assertColor(t *testing.T, img image.Image, x int, y int, want color.NRGBA) {
+	t.Helper()
+
+	got := color.NRGBAModel.Convert(img.At(img.Bounds().Min.X+x, img.Bounds().Min.Y+y)).(color.NRGBA)
+	for _, d := range []int{int(got.R) - int(want.R), int(got.G) - int(want.G), int(got.B) - int(want.B)} {
+		if d < -16 || d > 16 {
+			t.Errorf("color at %d,%d = %v, want %v", x, y, got, want)
+			return
+		}
+	}
+}
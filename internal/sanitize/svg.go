@@ -0,0 +1,258 @@
+package sanitize
+
+import (
+	"bytes"
+	"encoding/xml"
+	"io"
+	"regexp"
+	"strings"
+)
+
+const (
+	svgNamespace   = "http://www.w3.org/2000/svg"
+	xlinkNamespace = "http://www.w3.org/1999/xlink"
+	xmlNamespace   = "http://www.w3.org/XML/1998/namespace"
+)
+
+// svgElements are the SVG elements that are kept, all other elements
+// (including those of other namespaces) are removed with their content.
+var svgElements = toSet(
+	"svg", "g", "defs", "desc", "title", "metadata", "symbol", "use", "image", "switch", "a", "view",
+	"style", "path", "rect", "circle", "ellipse", "line", "polyline", "polygon",
+	"text", "tspan", "textPath", "marker", "linearGradient", "radialGradient", "stop", "pattern",
+	"clipPath", "mask", "filter", "feBlend", "feColorMatrix", "feComponentTransfer", "feComposite",
+	"feConvolveMatrix", "feDiffuseLighting", "feDisplacementMap", "feDistantLight", "feDropShadow",
+	"feFlood", "feFuncA", "feFuncB", "feFuncG", "feFuncR", "feGaussianBlur", "feImage", "feMerge",
+	"feMergeNode", "feMorphology", "feOffset", "fePointLight", "feSpecularLighting", "feSpotLight",
+	"feTile", "feTurbulence", "animate", "animateMotion", "animateTransform", "set", "mpath",
+)
+
+// svgAnimations can change the value of other attributes.
+var svgAnimations = toSet("animate", "animateMotion", "animateTransform", "set")
+
+// svgAttrs are the attributes without namespace that are kept.
+var svgAttrs = toSet(
+	// core and geometry
+	"id", "class", "style", "lang", "tabindex", "transform", "x", "y", "x1", "y1", "x2", "y2",
+	"cx", "cy", "r", "rx", "ry", "fx", "fy", "fr", "width", "height", "d", "points", "pathLength",
+	"viewBox", "preserveAspectRatio", "version", "baseProfile", "href",
+	"requiredFeatures", "requiredExtensions", "systemLanguage",
+	// text
+	"dx", "dy", "rotate", "textLength", "lengthAdjust", "startOffset", "method", "spacing", "side",
+	// gradients, patterns, markers, clipping and masking
+	"offset", "gradientUnits", "gradientTransform", "spreadMethod", "patternUnits",
+	"patternContentUnits", "patternTransform", "clipPathUnits", "maskUnits", "maskContentUnits",
+	"markerUnits", "markerWidth", "markerHeight", "refX", "refY", "orient",
+	// filters
+	"filterUnits", "primitiveUnits", "result", "in", "in2", "mode", "type", "values", "operator",
+	"k1", "k2", "k3", "k4", "stdDeviation", "edgeMode", "kernelMatrix", "order", "divisor", "bias",
+	"targetX", "targetY", "preserveAlpha", "surfaceScale", "diffuseConstant", "specularConstant",
+	"specularExponent", "kernelUnitLength", "scale", "xChannelSelector", "yChannelSelector",
+	"azimuth", "elevation", "pointsAtX", "pointsAtY", "pointsAtZ", "limitingConeAngle",
+	"baseFrequency", "numOctaves", "seed", "stitchTiles", "radius", "tableValues", "slope",
+	"intercept", "amplitude", "exponent",
+	// animations
+	"attributeName", "attributeType", "begin", "dur", "end", "min", "max", "restart", "repeatCount",
+	"repeatDur", "fill", "calcMode", "keyTimes", "keySplines", "from", "to", "by", "additive",
+	"accumulate", "path", "keyPoints",
+	// presentation
+	"alignment-baseline", "baseline-shift", "clip", "clip-path", "clip-rule", "color",
+	"color-interpolation", "color-interpolation-filters", "color-rendering", "cursor", "direction",
+	"display", "dominant-baseline", "fill-opacity", "fill-rule", "filter", "flood-color",
+	"flood-opacity", "font-family", "font-size", "font-size-adjust", "font-stretch", "font-style",
+	"font-variant", "font-weight", "image-rendering", "isolation", "letter-spacing",
+	"lighting-color", "marker-start", "marker-mid", "marker-end", "mask", "mix-blend-mode",
+	"opacity", "overflow", "paint-order", "pointer-events", "shape-rendering", "stop-color",
+	"stop-opacity", "stroke", "stroke-dasharray", "stroke-dashoffset", "stroke-linecap",
+	"stroke-linejoin", "stroke-miterlimit", "stroke-opacity", "stroke-width", "text-anchor",
+	"text-decoration", "text-rendering", "transform-origin", "unicode-bidi", "vector-effect",
+	"visibility", "word-spacing", "writing-mode",
+)
+
+var (
+	// svgUrl matches every url() in CSS or presentation attributes.
+	svgUrl = regexp.MustCompile(`(?i)url\s*\(\s*['"]?\s*([^'")\s]*)`)
+
+	// svgDataImage matches embedded raster images, which
+	// are the only references to other documents allowed.
+	svgDataImage = regexp.MustCompile(`(?i)^data:image/(png|jpeg|gif|webp)[;,]`)
+
+	svgTextEscaper = strings.NewReplacer("&", "&amp;", "<", "&lt;", ">", "&gt;")
+	svgAttrEscaper = strings.NewReplacer("&", "&amp;", "<", "&lt;", ">", "&gt;", `"`, "&quot;")
+)
+
+// SVG only keeps the SVG elements and attributes, that can't run a
+// script or load something from somewhere else. Elements of other
+// namespaces (e.g. XHTML), scripts, event handlers, embedded documents,
+// links and references to other files, style sheets that import other
+// files, processing instructions and document types are removed.
+// References inside of the document (e.g. `#gradient`) and embedded
+// raster images are kept.
+//
+// Returns ErrMalformed if the SVG is no well-formed XML or its root is
+// not an SVG element. Entities that are not predefined by XML are not
+// supported either.
+func SVG(data []byte) ([]byte, error) {
+	d := xml.NewDecoder(bytes.NewReader(data))
+	d.Strict = true
+
+	var buf bytes.Buffer
+	// depth of the removed element we are in, zero if we are in none
+	skip := 0
+	// content of the style sheet we are in, nil if we are in none
+	var style []byte
+	// depth of the element we are in, zero if we are outside of the root
+	depth := 0
+	hasRoot := false
+	for {
+		// namespaces are resolved, so that
+		// prefixes can't hide other elements.
+		t, err := d.Token()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, ErrMalformed
+		}
+
+		switch t := t.(type) {
+		case xml.StartElement:
+			if depth == 0 && skip == 0 && (t.Name.Local != "svg" || !isAllowedSVGElement(t)) {
+				return nil, ErrMalformed
+			}
+			if skip > 0 || style != nil || !isAllowedSVGElement(t) {
+				skip++
+				continue
+			}
+			if t.Name.Local == "style" {
+				style = []byte{}
+			}
+			buf.WriteString("<" + t.Name.Local)
+			if depth == 0 {
+				hasRoot = true
+				buf.WriteString(` xmlns="` + svgNamespace + `" xmlns:xlink="` + xlinkNamespace + `"`)
+			}
+			for _, attr := range t.Attr {
+				name, ok := svgAttrName(attr.Name)
+				if !ok || !isAllowedSVGAttr(name, attr.Value) {
+					continue
+				}
+				buf.WriteString(" " + name + `="` + svgAttrEscaper.Replace(attr.Value) + `"`)
+			}
+			buf.WriteString(">")
+			depth++
+		case xml.EndElement:
+			if skip > 0 {
+				skip--
+				continue
+			}
+			if style != nil {
+				// the style sheet is emptied, if it has a reference
+				if isAllowedSVGStyle(string(style)) {
+					buf.WriteString(svgTextEscaper.Replace(string(style)))
+				}
+				style = nil
+			}
+			buf.WriteString("</" + t.Name.Local + ">")
+			depth--
+		case xml.CharData:
+			if skip > 0 {
+				continue
+			}
+			if style != nil {
+				style = append(style, t...)
+				continue
+			}
+			if depth == 0 && len(bytes.TrimSpace(t)) > 0 {
+				// only whitespace is allowed outside of the root
+				continue
+			}
+			buf.WriteString(svgTextEscaper.Replace(string(t)))
+		case xml.ProcInst:
+			// only the declaration, style sheets could be loaded otherwise
+			if skip == 0 && t.Target == "xml" {
+				buf.WriteString("<?xml " + string(t.Inst) + "?>")
+			}
+		}
+	}
+	if skip > 0 || depth > 0 || !hasRoot {
+		return nil, ErrMalformed
+	}
+	return buf.Bytes(), nil
+}
+
+// isAllowedSVGElement returns if the element is a known SVG element.
+// Elements without namespace are treated as SVG elements, as they
+// are written with the SVG namespace.
+func isAllowedSVGElement(e xml.StartElement) bool {
+	if e.Name.Space != svgNamespace && e.Name.Space != "" {
+		return false
+	}
+	if !svgElements[e.Name.Local] {
+		return false
+	}
+	if svgAnimations[e.Name.Local] {
+		for _, attr := range e.Attr {
+			if attr.Name.Local != "attributeName" {
+				continue
+			}
+			// the value can have a prefix, e.g. `xlink:href`
+			name := attr.Value[strings.LastIndex(attr.Value, ":")+1:]
+			if !svgAttrs[name] || name == "href" || name == "style" {
+				return false
+			}
+		}
+	}
+	return true
+}
+
+// svgAttrName returns the name of the attribute as it is written,
+// if the attribute is known.
+func svgAttrName(name xml.Name) (string, bool) {
+	switch name.Space {
+	case "":
+		return name.Local, svgAttrs[name.Local]
+	case xlinkNamespace:
+		return "xlink:" + name.Local, name.Local == "href"
+	case xmlNamespace:
+		return "xml:" + name.Local, name.Local == "space" || name.Local == "lang"
+	}
+	// including the namespace declarations, as we declare our own
+	return "", false
+}
+
+// isAllowedSVGAttr returns if the value of the attribute
+// only references something inside of the document.
+func isAllowedSVGAttr(name string, value string) bool {
+	if name == "href" || name == "xlink:href" {
+		value = strings.TrimSpace(value)
+		return strings.HasPrefix(value, "#") || svgDataImage.MatchString(value)
+	}
+	return isAllowedSVGStyle(value)
+}
+
+// isAllowedSVGStyle returns if the CSS (or any other attribute value)
+// only references something inside of the document. CSS escapes are not
+// allowed at all, as they could hide a reference.
+func isAllowedSVGStyle(css string) bool {
+	lower := strings.ToLower(css)
+	for _, s := range []string{"@import", "image-set", "javascript:", `\`} {
+		if strings.Contains(lower, s) {
+			return false
+		}
+	}
+	for _, m := range svgUrl.FindAllStringSubmatch(css, -1) {
+		if !strings.HasPrefix(m[1], "#") && !svgDataImage.MatchString(m[1]) {
+			return false
+		}
+	}
+	return true
+}
+
+func toSet(values ...string) map[string]bool {
+	set := make(map[string]bool, len(values))
+	for _, v := range values {
+		set[v] = true
+	}
+	return set
+}
@@ -0,0 +1,141 @@
+package sanitize
+
+import (
+	"errors"
+	"strings"
+	"testing"
+)
+
+func TestSVG(t *testing.T) {
+	tests := []struct {
+		name    string
+		svg     string
+		removed []string
+		kept    []string
+	}{
+		{
+			name:    "script",
+			svg:     `<svg xmlns="http://www.w3.org/2000/svg"><script>alert(1)</script><SCRIPT>alert(2)</SCRIPT><rect width="1"/></svg>`,
+			removed: []string{"script", "SCRIPT", "alert"},
+			kept:    []string{`<rect width="1">`},
+		},
+		{
+			name:    "event handlers",
+			svg:     `<svg xmlns="http://www.w3.org/2000/svg" onload="alert(1)"><rect onclick="alert(2)" onmouseover="alert(3)" fill="red"/></svg>`,
+			removed: []string{"onload", "onclick", "onmouseover", "alert"},
+			kept:    []string{`fill="red"`},
+		},
+		{
+			name: "xhtml",
+			svg: `<svg xmlns="http://www.w3.org/2000/svg" xmlns:h="http://www.w3.org/1999/xhtml">` +
+				`<foreignObject><div xmlns="http://www.w3.org/1999/xhtml"><iframe src="https://example.com"/></div></foreignObject>` +
+				`<h:form action="https://example.com"><h:input name="password"/></h:form>` +
+				`<h:meta http-equiv="refresh" content="0;url=https://example.com"/></svg>`,
+			removed: []string{"foreignObject", "iframe", "form", "input", "meta", "example.com"},
+		},
+		{
+			// the prefix is bound to the SVG namespace only in the
+			// document, the element itself is in the XHTML namespace.
+			name:    "prefixed element of other namespace",
+			svg:     `<svg xmlns="http://www.w3.org/2000/svg" xmlns:svg="http://www.w3.org/1999/xhtml"><svg:script>alert(1)</svg:script></svg>`,
+			removed: []string{"script", "alert"},
+		},
+		{
+			name:    "unbound prefix",
+			svg:     `<svg xmlns="http://www.w3.org/2000/svg"><x:script>alert(1)</x:script><rect x:onload="alert(2)"/></svg>`,
+			removed: []string{"script", "onload", "alert"},
+		},
+		{
+			name: "links",
+			svg: `<svg xmlns="http://www.w3.org/2000/svg" xmlns:xlink="http://www.w3.org/1999/xlink">` +
+				`<a href="javascript:alert(1)"><text>a</text></a><a xlink:href="https://example.com"><text>b</text></a>` +
+				`<use href="https://example.com/sprite.svg#icon"/><image href="https://example.com/tracker.png"/>` +
+				`<use xlink:href="#local"/><image href="data:image/png;base64,iVBORw0KGgo="/></svg>`,
+			removed: []string{"javascript", "example.com"},
+			kept:    []string{`xlink:href="#local"`, `href="data:image/png;base64,iVBORw0KGgo="`},
+		},
+		{
+			name: "animated links",
+			svg: `<svg xmlns="http://www.w3.org/2000/svg"><a><set attributeName="href" to="javascript:alert(1)"/>` +
+				`<animate attributeName="xlink:href" values="https://example.com"/><animate attributeName="onclick" to="alert(2)"/>` +
+				`<animate attributeName="opacity" from="0" to="1" dur="1s"/><text>a</text></a></svg>`,
+			removed: []string{"<set", "href", "javascript", "example.com", "onclick", "alert"},
+			kept:    []string{`<animate attributeName="opacity" from="0" to="1" dur="1s">`},
+		},
+		{
+			name: "style",
+			svg: `<svg xmlns="http://www.w3.org/2000/svg"><style>@import url(https://example.com/a.css);</style>` +
+				`<style>rect { fill: url(#gradient) }</style>` +
+				`<rect style="fill: url('https://example.com/a.png')"/><rect fill="url(https://example.com/b.svg#p)"/>` +
+				`<rect style="background: \75 rl(https://example.com)"/><rect style="fill: url(#gradient)"/></svg>`,
+			removed: []string{"@import", "example.com"},
+			kept:    []string{`<style>rect { fill: url(#gradient) }</style>`, `<rect style="fill: url(#gradient)">`},
+		},
+		{
+			name: "processing instructions and doctype",
+			svg: `<?xml version="1.0" encoding="UTF-8"?><?xml-stylesheet href="https://example.com/a.css"?>` +
+				`<!DOCTYPE svg PUBLIC "-//W3C//DTD SVG 1.1//EN" "https://example.com/svg11.dtd">` +
+				`<svg xmlns="http://www.w3.org/2000/svg"><!-- comment --><rect/></svg>`,
+			removed: []string{"xml-stylesheet", "DOCTYPE", "example.com", "comment"},
+			kept:    []string{`<?xml version="1.0" encoding="UTF-8"?>`},
+		},
+		{
+			name:    "namespace declarations",
+			svg:     `<svg xmlns="http://www.w3.org/2000/svg" xmlns:ev="http://www.w3.org/2001/xml-events" ev:event="click" xml:space="preserve"><text>a &lt; b</text></svg>`,
+			removed: []string{"xml-events", "ev:event"},
+			kept:    []string{`xml:space="preserve"`, `<text>a &lt; b</text>`},
+		},
+		{
+			name: "without namespace",
+			svg:  `<svg viewBox="0 0 10 10"><circle cx="5" cy="5" r="5"/></svg>`,
+			kept: []string{`<svg xmlns="http://www.w3.org/2000/svg"`, `viewBox="0 0 10 10"`, `<circle cx="5" cy="5" r="5">`},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			sanitized, err := SVG([]byte(tt.svg))
+			if err != nil {
+				t.Fatalf("SVG() error = %v", err)
+			}
+			got := string(sanitized)
+			for _, s := range tt.removed {
+				if strings.Contains(got, s) {
+					t.Errorf("SVG() = %s, must not contain %q", got, s)
+				}
+			}
+			for _, s := range tt.kept {
+				if !strings.Contains(got, s) {
+					t.Errorf("SVG() = %s, must contain %q", got, s)
+				}
+			}
+
+			// the result is well-formed and does not change anymore
+			again, err := SVG(sanitized)
+			if err != nil || string(again) != got {
+				t.Errorf("SVG() of sanitized SVG = %s, %v, want %s", again, err, got)
+			}
+		})
+	}
+}
+
+func TestSVGMalformed(t *testing.T) {
+	tests := map[string]string{
+		"empty":         ``,
+		"no xml":        `not an svg`,
+		"unclosed":      `<svg xmlns="http://www.w3.org/2000/svg"><rect>`,
+		"html root":     `<html><body><svg xmlns="http://www.w3.org/2000/svg"/></body></html>`,
+		"xhtml root":    `<svg xmlns="http://www.w3.org/1999/xhtml"><script>alert(1)</script></svg>`,
+		"other root":    `<rect xmlns="http://www.w3.org/2000/svg"/>`,
+		"entity":        `<!DOCTYPE svg [<!ENTITY a "alert(1)">]><svg xmlns="http://www.w3.org/2000/svg"><text>&a;</text></svg>`,
+		"two roots":     `<svg xmlns="http://www.w3.org/2000/svg"/><script>alert(1)</script>`,
+		"invalid chars": "<svg xmlns=\"http://www.w3.org/2000/svg\">\x00</svg>",
+	}
+	for name, svg := range tests {
+		t.Run(name, func(t *testing.T) {
+			sanitized, err := SVG([]byte(svg))
+			if !errors.Is(err, ErrMalformed) {
+				t.Errorf("SVG() = %s, %v, want ErrMalformed", sanitized, err)
+			}
+		})
+	}
+}
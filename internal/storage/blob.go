@@ -0,0 +1,191 @@
+package storage
+
+import (
+	"errors"
+	"fmt"
+	"k8s.io/klog"
+	"os"
+	"sync"
+)
+
+// Blob is the physical content of one or more files. Files with
+// the same content share the same blob, which is only deleted
+// after the last file referencing it is gone.
+type Blob struct {
+	// Digest is the hex encoded SHA-256 of the content.
+	Digest string
+	Size   int64
+
+	// KeyId is the id of the key the blob has been encrypted
+	// with. Empty if the blob is not encrypted.
+	KeyId string
+
+	// Name is the name of the blob inside of the file system,
+	// which is kept for as long as the blob exists.
+	Name string
+
+	// Refs is the amount of files referencing the blob.
+	Refs int64
+}
+
+// newBlobName returns the name of a new blob with given digest inside of the
+// file system. With encryption, the name is an HMAC of the digest, so that
+// nobody with access to the storage can tell which content is stored.
+func (fs *FileStorage) newBlobName(digest string) string {
+	if efs, ok := fs.fileSystem.(*EncryptedFileSystem); ok {
+		return "blob-" + efs.HashName(digest)
+	}
+	return "blob-" + digest
+}
+
+// tempName returns the name of the temporary file,
+// that an upload is written to before it becomes a blob.
+func tempName(name string) string {
+	return "tmp-" + name
+}
+
+// fileName returns the name of the physical file inside of the file
+// system. Files stored before the deduplication have their own file.
+func (sf *StoredFile) fileName() string {
+	if sf.Digest == "" {
+		return sf.Id
+	}
+	return sf.BlobName
+}
+
+// storeBlob turns the temporary file into the blob with given digest.
+// If the blob already exists, the temporary file is deleted instead.
+// Returns the blob with a reference for the new file.
+func (fs *FileStorage) storeBlob(tmpName string, b *Blob) (*Blob, error) {
+	unlock := fs.blobLocks.lock(b.Digest)
+	defer unlock()
+
+	stored, err := fs.fileMetaDb.AcquireBlob(b)
+	if err != nil {
+		fs.deleteTempFile(tmpName)
+		return nil, err
+	}
+
+	if stored.Refs > 1 {
+		// the same content has been stored before, but the blob might
+		// have been quarantined, so the new content replaces it then.
+		ok, err := fs.fileSystem.Exists(stored.Name)
+		if err == nil && ok {
+			fs.deleteTempFile(tmpName)
+			return stored, nil
+		}
+		klog.Warningf("Blob %s is missing, replace it with the new upload", b.Digest)
+	}
+
+	err = fs.fileSystem.MoveFile(tmpName, stored.Name)
+	if err != nil {
+		fs.deleteTempFile(tmpName)
+		if err := fs.releaseBlob(b.Digest, stored.Name); err != nil {
+			klog.Errorf("Could not roll back blob %s: %v", b.Digest, err)
+		}
+		return nil, fmt.Errorf("could not move file to blob %s: %v", b.Digest, err)
+	}
+
+	if stored.KeyId != b.KeyId {
+		// the replaced blob has been encrypted with another key
+		err = fs.fileMetaDb.UpdateBlobKey(b.Digest, b.KeyId)
+		if err != nil {
+			if err := fs.releaseBlob(b.Digest, stored.Name); err != nil {
+				klog.Errorf("Could not roll back blob %s: %v", b.Digest, err)
+			}
+			return nil, fmt.Errorf("could not update key of blob %s: %v", b.Digest, err)
+		}
+		stored.KeyId = b.KeyId
+	}
+	return stored, nil
+}
+
+// releaseBlob removes a reference from the blob with given digest and
+// deletes the blob with given name if it is not referenced anymore.
+// The blob has to be locked by the caller.
+func (fs *FileStorage) releaseBlob(digest string, name string) error {
+	gone, err := fs.fileMetaDb.ReleaseBlob(digest, func() error {
+		fs.deleteThumbnails(name)
+		err := fs.fileSystem.DeleteFile(name)
+		if errors.Is(err, os.ErrNotExist) {
+			klog.Warningf("Blob %s has metadata, but does not exist", digest)
+			return nil
+		}
+		return err
+	})
+	if err != nil {
+		return fmt.Errorf("could not release blob %s: %v", digest, err)
+	}
+	if gone {
+		klog.Infof("Delete blob %s (not referenced anymore)", digest)
+	}
+	return nil
+}
+
+// rollbackBlob releases the reference of a file,
+// whose metadata could not be written.
+func (fs *FileStorage) rollbackBlob(b *Blob) {
+	unlock := fs.blobLocks.lock(b.Digest)
+	defer unlock()
+
+	err := fs.releaseBlob(b.Digest, b.Name)
+	if err != nil {
+		klog.Errorf("Could not roll back blob %s: %v", b.Digest, err)
+	}
+}
+
+// fileLock locks the physical file of given file and returns the
+// unlock function. Files sharing a blob share the same lock.
+func (fs *FileStorage) fileLock(sf *StoredFile) func() {
+	if sf.Digest == "" {
+		return fs.blobLocks.lock(sf.Id)
+	}
+	return fs.blobLocks.lock(sf.Digest)
+}
+
+// deleteTempFile deletes a temporary file, that is not needed anymore.
+func (fs *FileStorage) deleteTempFile(name string) {
+	err := fs.fileSystem.DeleteFile(name)
+	if err != nil && !errors.Is(err, os.ErrNotExist) {
+		klog.Warningf("Could not delete temporary file %s: %v", name, err)
+	}
+}
+
+// keyLocks locks by key, without holding on to the
+// locks of keys that are not in use anymore.
+type keyLocks struct {
+	mu    sync.Mutex
+	locks map[string]*keyLock
+}
+
+type keyLock struct {
+	sync.Mutex
+	users int
+}
+
+// lock locks given key and returns the unlock function.
+func (kl *keyLocks) lock(key string) func() {
+	kl.mu.Lock()
+	if kl.locks == nil {
+		kl.locks = make(map[string]*keyLock)
+	}
+	l, ok := kl.locks[key]
+	if !ok {
+		l = &keyLock{}
+		kl.locks[key] = l
+	}
+	l.users++
+	kl.mu.Unlock()
+
+	l.Lock()
+	return func() {
+		l.Unlock()
+
+		kl.mu.Lock()
+		l.users--
+		if l.users == 0 {
+			delete(kl.locks, key)
+		}
+		kl.mu.Unlock()
+	}
+}
@@ -0,0 +1,238 @@
+package storage
+
+import (
+	"errors"
+	"fmt"
+	"github.com/superioz/aqua/internal/config"
+	"github.com/superioz/aqua/internal/request"
+	"io"
+	"strings"
+	"sync"
+	"testing"
+)
+
+// newTestFileStorage returns a file storage with the
+// files in a temporary folder and given database.
+func newTestFileStorage(t *testing.T, db FileMetaDatabase) *FileStorage {
+	return &FileStorage{
+		fileMetaDb:     db,
+		fileSystem:     NewLocalFileStorage(t.TempDir() + "/"),
+		thumbnailSlots: make(chan struct{}, 1),
+	}
+}
+
+func storeTestFile(t *testing.T, fs *FileStorage, content string) *StoredFile {
+	t.Helper()
+
+	sf, err := fs.StoreFile(&request.RequestFormFile{
+		File:          strings.NewReader(content),
+		ContentType:   "text/plain",
+		ContentLength: int64(len(content)),
+	}, &StoreOptions{Expiration: config.ExpireNever})
+	if err != nil {
+		t.Fatalf("StoreFile() error = %v", err)
+	}
+	return sf
+}
+
+// physicalFiles returns the names of all files in the file system.
+func physicalFiles(t *testing.T, fs *FileStorage) []string {
+	infos, err := fs.fileSystem.ListFiles()
+	if err != nil {
+		t.Fatal(err)
+	}
+	var names []string
+	for _, info := range infos {
+		names = append(names, info.Name)
+	}
+	return names
+}
+
+func TestBlobRefs(t *testing.T) {
+	runWithDatabases(t, func(t *testing.T, db FileMetaDatabase) {
+		for i := int64(1); i <= 2; i++ {
+			b, err := db.AcquireBlob(&Blob{Digest: "digest", Size: 10, KeyId: "k1"})
+			if err != nil || b.Refs != i || b.Size != 10 || b.KeyId != "k1" {
+				t.Fatalf("AcquireBlob() = %+v, %v, want %d refs", b, err, i)
+			}
+		}
+
+		deleted := 0
+		deleteBlob := func() error {
+			deleted++
+			return nil
+		}
+		gone, err := db.ReleaseBlob("digest", deleteBlob)
+		if err != nil || gone || deleted != 0 {
+			t.Fatalf("ReleaseBlob() = %v, %v with %d deletions, want the blob to be kept", gone, err, deleted)
+		}
+		b, err := db.GetBlob("digest")
+		if err != nil || b == nil || b.Refs != 1 {
+			t.Errorf("GetBlob() = %+v, %v, want 1 ref", b, err)
+		}
+
+		// the blob is gone from the metadata, even if it could not be deleted
+		gone, err = db.ReleaseBlob("digest", func() error {
+			deleted++
+			return errors.New("could not delete")
+		})
+		if err == nil || !gone || deleted != 1 {
+			t.Fatalf("ReleaseBlob() = %v, %v with %d deletions, want the blob to be gone", gone, err, deleted)
+		}
+		b, err = db.GetBlob("digest")
+		if err != nil || b != nil {
+			t.Errorf("GetBlob() of released blob = %+v, %v, want nil", b, err)
+		}
+
+		gone, err = db.ReleaseBlob("digest", deleteBlob)
+		if err != nil || gone || deleted != 1 {
+			t.Errorf("ReleaseBlob() of unknown blob = %v, %v with %d deletions", gone, err, deleted)
+		}
+		b, err = db.AcquireBlob(&Blob{Digest: "digest", Size: 10})
+		if err != nil || b.Refs != 1 {
+			t.Errorf("AcquireBlob() after release = %+v, %v, want 1 ref", b, err)
+		}
+	})
+}
+
+func TestStoreFileDeduplication(t *testing.T) {
+	runWithDatabases(t, func(t *testing.T, db FileMetaDatabase) {
+		fs := newTestFileStorage(t, db)
+		first := storeTestFile(t, fs, "same content")
+		second := storeTestFile(t, fs, "same content")
+		other := storeTestFile(t, fs, "other content")
+
+		if first.Id == second.Id || first.Digest != second.Digest || first.Digest == other.Digest {
+			t.Fatalf("files with the same content must share the blob, got %s and %s", first.Digest, second.Digest)
+		}
+		if names := physicalFiles(t, fs); len(names) != 2 {
+			t.Errorf("physical files = %v, want 2 blobs", names)
+		}
+		b, err := db.GetBlob(first.Digest)
+		if err != nil || b == nil || b.Refs != 2 {
+			t.Fatalf("GetBlob() = %+v, %v, want 2 refs", b, err)
+		}
+
+		ok, err := fs.DeleteFile(first.Id)
+		if err != nil || !ok {
+			t.Fatalf("DeleteFile() = %v, %v", ok, err)
+		}
+		_, f, err := fs.OpenFile(second.Id)
+		if err != nil {
+			t.Fatalf("file is gone after deleting the other file with the same content: %v", err)
+		}
+		f.Close()
+
+		_, err = fs.DeleteFile(second.Id)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if names := physicalFiles(t, fs); len(names) != 1 || names[0] != other.BlobName {
+			t.Errorf("physical files = %v, want only the blob of the other file", names)
+		}
+		b, err = db.GetBlob(first.Digest)
+		if err != nil || b != nil {
+			t.Errorf("GetBlob() after deleting all files = %+v, %v, want nil", b, err)
+		}
+	})
+}
+
+func TestStoreFileEncryptedBlobName(t *testing.T) {
+	runWithDatabases(t, func(t *testing.T, db FileMetaDatabase) {
+		dir := t.TempDir() + "/"
+		fs := newTestFileStorage(t, db)
+		fs.fileSystem = newTestEncryptedFileSystem(t, dir, "k1", "k2")
+		first := storeTestFile(t, fs, "same content")
+
+		// the name must not reveal the digest of the content
+		names := physicalFiles(t, fs)
+		if len(names) != 1 || names[0] != first.BlobName || strings.Contains(names[0], first.Digest) {
+			t.Fatalf("physical files = %v, want a blob not named after %s", names, first.Digest)
+		}
+
+		// the blob keeps its name after the key has been rotated
+		fs.fileSystem = newTestEncryptedFileSystem(t, dir, "k2", "k1")
+		second := storeTestFile(t, fs, "same content")
+		if second.BlobName != first.BlobName || second.KeyId != "k1" {
+			t.Errorf("second file has blob %s with key %s, want %s with key k1", second.BlobName, second.KeyId, first.BlobName)
+		}
+		if names := physicalFiles(t, fs); len(names) != 1 {
+			t.Errorf("physical files = %v, want the blob only", names)
+		}
+	})
+}
+
+func TestStoreFileReplaceMissingBlob(t *testing.T) {
+	runWithDatabases(t, func(t *testing.T, db FileMetaDatabase) {
+		dir := t.TempDir() + "/"
+		fs := newTestFileStorage(t, db)
+		fs.fileSystem = newTestEncryptedFileSystem(t, dir, "k1", "k2")
+		first := storeTestFile(t, fs, "same content")
+		err := fs.fileSystem.DeleteFile(first.BlobName)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		// the key has been rotated before the content is uploaded again
+		fs.fileSystem = newTestEncryptedFileSystem(t, dir, "k2", "k1")
+		second := storeTestFile(t, fs, "same content")
+		if second.KeyId != "k2" {
+			t.Errorf("key of new file = %s, want k2", second.KeyId)
+		}
+		b, err := db.GetBlob(first.Digest)
+		if err != nil || b == nil || b.KeyId != "k2" {
+			t.Errorf("GetBlob() = %+v, %v, want key k2", b, err)
+		}
+
+		for _, id := range []string{first.Id, second.Id} {
+			sf, f, err := fs.OpenFile(id)
+			if err != nil {
+				t.Fatalf("OpenFile(%s) error = %v", id, err)
+			}
+			content, err := io.ReadAll(f)
+			f.Close()
+			if err != nil || string(content) != "same content" || sf.KeyId != "k2" {
+				t.Errorf("file %s = %q with key %s, %v, want the content with key k2", id, content, sf.KeyId, err)
+			}
+		}
+	})
+}
+
+func TestStoreFileDeduplicationParallel(t *testing.T) {
+	runWithDatabases(t, func(t *testing.T, db FileMetaDatabase) {
+		fs := newTestFileStorage(t, db)
+		kept := storeTestFile(t, fs, "kept")
+
+		// storing and deleting the same content at the same
+		// time must not delete the blob of a stored file.
+		var wg sync.WaitGroup
+		for i := 0; i < 10; i++ {
+			wg.Add(1)
+			go func(i int) {
+				defer wg.Done()
+				sf, err := fs.StoreFile(&request.RequestFormFile{
+					File:          strings.NewReader("kept"),
+					ContentType:   "text/plain",
+					ContentLength: 4,
+				}, &StoreOptions{Expiration: config.ExpireNever})
+				if err != nil {
+					t.Errorf("StoreFile() error = %v", err)
+					return
+				}
+				_, err = fs.DeleteFile(sf.Id)
+				if err != nil {
+					t.Errorf("DeleteFile() error = %v", err)
+				}
+			}(i)
+		}
+		wg.Wait()
+
+		b, err := db.GetBlob(kept.Digest)
+		if err != nil || b == nil || b.Refs != 1 {
+			t.Errorf("GetBlob() = %+v, %v, want 1 ref", b, err)
+		}
+		if names := physicalFiles(t, fs); fmt.Sprint(names) != fmt.Sprint([]string{kept.BlobName}) {
+			t.Errorf("physical files = %v, want only the blob", names)
+		}
+	})
+}
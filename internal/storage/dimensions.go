@@ -0,0 +1,137 @@
+package storage
+
+import (
+	"encoding/binary"
+	"errors"
+	"image"
+	"io"
+)
+
+// maxBoxDepth limits how deep the boxes of an mp4 are searched.
+const maxBoxDepth = 8
+
+// mp4Containers are the boxes, that contain the track header.
+var mp4Containers = map[string]bool{
+	"moov": true,
+	"trak": true,
+}
+
+// Dimensions returns the width and height of images and mp4 videos in
+// pixels, without reading more of the file than needed. Returns zeros
+// if the file has no dimensions or they can't be determined.
+func (fs *FileStorage) Dimensions(sf *StoredFile) (int, int, error) {
+	if !HasThumbnail(sf.MimeType) && sf.MimeType != "video/mp4" {
+		return 0, 0, nil
+	}
+
+	f, err := fs.getFile(sf.fileName(), sf.KeyId)
+	if err != nil {
+		return 0, 0, err
+	}
+	defer f.Close()
+
+	if sf.MimeType == "video/mp4" {
+		return mp4Dimensions(f)
+	}
+	cfg, _, err := image.DecodeConfig(f)
+	if err != nil {
+		// not our problem, the file is served anyway
+		return 0, 0, nil
+	}
+	return cfg.Width, cfg.Height, nil
+}
+
+// mp4Dimensions returns the dimensions of the first video track
+// from its track header (tkhd).
+func mp4Dimensions(f io.ReadSeeker) (int, int, error) {
+	size, err := f.Seek(0, io.SeekEnd)
+	if err != nil {
+		return 0, 0, err
+	}
+	w, h, err := findTrackDimensions(f, 0, size, 0)
+	if errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF) {
+		return 0, 0, nil
+	}
+	return w, h, err
+}
+
+// findTrackDimensions searches the boxes between start and end
+// for a track header with dimensions.
+func findTrackDimensions(f io.ReadSeeker, start int64, end int64, depth int) (int, int, error) {
+	if depth > maxBoxDepth {
+		return 0, 0, nil
+	}
+
+	header := make([]byte, 16)
+	for pos := start; pos+8 <= end; {
+		_, err := f.Seek(pos, io.SeekStart)
+		if err != nil {
+			return 0, 0, err
+		}
+		_, err = io.ReadFull(f, header[:8])
+		if err != nil {
+			return 0, 0, err
+		}
+
+		boxSize := int64(binary.BigEndian.Uint32(header))
+		boxType := string(header[4:8])
+		headerSize := int64(8)
+		switch boxSize {
+		case 0:
+			// until the end of the file
+			boxSize = end - pos
+		case 1:
+			_, err = io.ReadFull(f, header[8:16])
+			if err != nil {
+				return 0, 0, err
+			}
+			boxSize = int64(binary.BigEndian.Uint64(header[8:]))
+			headerSize = 16
+		}
+		if boxSize < headerSize || pos+boxSize > end {
+			return 0, 0, nil
+		}
+
+		if mp4Containers[boxType] {
+			w, h, err := findTrackDimensions(f, pos+headerSize, pos+boxSize, depth+1)
+			if err != nil || w > 0 {
+				return w, h, err
+			}
+		}
+		if boxType == "tkhd" {
+			w, h, err := readTrackHeader(f, boxSize-headerSize)
+			if err != nil || w > 0 {
+				return w, h, err
+			}
+		}
+		pos += boxSize
+	}
+	return 0, 0, nil
+}
+
+// readTrackHeader reads the dimensions from the track header, which
+// are zero for tracks that are not visual (e.g. audio).
+func readTrackHeader(r io.Reader, size int64) (int, int, error) {
+	if size > 1024 {
+		return 0, 0, nil
+	}
+	tkhd := make([]byte, size)
+	_, err := io.ReadFull(r, tkhd)
+	if err != nil {
+		return 0, 0, err
+	}
+
+	// the times and the duration are 64 bit since version 1
+	offset := 76
+	if len(tkhd) > 0 && tkhd[0] == 1 {
+		offset = 88
+	}
+	if len(tkhd) < offset+8 {
+		return 0, 0, nil
+	}
+
+	// fixed-point 16.16 numbers
+	w := int(binary.BigEndian.Uint32(tkhd[offset:]) >> 16)
+	h := int(binary.BigEndian.Uint32(tkhd[offset+4:]) >> 16)
+	return w, h, nil
+}
@@ -0,0 +1,431 @@
+package storage
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"golang.org/x/crypto/hkdf"
+	"io"
+	"strings"
+)
+
+const (
+	// encryptionMagic is at the start of every encrypted file.
+	encryptionMagic = "AQE1"
+
+	encryptionKeySize   = 32
+	encryptionSaltSize  = 32
+	encryptionChunkSize = 64 * 1024
+)
+
+var (
+	ErrUnknownEncryptionKey = errors.New("unknown encryption key")
+	errEncryptedFileCorrupt = errors.New("encrypted file is corrupt")
+
+	// errFileNotEncrypted is returned if an encrypted file was
+	// expected, but the file has no encryption header.
+	errFileNotEncrypted = fmt.Errorf("%w: not encrypted", errEncryptedFileCorrupt)
+)
+
+// EncryptedFileSystem encrypts all files before they are written to the
+// underlying file system and decrypts them again when they are read.
+//
+// Files are split into chunks, which are encrypted with AES-256-GCM one by one,
+// so that the files can be streamed and read partially. Every file is
+// encrypted with its own key that is derived from the configured key and a
+// random salt. The header of the file contains the id of the configured key,
+// so that files encrypted with an older key can still be read after a new
+// key has been added.
+//
+// Whether a file is encrypted (and with which key) is known from its
+// metadata, see GetFileWithKey. Files that have been stored before the
+// encryption has been enabled are returned as they are.
+type EncryptedFileSystem struct {
+	FileSystem
+
+	keys  map[string][]byte
+	keyId string
+
+	// nameKey is derived from the key new files are encrypted with
+	// and is used to hash names, see HashName.
+	nameKey []byte
+}
+
+// NewEncryptedFileSystem wraps given file system. New files are
+// encrypted with the key with given id, all other keys are only
+// used for reading files.
+func NewEncryptedFileSystem(fs FileSystem, keys map[string][]byte, keyId string) (*EncryptedFileSystem, error) {
+	if _, ok := keys[keyId]; !ok {
+		return nil, fmt.Errorf("%w %s", ErrUnknownEncryptionKey, keyId)
+	}
+	for id, key := range keys {
+		if len(key) != encryptionKeySize {
+			return nil, fmt.Errorf("encryption key %s must be %d bytes long", id, encryptionKeySize)
+		}
+	}
+
+	nameKey := make([]byte, encryptionKeySize)
+	_, err := io.ReadFull(hkdf.New(sha256.New, keys[keyId], nil, []byte("aqua file names")), nameKey)
+	if err != nil {
+		return nil, err
+	}
+	return &EncryptedFileSystem{FileSystem: fs, keys: keys, keyId: keyId, nameKey: nameKey}, nil
+}
+
+// ParseEncryptionKeys parses a comma-separated list of keys in the format
+// `id:base64key`. Returns the keys and the id of the first key.
+func ParseEncryptionKeys(raw string) (map[string][]byte, string, error) {
+	keys := make(map[string][]byte)
+	var firstId string
+	for _, entry := range strings.Split(raw, ",") {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+
+		parts := strings.SplitN(entry, ":", 2)
+		if len(parts) != 2 || parts[0] == "" || len(parts[0]) > 255 {
+			return nil, "", errors.New("encryption keys must be in the format id:base64key")
+		}
+		key, err := base64.StdEncoding.DecodeString(parts[1])
+		if err != nil {
+			return nil, "", fmt.Errorf("encryption key %s is not valid base64: %v", parts[0], err)
+		}
+		if _, ok := keys[parts[0]]; ok {
+			return nil, "", fmt.Errorf("duplicate encryption key %s", parts[0])
+		}
+
+		keys[parts[0]] = key
+		if firstId == "" {
+			firstId = parts[0]
+		}
+	}
+	if len(keys) == 0 {
+		return nil, "", errors.New("no encryption keys given")
+	}
+	return keys, firstId, nil
+}
+
+// KeyId returns the id of the key new files are encrypted with.
+func (e *EncryptedFileSystem) KeyId() string {
+	return e.keyId
+}
+
+// HashName returns the hex encoded HMAC-SHA256 of given name under the
+// key new files are encrypted with. It can be used as name of a file,
+// without revealing anything about its content.
+func (e *EncryptedFileSystem) HashName(name string) string {
+	mac := hmac.New(sha256.New, e.nameKey)
+	mac.Write([]byte(name))
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+func (e *EncryptedFileSystem) CreateFile(r io.Reader, name string) (bool, error) {
+	salt := make([]byte, encryptionSaltSize)
+	_, err := rand.Read(salt)
+	if err != nil {
+		return false, err
+	}
+
+	// magic | key id length | key id | salt | chunk size
+	var header bytes.Buffer
+	header.WriteString(encryptionMagic)
+	header.WriteByte(byte(len(e.keyId)))
+	header.WriteString(e.keyId)
+	header.Write(salt)
+	_ = binary.Write(&header, binary.BigEndian, uint32(encryptionChunkSize))
+
+	aead, err := newFileAEAD(e.keys[e.keyId], salt)
+	if err != nil {
+		return false, err
+	}
+
+	er := &encryptingReader{
+		r:     bufio.NewReaderSize(r, encryptionChunkSize),
+		aead:  aead,
+		ad:    header.Bytes(),
+		plain: make([]byte, encryptionChunkSize),
+		buf:   make([]byte, 0, encryptionChunkSize+aead.Overhead()),
+	}
+	return e.FileSystem.CreateFile(io.MultiReader(bytes.NewReader(header.Bytes()), er), name)
+}
+
+// GetFile returns the decrypted file, which has to be encrypted with any
+// of the keys. Files whose metadata is known should be read with
+// GetFileWithKey instead.
+func (e *EncryptedFileSystem) GetFile(name string) (io.ReadSeekCloser, error) {
+	return e.getFile(name, func(keyId string) bool { return true })
+}
+
+// GetFileWithKey returns the file with given name, which has been encrypted
+// with the key with given id. If the id is empty, the file has been stored
+// before the encryption has been enabled and is returned as it is.
+//
+// Files that have not been encrypted with the key are rejected, so that
+// they can't be passed off as plain files by removing the encryption.
+func (e *EncryptedFileSystem) GetFileWithKey(name string, keyId string) (io.ReadSeekCloser, error) {
+	if keyId == "" {
+		return e.FileSystem.GetFile(name)
+	}
+	return e.getFile(name, func(id string) bool { return id == keyId })
+}
+
+// getFile returns the decrypted file, if the id of its key is accepted.
+func (e *EncryptedFileSystem) getFile(name string, acceptKey func(keyId string) bool) (io.ReadSeekCloser, error) {
+	f, err := e.FileSystem.GetFile(name)
+	if err != nil {
+		return nil, err
+	}
+
+	dr, err := e.newDecryptingReader(f, acceptKey)
+	if err != nil {
+		f.Close()
+		return nil, fmt.Errorf("file %s: %w", name, err)
+	}
+	return dr, nil
+}
+
+// newDecryptingReader reads the header of the file and prepares
+// everything to decrypt it.
+func (e *EncryptedFileSystem) newDecryptingReader(f io.ReadSeekCloser, acceptKey func(keyId string) bool) (*decryptingReader, error) {
+	prefix := make([]byte, len(encryptionMagic)+1)
+	_, err := io.ReadFull(f, prefix)
+	if err == io.EOF || err == io.ErrUnexpectedEOF || (err == nil && string(prefix[:len(encryptionMagic)]) != encryptionMagic) {
+		return nil, errFileNotEncrypted
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	rest := make([]byte, int(prefix[len(encryptionMagic)])+encryptionSaltSize+4)
+	_, err = io.ReadFull(f, rest)
+	if err != nil {
+		return nil, errEncryptedFileCorrupt
+	}
+	keyIdLen := int(prefix[len(encryptionMagic)])
+	keyId := string(rest[:keyIdLen])
+	salt := rest[keyIdLen : keyIdLen+encryptionSaltSize]
+	chunkSize := int64(binary.BigEndian.Uint32(rest[keyIdLen+encryptionSaltSize:]))
+	if chunkSize != encryptionChunkSize {
+		// otherwise the header decides how much we allocate
+		return nil, errEncryptedFileCorrupt
+	}
+	if !acceptKey(keyId) {
+		return nil, fmt.Errorf("%w: encrypted with unexpected key %s", errEncryptedFileCorrupt, keyId)
+	}
+
+	key, ok := e.keys[keyId]
+	if !ok {
+		return nil, fmt.Errorf("%w %s", ErrUnknownEncryptionKey, keyId)
+	}
+	aead, err := newFileAEAD(key, salt)
+	if err != nil {
+		return nil, err
+	}
+
+	headerSize := int64(len(prefix) + len(rest))
+	totalSize, err := f.Seek(0, io.SeekEnd)
+	if err != nil {
+		return nil, err
+	}
+
+	// every chunk has the same size, apart from the last one,
+	// which even exists if the file is empty.
+	overhead := int64(aead.Overhead())
+	sealedChunkSize := chunkSize + overhead
+	bodySize := totalSize - headerSize
+	chunks := (bodySize + sealedChunkSize - 1) / sealedChunkSize
+	if chunks == 0 || bodySize-(chunks-1)*sealedChunkSize < overhead {
+		return nil, errEncryptedFileCorrupt
+	}
+
+	dr := &decryptingReader{
+		keyId:      keyId,
+		f:          f,
+		aead:       aead,
+		ad:         append(prefix, rest...),
+		headerSize: headerSize,
+		chunkSize:  chunkSize,
+		chunks:     chunks,
+		size:       bodySize - chunks*overhead,
+		chunkIndex: -1,
+		chunk:      make([]byte, 0, chunkSize),
+		buf:        make([]byte, sealedChunkSize),
+	}
+
+	// the content is streamed after the response has been started,
+	// so we at least make sure that the key is correct beforehand.
+	err = dr.readChunk(0)
+	if err != nil {
+		return nil, err
+	}
+	return dr, nil
+}
+
+// newFileAEAD derives the key of a single file from given
+// key and the salt of the file.
+func newFileAEAD(key []byte, salt []byte) (cipher.AEAD, error) {
+	fileKey := make([]byte, encryptionKeySize)
+	_, err := io.ReadFull(hkdf.New(sha256.New, key, salt, []byte("aqua file encryption")), fileKey)
+	if err != nil {
+		return nil, err
+	}
+
+	block, err := aes.NewCipher(fileKey)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+// chunkNonce returns the nonce of the chunk with given index. The last
+// chunk is marked, so that a truncated file can't be decrypted.
+func chunkNonce(index int64, last bool) []byte {
+	nonce := make([]byte, 12)
+	binary.BigEndian.PutUint64(nonce[3:11], uint64(index))
+	if last {
+		nonce[11] = 1
+	}
+	return nonce
+}
+
+// encryptingReader reads the plain file and returns the encrypted chunks.
+type encryptingReader struct {
+	r    *bufio.Reader
+	aead cipher.AEAD
+	ad   []byte
+
+	plain []byte
+	buf   []byte
+	out   []byte
+	index int64
+	done  bool
+}
+
+func (er *encryptingReader) Read(p []byte) (int, error) {
+	for len(er.out) == 0 {
+		if er.done {
+			return 0, io.EOF
+		}
+
+		n, err := io.ReadFull(er.r, er.plain)
+		if err != nil && err != io.EOF && err != io.ErrUnexpectedEOF {
+			return 0, err
+		}
+
+		// we have to know whether this is the last chunk
+		// before it can be encrypted.
+		last := n < len(er.plain)
+		if !last {
+			_, err = er.r.Peek(1)
+			if err == io.EOF {
+				last = true
+			} else if err != nil {
+				return 0, err
+			}
+		}
+
+		er.out = er.aead.Seal(er.buf[:0], chunkNonce(er.index, last), er.plain[:n], er.ad)
+		er.index++
+		er.done = last
+	}
+
+	n := copy(p, er.out)
+	er.out = er.out[n:]
+	return n, nil
+}
+
+// decryptingReader decrypts an encrypted file chunk by chunk,
+// while being able to seek to any position of the plain file.
+type decryptingReader struct {
+	keyId string
+
+	f    io.ReadSeekCloser
+	aead cipher.AEAD
+	ad   []byte
+
+	headerSize int64
+	chunkSize  int64
+	chunks     int64
+
+	// size of the plain file
+	size int64
+	pos  int64
+
+	// the last decrypted chunk
+	chunkIndex int64
+	chunk      []byte
+	buf        []byte
+}
+
+func (dr *decryptingReader) Read(p []byte) (int, error) {
+	if dr.pos >= dr.size {
+		return 0, io.EOF
+	}
+
+	index := dr.pos / dr.chunkSize
+	if index != dr.chunkIndex {
+		err := dr.readChunk(index)
+		if err != nil {
+			return 0, err
+		}
+	}
+
+	n := copy(p, dr.chunk[dr.pos-index*dr.chunkSize:])
+	dr.pos += int64(n)
+	return n, nil
+}
+
+// readChunk reads and decrypts the chunk with given index.
+func (dr *decryptingReader) readChunk(index int64) error {
+	sealedChunkSize := dr.chunkSize + int64(dr.aead.Overhead())
+	_, err := dr.f.Seek(dr.headerSize+index*sealedChunkSize, io.SeekStart)
+	if err != nil {
+		return err
+	}
+
+	n, err := io.ReadFull(dr.f, dr.buf)
+	if err != nil && err != io.ErrUnexpectedEOF {
+		return err
+	}
+
+	dr.chunkIndex = -1
+	dr.chunk, err = dr.aead.Open(dr.chunk[:0], chunkNonce(index, index == dr.chunks-1), dr.buf[:n], dr.ad)
+	if err != nil {
+		return fmt.Errorf("chunk %d: %w", index, errEncryptedFileCorrupt)
+	}
+	dr.chunkIndex = index
+	return nil
+}
+
+func (dr *decryptingReader) Seek(offset int64, whence int) (int64, error) {
+	var pos int64
+	switch whence {
+	case io.SeekStart:
+		pos = offset
+	case io.SeekCurrent:
+		pos = dr.pos + offset
+	case io.SeekEnd:
+		pos = dr.size + offset
+	default:
+		return 0, errors.New("invalid whence")
+	}
+	if pos < 0 {
+		return 0, errors.New("negative position")
+	}
+	dr.pos = pos
+	return pos, nil
+}
+
+func (dr *decryptingReader) Close() error {
+	return dr.f.Close()
+}
@@ -0,0 +1,242 @@
+package storage
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"os"
+	"strings"
+	"testing"
+)
+
+// newTestEncryptedFileSystem returns an encrypted file system in given
+// folder, which encrypts new files with the first of given key ids.
+func newTestEncryptedFileSystem(t *testing.T, dir string, keyIds ...string) *EncryptedFileSystem {
+	keys := map[string][]byte{}
+	for _, id := range keyIds {
+		keys[id] = bytes.Repeat([]byte(id[len(id)-1:]), encryptionKeySize)
+	}
+	e, err := NewEncryptedFileSystem(NewLocalFileStorage(dir), keys, keyIds[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	return e
+}
+
+// encryptionHeaderSize returns the size of the header of a file
+// encrypted with the key with given id.
+func encryptionHeaderSize(keyId string) int {
+	return len(encryptionMagic) + 1 + len(keyId) + encryptionSaltSize + 4
+}
+
+func TestEncryptedFileSystem(t *testing.T) {
+	dir := t.TempDir() + "/"
+	testFileSystem(t, newTestEncryptedFileSystem(t, dir, "k1"))
+
+	raw, err := os.ReadFile(dir + "empty")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.HasPrefix(raw, []byte(encryptionMagic)) {
+		t.Errorf("empty file has not been encrypted")
+	}
+}
+
+func TestEncryptedFileSystemRanges(t *testing.T) {
+	e := newTestEncryptedFileSystem(t, t.TempDir()+"/", "k1")
+	content := randomBytes(t, 3*encryptionChunkSize+17)
+	_, err := e.CreateFile(bytes.NewReader(content), "file")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	f, err := e.GetFile("file")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+
+	// reads within a chunk and across chunk boundaries
+	offsets := []int{0, 1, encryptionChunkSize - 1, encryptionChunkSize, 2*encryptionChunkSize + 5, len(content) - 20, len(content) - 1}
+	for _, offset := range offsets {
+		_, err = f.Seek(int64(offset), io.SeekStart)
+		if err != nil {
+			t.Fatalf("Seek(%d) error = %v", offset, err)
+		}
+		want := content[offset:]
+		if len(want) > 100 {
+			want = want[:100]
+		}
+		got := make([]byte, len(want))
+		_, err = io.ReadFull(f, got)
+		if err != nil || !bytes.Equal(got, want) {
+			t.Errorf("read at offset %d does not match (error = %v)", offset, err)
+		}
+	}
+
+	pos, err := f.Seek(-10, io.SeekCurrent)
+	if err != nil || pos != int64(len(content)-10) {
+		t.Errorf("Seek(-10, io.SeekCurrent) = %d, %v, want %d", pos, err, len(content)-10)
+	}
+	rest, err := io.ReadAll(f)
+	if err != nil || !bytes.Equal(rest, content[len(content)-10:]) {
+		t.Errorf("content at the end does not match (error = %v)", err)
+	}
+
+	_, err = f.Seek(int64(len(content)+10), io.SeekStart)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n, err := f.Read(make([]byte, 10)); n != 0 || err != io.EOF {
+		t.Errorf("Read() after the end = %d, %v, want io.EOF", n, err)
+	}
+	if _, err = f.Seek(-1, io.SeekStart); err == nil {
+		t.Errorf("Seek() to negative position succeeded")
+	}
+}
+
+func TestEncryptedFileSystemKeys(t *testing.T) {
+	dir := t.TempDir() + "/"
+	_, err := newTestEncryptedFileSystem(t, dir, "k1").CreateFile(strings.NewReader("secret"), "file")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// files of an older key can still be read after a new key has been added
+	e := newTestEncryptedFileSystem(t, dir, "k2", "k1")
+	for _, keyId := range []string{"k1", "k2"} {
+		_, err = e.CreateFile(strings.NewReader("secret"), "file-"+keyId)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	assertFileContent(t, e, "file", []byte("secret"))
+	f, err := e.GetFileWithKey("file", "k1")
+	if err != nil {
+		t.Fatalf("GetFileWithKey(k1) error = %v", err)
+	}
+	f.Close()
+
+	_, err = e.GetFileWithKey("file", "k2")
+	if !errors.Is(err, errEncryptedFileCorrupt) {
+		t.Errorf("GetFileWithKey() with other key error = %v, want errEncryptedFileCorrupt", err)
+	}
+	_, err = newTestEncryptedFileSystem(t, dir, "k2").GetFile("file")
+	if !errors.Is(err, ErrUnknownEncryptionKey) {
+		t.Errorf("GetFile() without the key error = %v, want ErrUnknownEncryptionKey", err)
+	}
+
+	// the key ids are only names, the key itself has to match as well
+	keys := map[string][]byte{"k1": bytes.Repeat([]byte("x"), encryptionKeySize)}
+	wrong, err := NewEncryptedFileSystem(NewLocalFileStorage(dir), keys, "k1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = wrong.GetFile("file")
+	if !errors.Is(err, errEncryptedFileCorrupt) {
+		t.Errorf("GetFile() with wrong key error = %v, want errEncryptedFileCorrupt", err)
+	}
+}
+
+func TestEncryptedFileSystemPlainFile(t *testing.T) {
+	dir := t.TempDir() + "/"
+	e := newTestEncryptedFileSystem(t, dir, "k1")
+
+	// e.g. stored before the encryption has been enabled
+	for name, content := range map[string]string{"plain": "plain content", "short": "AQ", "empty": ""} {
+		err := os.WriteFile(dir+name, []byte(content), 0644)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		_, err = e.GetFile(name)
+		if !errors.Is(err, errFileNotEncrypted) {
+			t.Errorf("GetFile(%s) error = %v, want errFileNotEncrypted", name, err)
+		}
+		_, err = e.GetFileWithKey(name, "k1")
+		if !errors.Is(err, errFileNotEncrypted) {
+			t.Errorf("GetFileWithKey(%s, k1) error = %v, want errFileNotEncrypted", name, err)
+		}
+
+		f, err := e.GetFileWithKey(name, "")
+		if err != nil {
+			t.Fatalf("GetFileWithKey(%s) without key error = %v", name, err)
+		}
+		got, _ := io.ReadAll(f)
+		f.Close()
+		if string(got) != content {
+			t.Errorf("GetFileWithKey(%s) without key = %q, want %q", name, got, content)
+		}
+	}
+}
+
+func TestEncryptedFileSystemCorrupt(t *testing.T) {
+	dir := t.TempDir() + "/"
+	e := newTestEncryptedFileSystem(t, dir, "k1")
+	_, err := e.CreateFile(bytes.NewReader(randomBytes(t, 2*encryptionChunkSize+100)), "file")
+	if err != nil {
+		t.Fatal(err)
+	}
+	raw, err := os.ReadFile(dir + "file")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	headerSize := encryptionHeaderSize("k1")
+	sealedChunkSize := encryptionChunkSize + 16
+	tests := []struct {
+		name   string
+		modify func(raw []byte) []byte
+	}{
+		{"salt", func(raw []byte) []byte { raw[headerSize-10] ^= 1; return raw }},
+		{"chunk size", func(raw []byte) []byte { raw[headerSize-2] ^= 1; return raw }},
+		{"first chunk", func(raw []byte) []byte { raw[headerSize+10] ^= 1; return raw }},
+		{"second chunk", func(raw []byte) []byte { raw[headerSize+sealedChunkSize+10] ^= 1; return raw }},
+		{"last chunk removed", func(raw []byte) []byte { return raw[:headerSize+2*sealedChunkSize] }},
+		{"last chunk truncated", func(raw []byte) []byte { return raw[:len(raw)-1] }},
+		{"chunks swapped", func(raw []byte) []byte {
+			swapped := append([]byte{}, raw[:headerSize]...)
+			swapped = append(swapped, raw[headerSize+sealedChunkSize:headerSize+2*sealedChunkSize]...)
+			swapped = append(swapped, raw[headerSize:headerSize+sealedChunkSize]...)
+			return append(swapped, raw[headerSize+2*sealedChunkSize:]...)
+		}},
+		{"header only", func(raw []byte) []byte { return raw[:headerSize] }},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := os.WriteFile(dir+"corrupt", tt.modify(append([]byte{}, raw...)), 0644)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			// the corruption is detected on opening or reading at the latest
+			f, err := e.GetFile("corrupt")
+			if err == nil {
+				_, err = io.ReadAll(f)
+				f.Close()
+			}
+			if !errors.Is(err, errEncryptedFileCorrupt) {
+				t.Errorf("error = %v, want errEncryptedFileCorrupt", err)
+			}
+		})
+	}
+}
+
+func TestParseEncryptionKeys(t *testing.T) {
+	key := strings.Repeat("A", 43) + "="
+	keys, keyId, err := ParseEncryptionKeys(" new:" + key + ", old:" + key + ",")
+	if err != nil || keyId != "new" || len(keys) != 2 || len(keys["old"]) != encryptionKeySize {
+		t.Errorf("ParseEncryptionKeys() = %d keys, %s, %v, want 2 keys and new", len(keys), keyId, err)
+	}
+
+	for _, raw := range []string{"", "k1", ":" + key, "k1:no base64", "k1:" + key + ",k1:" + key} {
+		_, _, err = ParseEncryptionKeys(raw)
+		if err == nil {
+			t.Errorf("ParseEncryptionKeys(%q) succeeded", raw)
+		}
+	}
+	_, err = NewEncryptedFileSystem(NewLocalFileStorage(t.TempDir()+"/"), map[string][]byte{"k1": []byte("short")}, "k1")
+	if err == nil {
+		t.Errorf("NewEncryptedFileSystem() with short key succeeded")
+	}
+}
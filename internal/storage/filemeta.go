@@ -2,7 +2,10 @@ package storage
 
 import (
 	"database/sql"
+	"errors"
+	"fmt"
 	"os"
+	"strings"
 	"time"
 )
 
@@ -14,14 +17,92 @@ import (
 // and delete it accordingly.
 type FileMetaDatabase interface {
 	Connect() error
+	Close() error
 	WriteFile(sf *StoredFile) error
 	GetFile(id string) (*StoredFile, error)
 	GetAllFiles() ([]*StoredFile, error)
 	GetAllExpired() ([]*StoredFile, error)
-	DeleteFile(id string) error
+	// DeleteFile deletes the file and returns
+	// false if it did not exist (anymore).
+	DeleteFile(id string) (bool, error)
+
+	// QueryFiles returns all files that match the filter and the total
+	// amount of matching files regardless of limit and offset.
+	QueryFiles(filter *FileFilter) ([]*StoredFile, int64, error)
+
+	// UpdateExpiration sets the expiration time of the file.
+	// Returns false if the file does not exist.
+	UpdateExpiration(id string, expiresAt int64) (bool, error)
+
+	// IncrementDownloads counts a download of the file, but only if it has no
+	// download limit or the limit has not been reached yet. Returns the updated
+	// file or ErrDownloadLimitReached.
+	IncrementDownloads(id string) (*StoredFile, error)
+
+	// GetTokenUsage returns the amount and the total size
+	// of all files uploaded with given token, that are not expired.
+	GetTokenUsage(tokenId string) (*TokenUsage, error)
+
+	// AcquireBlob adds a reference to the blob with the digest of given
+	// blob, creating it if needed. Returns the blob as it is stored now.
+	AcquireBlob(b *Blob) (*Blob, error)
+
+	// GetBlob returns the blob with given digest or
+	// nil, if it is not referenced by any file.
+	GetBlob(digest string) (*Blob, error)
+
+	// GetAllBlobs returns all blobs, that are referenced by files.
+	GetAllBlobs() ([]*Blob, error)
+
+	// UpdateBlobKey sets the key of the blob with given digest and
+	// of all files referencing it, after the blob has been written
+	// again with another key.
+	UpdateBlobKey(digest string, keyId string) error
+
+	// ReleaseBlob removes a reference from the blob with given digest.
+	// If it was the last reference, deleteBlob is called to delete the
+	// physical blob, while the blob is locked in the database, so that
+	// no other instance can acquire it until it is deleted. Returns true
+	// if it was the last reference and the blob is gone.
+	ReleaseBlob(digest string, deleteBlob func() error) (bool, error)
+}
+
+// TokenUsage is what a token currently uses of the storage.
+type TokenUsage struct {
+	Files int64
+	Bytes int64
+}
+
+// FileFilter restricts which files are returned by a query.
+// Every field with its zero value is ignored.
+type FileFilter struct {
+	MimeType       string
+	UploadedAfter  int64
+	UploadedBefore int64
+
+	// Expired filters by expiration state, if set.
+	Expired *bool
+
+	// KeyId filters by the key the files are encrypted with.
+	KeyId string
+
+	Limit  int
+	Offset int
 }
 
+var (
+	errNotConnected = errors.New("file meta db is not connected")
+)
+
+const (
+	// sqliteBusyTimeout is the time in milliseconds a connection waits
+	// for a lock on the database, before it returns SQLITE_BUSY.
+	sqliteBusyTimeout = 5000
+)
+
 type SqliteFileMetaDatabase struct {
+	sqlFileMetaDatabase
+
 	DbFolderPath string
 	DbFilePath   string
 }
@@ -39,141 +120,444 @@ func (s *SqliteFileMetaDatabase) Connect() error {
 		return err
 	}
 
-	db, err := sql.Open("sqlite", s.DbFilePath)
+	// the pragmas are applied to every new connection of the pool.
+	// WAL allows readers to continue while a file is being written.
+	dsn := fmt.Sprintf("%s?_pragma=busy_timeout(%d)&_pragma=journal_mode(wal)&_pragma=synchronous(normal)",
+		s.DbFilePath, sqliteBusyTimeout)
+	db, err := sql.Open("sqlite", dsn)
 	if err != nil {
 		return err
 	}
-	defer db.Close()
 
-	_, err = db.Exec(`create table if not exists files (
-		id text not null primary key, 
-		uploaded_at integer,
-		expires_at integer,
-		mime_type varchar,
-		size integer
-	);`)
+	err = migrate(db, questionMarkBindVar, "")
 	if err != nil {
+		db.Close()
 		return err
 	}
+
+	return s.open(db, questionMarkBindVar)
+}
+
+// sqlFileMetaDatabase implements the FileMetaDatabase queries on top
+// of database/sql. It holds one long-lived connection pool and prepares
+// every statement once, so that the backends only have to open
+// the database and create the schema.
+type sqlFileMetaDatabase struct {
+	db *sql.DB
+	bv bindVar
+
+	writeStmt              *sql.Stmt
+	deleteStmt             *sql.Stmt
+	getStmt                *sql.Stmt
+	getAllStmt             *sql.Stmt
+	getAllExpiredStmt      *sql.Stmt
+	updateExpirationStmt   *sql.Stmt
+	tokenUsageStmt         *sql.Stmt
+	incrementDownloadsStmt *sql.Stmt
+	acquireBlobStmt        *sql.Stmt
+	releaseBlobStmt        *sql.Stmt
+	deleteBlobStmt         *sql.Stmt
+	getBlobStmt            *sql.Stmt
+	getAllBlobsStmt        *sql.Stmt
+	updateBlobKeyStmt      *sql.Stmt
+	updateFilesKeyStmt     *sql.Stmt
+}
+
+// bindVar returns the placeholder for the n-th (starting with 1)
+// argument of a query, as it differs between the database drivers.
+type bindVar func(n int) string
+
+func questionMarkBindVar(int) string {
+	return "?"
+}
+
+func dollarBindVar(n int) string {
+	return fmt.Sprintf("$%d", n)
+}
+
+// placeholders returns n comma-separated placeholders.
+func placeholders(n int) string {
+	return strings.TrimSuffix(strings.Repeat("?, ", n), ", ")
+}
+
+// rebind replaces every `?` inside the query with
+// the placeholder of given bindVar.
+func rebind(query string, bv bindVar) string {
+	var sb strings.Builder
+	n := 0
+	for _, r := range query {
+		if r == '?' {
+			n++
+			sb.WriteString(bv(n))
+			continue
+		}
+		sb.WriteRune(r)
+	}
+	return sb.String()
+}
+
+const fileColumns = `id, uploaded_at, expires_at, mime_type, size, deletion_key, token_id, max_downloads, downloads, password_hash, key_id, digest, language, blob_name`
+
+// fileColumnsCount is the amount of columns in fileColumns.
+var fileColumnsCount = len(strings.Split(fileColumns, ","))
+
+const blobColumns = `digest, size, key_id, name, refs`
+
+// open takes ownership of given database and prepares all statements.
+// If that fails, the database is closed again.
+func (s *sqlFileMetaDatabase) open(db *sql.DB, bv bindVar) error {
+	s.db = db
+	s.bv = bv
+
+	stmts := []struct {
+		stmt  **sql.Stmt
+		query string
+	}{
+		{&s.writeStmt, `insert into files(` + fileColumns + `) values(` + placeholders(fileColumnsCount) + `)`},
+		{&s.deleteStmt, `delete from files where id = ?`},
+		{&s.getStmt, `select ` + fileColumns + ` from files where id = ?`},
+		{&s.getAllStmt, `select ` + fileColumns + ` from files`},
+		{&s.getAllExpiredStmt, `select ` + fileColumns + ` from files where (expires_at > 0 and expires_at <= ?) or (max_downloads > 0 and downloads >= max_downloads)`},
+		{&s.updateExpirationStmt, `update files set expires_at = ? where id = ?`},
+		{&s.tokenUsageStmt, `select count(*), coalesce(sum(size), 0) from files where token_id = ? and (expires_at <= 0 or expires_at > ?)`},
+		{&s.incrementDownloadsStmt, `update files set downloads = downloads + 1 where id = ? and (max_downloads <= 0 or downloads < max_downloads) returning ` + fileColumns},
+		{&s.acquireBlobStmt, `insert into blobs(digest, size, key_id, name, refs) values(?, ?, ?, ?, 1) on conflict(digest) do update set refs = blobs.refs + 1 returning ` + blobColumns},
+		{&s.releaseBlobStmt, `update blobs set refs = refs - 1 where digest = ? returning refs`},
+		{&s.deleteBlobStmt, `delete from blobs where digest = ? and refs <= 0`},
+		{&s.getBlobStmt, `select ` + blobColumns + ` from blobs where digest = ? and refs > 0`},
+		{&s.getAllBlobsStmt, `select ` + blobColumns + ` from blobs where refs > 0 order by digest`},
+		{&s.updateBlobKeyStmt, `update blobs set key_id = ? where digest = ?`},
+		{&s.updateFilesKeyStmt, `update files set key_id = ? where digest = ?`},
+	}
+	for _, st := range stmts {
+		stmt, err := db.Prepare(rebind(st.query, bv))
+		if err != nil {
+			s.Close()
+			return err
+		}
+		*st.stmt = stmt
+	}
 	return nil
 }
 
-func (s *SqliteFileMetaDatabase) WriteFile(sf *StoredFile) error {
-	db, err := sql.Open("sqlite", s.DbFilePath)
+// Close closes all prepared statements and the database itself.
+func (s *sqlFileMetaDatabase) Close() error {
+	if s.db == nil {
+		return nil
+	}
+
+	for _, stmt := range []*sql.Stmt{s.writeStmt, s.deleteStmt, s.getStmt, s.getAllStmt, s.getAllExpiredStmt, s.updateExpirationStmt, s.tokenUsageStmt, s.incrementDownloadsStmt,
+		s.acquireBlobStmt, s.releaseBlobStmt, s.deleteBlobStmt, s.getBlobStmt, s.getAllBlobsStmt, s.updateBlobKeyStmt, s.updateFilesKeyStmt} {
+		if stmt != nil {
+			stmt.Close()
+		}
+	}
+
+	err := s.db.Close()
+	s.db = nil
+	return err
+}
+
+func (s *sqlFileMetaDatabase) WriteFile(sf *StoredFile) error {
+	if s.db == nil {
+		return errNotConnected
+	}
+	_, err := s.writeStmt.Exec(sf.Id, sf.UploadedAt, sf.ExpiresAt, sf.MimeType, sf.Size, sf.DeletionKeyHash, sf.TokenId,
+		sf.MaxDownloads, sf.Downloads, sf.PasswordHash, sf.KeyId, sf.Digest, sf.Language, sf.BlobName)
+	return err
+}
+
+func (s *sqlFileMetaDatabase) DeleteFile(id string) (bool, error) {
+	if s.db == nil {
+		return false, errNotConnected
+	}
+	res, err := s.deleteStmt.Exec(id)
 	if err != nil {
-		return err
+		return false, err
 	}
-	defer db.Close()
+	n, err := res.RowsAffected()
+	if err != nil {
+		return false, err
+	}
+	return n > 0, nil
+}
 
-	stmt, err := db.Prepare(`insert into files(id, uploaded_at, expires_at, mime_type, size) values(?, ?, ?, ?, ?)`)
+func (s *sqlFileMetaDatabase) GetFile(id string) (*StoredFile, error) {
+	if s.db == nil {
+		return nil, errNotConnected
+	}
+	rows, err := s.getStmt.Query(id)
 	if err != nil {
-		return err
+		return nil, err
+	}
+	defer rows.Close()
+
+	if !rows.Next() {
+		return nil, rows.Err()
 	}
-	defer stmt.Close()
+	return getFromRows(rows)
+}
 
-	_, err = stmt.Exec(sf.Id, sf.UploadedAt, sf.ExpiresAt, sf.MimeType, sf.Size)
+func (s *sqlFileMetaDatabase) GetAllFiles() ([]*StoredFile, error) {
+	if s.db == nil {
+		return nil, errNotConnected
+	}
+	rows, err := s.getAllStmt.Query()
 	if err != nil {
-		return err
+		return nil, err
 	}
-	return nil
+	defer rows.Close()
+
+	return getAllFromRows(rows)
 }
 
-func (s *SqliteFileMetaDatabase) DeleteFile(id string) error {
-	db, err := sql.Open("sqlite", s.DbFilePath)
+func (s *sqlFileMetaDatabase) GetAllExpired() ([]*StoredFile, error) {
+	if s.db == nil {
+		return nil, errNotConnected
+	}
+	now := time.Now().Unix()
+	rows, err := s.getAllExpiredStmt.Query(now)
 	if err != nil {
-		return err
+		return nil, err
+	}
+	defer rows.Close()
+
+	return getAllFromRows(rows)
+}
+
+func (s *sqlFileMetaDatabase) QueryFiles(filter *FileFilter) ([]*StoredFile, int64, error) {
+	if s.db == nil {
+		return nil, 0, errNotConnected
+	}
+
+	var conds []string
+	var args []interface{}
+	if filter.MimeType != "" {
+		conds = append(conds, `mime_type = ?`)
+		args = append(args, filter.MimeType)
+	}
+	if filter.UploadedAfter > 0 {
+		conds = append(conds, `uploaded_at >= ?`)
+		args = append(args, filter.UploadedAfter)
+	}
+	if filter.UploadedBefore > 0 {
+		conds = append(conds, `uploaded_at < ?`)
+		args = append(args, filter.UploadedBefore)
+	}
+	if filter.KeyId != "" {
+		conds = append(conds, `key_id = ?`)
+		args = append(args, filter.KeyId)
+	}
+	if filter.Expired != nil {
+		// files that have reached their download limit are expired as well
+		now := time.Now().Unix()
+		if *filter.Expired {
+			conds = append(conds, `((expires_at > 0 and expires_at <= ?) or (max_downloads > 0 and downloads >= max_downloads))`)
+		} else {
+			conds = append(conds, `((expires_at <= 0 or expires_at > ?) and (max_downloads <= 0 or downloads < max_downloads))`)
+		}
+		args = append(args, now)
+	}
+
+	where := ""
+	if len(conds) > 0 {
+		where = ` where ` + strings.Join(conds, ` and `)
 	}
-	defer db.Close()
 
-	stmt, err := db.Prepare(`delete from files where id = ?`)
+	var total int64
+	err := s.db.QueryRow(rebind(`select count(*) from files`+where, s.bv), args...).Scan(&total)
 	if err != nil {
-		return err
+		return nil, 0, err
 	}
-	defer stmt.Close()
 
-	_, err = stmt.Exec(id)
-	return err
+	query := `select ` + fileColumns + ` from files` + where + ` order by uploaded_at desc, id`
+	if filter.Limit > 0 {
+		query += ` limit ? offset ?`
+		args = append(args, filter.Limit, filter.Offset)
+	}
+	rows, err := s.db.Query(rebind(query, s.bv), args...)
+	if err != nil {
+		return nil, 0, err
+	}
+	defer rows.Close()
+
+	sfs, err := getAllFromRows(rows)
+	if err != nil {
+		return nil, 0, err
+	}
+	return sfs, total, nil
 }
 
-func (s *SqliteFileMetaDatabase) GetFile(id string) (*StoredFile, error) {
-	db, err := sql.Open("sqlite", s.DbFilePath)
+func (s *sqlFileMetaDatabase) UpdateExpiration(id string, expiresAt int64) (bool, error) {
+	if s.db == nil {
+		return false, errNotConnected
+	}
+
+	res, err := s.updateExpirationStmt.Exec(expiresAt, id)
 	if err != nil {
-		return nil, err
+		return false, err
+	}
+	n, err := res.RowsAffected()
+	if err != nil {
+		return false, err
+	}
+	return n > 0, nil
+}
+
+func (s *sqlFileMetaDatabase) GetTokenUsage(tokenId string) (*TokenUsage, error) {
+	if s.db == nil {
+		return nil, errNotConnected
 	}
-	defer db.Close()
 
-	stmt, err := db.Prepare(`select * from files where id = ?`)
+	var usage TokenUsage
+	err := s.tokenUsageStmt.QueryRow(tokenId, time.Now().Unix()).Scan(&usage.Files, &usage.Bytes)
 	if err != nil {
 		return nil, err
 	}
-	defer stmt.Close()
+	return &usage, nil
+}
+
+func (s *sqlFileMetaDatabase) IncrementDownloads(id string) (*StoredFile, error) {
+	if s.db == nil {
+		return nil, errNotConnected
+	}
 
-	rows, err := stmt.Query(id)
+	// the condition and the increment happen in one statement,
+	// so that concurrent downloads can't exceed the limit.
+	rows, err := s.incrementDownloadsStmt.Query(id)
 	if err != nil {
 		return nil, err
 	}
 	defer rows.Close()
 
 	if !rows.Next() {
-		return nil, nil
+		err = rows.Err()
+		if err != nil {
+			return nil, err
+		}
+		return nil, ErrDownloadLimitReached
 	}
+	return getFromRows(rows)
+}
 
-	sf, err := getFromRows(rows)
+func (s *sqlFileMetaDatabase) AcquireBlob(b *Blob) (*Blob, error) {
+	if s.db == nil {
+		return nil, errNotConnected
+	}
+
+	var stored Blob
+	err := s.acquireBlobStmt.QueryRow(b.Digest, b.Size, b.KeyId, b.Name).Scan(&stored.Digest, &stored.Size, &stored.KeyId, &stored.Name, &stored.Refs)
 	if err != nil {
 		return nil, err
 	}
-	return sf, nil
+	return &stored, nil
 }
 
-func (s *SqliteFileMetaDatabase) GetAllFiles() ([]*StoredFile, error) {
-	db, err := sql.Open("sqlite", s.DbFilePath)
+func (s *sqlFileMetaDatabase) GetBlob(digest string) (*Blob, error) {
+	if s.db == nil {
+		return nil, errNotConnected
+	}
+
+	var b Blob
+	err := s.getBlobStmt.QueryRow(digest).Scan(&b.Digest, &b.Size, &b.KeyId, &b.Name, &b.Refs)
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, nil
+	}
 	if err != nil {
 		return nil, err
 	}
-	defer db.Close()
+	return &b, nil
+}
+
+func (s *sqlFileMetaDatabase) GetAllBlobs() ([]*Blob, error) {
+	if s.db == nil {
+		return nil, errNotConnected
+	}
 
-	rows, err := db.Query(`select * from files`)
+	rows, err := s.getAllBlobsStmt.Query()
 	if err != nil {
 		return nil, err
 	}
 	defer rows.Close()
 
-	var sfs []*StoredFile
+	var blobs []*Blob
 	for rows.Next() {
-		sf, err := getFromRows(rows)
+		var b Blob
+		err = rows.Scan(&b.Digest, &b.Size, &b.KeyId, &b.Name, &b.Refs)
 		if err != nil {
 			return nil, err
 		}
+		blobs = append(blobs, &b)
+	}
+	return blobs, rows.Err()
+}
 
-		sfs = append(sfs, sf)
+func (s *sqlFileMetaDatabase) UpdateBlobKey(digest string, keyId string) error {
+	if s.db == nil {
+		return errNotConnected
 	}
-	err = rows.Err()
+
+	// the blob and its files have to agree on the key,
+	// otherwise the files can't be decrypted anymore.
+	tx, err := s.db.Begin()
 	if err != nil {
-		return nil, err
+		return err
 	}
-	return sfs, nil
+	defer tx.Rollback()
+
+	_, err = tx.Stmt(s.updateBlobKeyStmt).Exec(keyId, digest)
+	if err != nil {
+		return err
+	}
+	_, err = tx.Stmt(s.updateFilesKeyStmt).Exec(keyId, digest)
+	if err != nil {
+		return err
+	}
+	return tx.Commit()
 }
 
-func (s *SqliteFileMetaDatabase) GetAllExpired() ([]*StoredFile, error) {
-	db, err := sql.Open("sqlite", s.DbFilePath)
+func (s *sqlFileMetaDatabase) ReleaseBlob(digest string, deleteBlob func() error) (bool, error) {
+	if s.db == nil {
+		return false, errNotConnected
+	}
+
+	tx, err := s.db.Begin()
 	if err != nil {
-		return nil, err
+		return false, err
 	}
-	defer db.Close()
+	defer tx.Rollback()
 
-	stmt, err := db.Prepare(`select * from files where expires_at > 0 and expires_at <= ?`)
+	// the update locks the row until the end of the transaction,
+	// so acquiring the blob has to wait until it is deleted.
+	var refs int64
+	err = tx.Stmt(s.releaseBlobStmt).QueryRow(digest).Scan(&refs)
+	if errors.Is(err, sql.ErrNoRows) {
+		// nobody knows about the blob, the reconciliation takes care of it
+		return false, nil
+	}
 	if err != nil {
-		return nil, err
+		return false, err
+	}
+	if refs > 0 {
+		return false, tx.Commit()
 	}
-	defer stmt.Close()
 
-	now := time.Now().Unix()
-	rows, err := stmt.Query(now)
+	deleteErr := deleteBlob()
+	_, err = tx.Stmt(s.deleteBlobStmt).Exec(digest)
 	if err != nil {
-		return nil, err
+		return false, err
 	}
-	defer rows.Close()
+	err = tx.Commit()
+	if err != nil {
+		return false, err
+	}
+	// the blob is gone from the metadata anyway, a physical
+	// blob that is left over is found by the reconciliation.
+	return true, deleteErr
+}
 
+// getAllFromRows reads all remaining rows into a list of files.
+func getAllFromRows(rows *sql.Rows) ([]*StoredFile, error) {
 	var sfs []*StoredFile
 	for rows.Next() {
 		sf, err := getFromRows(rows)
@@ -183,7 +567,7 @@ func (s *SqliteFileMetaDatabase) GetAllExpired() ([]*StoredFile, error) {
 
 		sfs = append(sfs, sf)
 	}
-	err = rows.Err()
+	err := rows.Err()
 	if err != nil {
 		return nil, err
 	}
@@ -196,8 +580,18 @@ func getFromRows(rows *sql.Rows) (*StoredFile, error) {
 	var expiresAt int
 	var mimeType string
 	var size int
+	var deletionKeyHash string
+	var tokenId string
+	var maxDownloads int64
+	var downloads int64
+	var passwordHash string
+	var keyId string
+	var digest string
+	var language string
+	var blobName string
 
-	err := rows.Scan(&id, &uploadedAt, &expiresAt, &mimeType, &size)
+	err := rows.Scan(&id, &uploadedAt, &expiresAt, &mimeType, &size, &deletionKeyHash, &tokenId,
+		&maxDownloads, &downloads, &passwordHash, &keyId, &digest, &language, &blobName)
 	if err != nil {
 		return nil, err
 	}
@@ -207,6 +601,16 @@ func getFromRows(rows *sql.Rows) (*StoredFile, error) {
 		ExpiresAt:  int64(expiresAt),
 		MimeType:   mimeType,
 		Size:       int64(size),
+
+		DeletionKeyHash: deletionKeyHash,
+		TokenId:         tokenId,
+		MaxDownloads:    maxDownloads,
+		Downloads:       downloads,
+		PasswordHash:    passwordHash,
+		KeyId:           keyId,
+		Digest:          digest,
+		Language:        language,
+		BlobName:        blobName,
 	}
 	return sf, nil
 }
@@ -0,0 +1,212 @@
+package storage
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"os"
+	"reflect"
+	"sort"
+	"testing"
+	"time"
+)
+
+// runWithDatabases runs the test against every FileMetaDatabase. Postgres
+// is only tested if AQUA_TEST_POSTGRES_DSN is set, as it needs a server.
+// Its tables are dropped before every test, so don't point it to a
+// database that is used for anything else.
+//
+// Without a server, the postgres placeholders are at least tested
+// against sqlite, which understands them as well.
+func runWithDatabases(t *testing.T, test func(t *testing.T, db FileMetaDatabase)) {
+	t.Run("sqlite", func(t *testing.T) {
+		test(t, newTestSqliteDatabase(t))
+	})
+	t.Run("sqlite with postgres placeholders", func(t *testing.T) {
+		test(t, newTestDollarDatabase(t))
+	})
+	t.Run("postgres", func(t *testing.T) {
+		dsn, ok := os.LookupEnv("AQUA_TEST_POSTGRES_DSN")
+		if !ok {
+			t.Skip("AQUA_TEST_POSTGRES_DSN is not set")
+		}
+		dropTables(t, "postgres", dsn)
+
+		db := NewPostgresFileMetaDatabase(dsn)
+		err := db.Connect()
+		if err != nil {
+			t.Fatalf("could not connect to postgres: %v", err)
+		}
+		t.Cleanup(func() { db.Close() })
+		test(t, db)
+	})
+}
+
+func newTestSqliteDatabase(t *testing.T) *SqliteFileMetaDatabase {
+	db := NewSqliteFileMetaDatabase(t.TempDir() + "/")
+	err := db.Connect()
+	if err != nil {
+		t.Fatalf("could not connect to sqlite: %v", err)
+	}
+	t.Cleanup(func() { db.Close() })
+	return db
+}
+
+// newTestDollarDatabase returns a sqlite database,
+// whose queries use the placeholders of postgres.
+func newTestDollarDatabase(t *testing.T) *SqliteFileMetaDatabase {
+	dsn := fmt.Sprintf("%s/files.db?_pragma=busy_timeout(%d)", t.TempDir(), sqliteBusyTimeout)
+	db, err := sql.Open("sqlite", dsn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = migrate(db, dollarBindVar, "")
+	if err != nil {
+		db.Close()
+		t.Fatalf("could not migrate sqlite: %v", err)
+	}
+
+	s := &SqliteFileMetaDatabase{}
+	err = s.open(db, dollarBindVar)
+	if err != nil {
+		t.Fatalf("could not prepare statements: %v", err)
+	}
+	t.Cleanup(func() { s.Close() })
+	return s
+}
+
+func dropTables(t *testing.T, driver string, dsn string) {
+	db, err := sql.Open(driver, dsn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	for _, table := range []string{"files", "blobs", "schema_version"} {
+		_, err = db.Exec(`drop table if exists ` + table)
+		if err != nil {
+			t.Fatalf("could not drop table %s: %v", table, err)
+		}
+	}
+}
+
+func TestFileMetaDatabase(t *testing.T) {
+	runWithDatabases(t, func(t *testing.T, db FileMetaDatabase) {
+		now := time.Now().Unix()
+		files := []*StoredFile{
+			{Id: "never", UploadedAt: now - 30, ExpiresAt: -1, MimeType: "image/png", Size: 10, TokenId: "alice"},
+			{Id: "expired", UploadedAt: now - 20, ExpiresAt: now - 1, MimeType: "text/plain", Size: 20, TokenId: "alice"},
+			{Id: "exhausted", UploadedAt: now - 10, ExpiresAt: -1, MimeType: "text/plain", Size: 30, MaxDownloads: 1, Downloads: 1},
+			{
+				Id: "full", UploadedAt: now, ExpiresAt: now + 3600, MimeType: "text/plain", Size: 40,
+				DeletionKeyHash: "hash", TokenId: "alice", MaxDownloads: 2, PasswordHash: "password",
+				KeyId: "k1", Digest: "digest", Language: "Go",
+			},
+		}
+		for _, sf := range files {
+			err := db.WriteFile(sf)
+			if err != nil {
+				t.Fatalf("WriteFile(%s) error = %v", sf.Id, err)
+			}
+		}
+		if err := db.WriteFile(files[0]); err == nil {
+			t.Errorf("WriteFile() with existing id succeeded")
+		}
+
+		got, err := db.GetFile("full")
+		if err != nil || !reflect.DeepEqual(got, files[3]) {
+			t.Errorf("GetFile() = %+v, %v, want %+v", got, err, files[3])
+		}
+		got, err = db.GetFile("missing")
+		if err != nil || got != nil {
+			t.Errorf("GetFile(missing) = %+v, %v, want nil", got, err)
+		}
+
+		all, err := db.GetAllFiles()
+		if err != nil || !reflect.DeepEqual(sortedIds(all), []string{"exhausted", "expired", "full", "never"}) {
+			t.Errorf("GetAllFiles() = %v, %v", sortedIds(all), err)
+		}
+		expired, err := db.GetAllExpired()
+		if err != nil || !reflect.DeepEqual(sortedIds(expired), []string{"exhausted", "expired"}) {
+			t.Errorf("GetAllExpired() = %v, %v, want [exhausted expired]", sortedIds(expired), err)
+		}
+
+		// newest first
+		page, total, err := db.QueryFiles(&FileFilter{MimeType: "text/plain", Limit: 2, Offset: 1})
+		if err != nil || total != 3 || !reflect.DeepEqual(ids(page), []string{"exhausted", "expired"}) {
+			t.Errorf("QueryFiles() = %v, %d, %v, want [exhausted expired], 3", ids(page), total, err)
+		}
+		notExpired := false
+		page, total, err = db.QueryFiles(&FileFilter{Expired: &notExpired, KeyId: "k1"})
+		if err != nil || total != 1 || !reflect.DeepEqual(ids(page), []string{"full"}) {
+			t.Errorf("QueryFiles(not expired) = %v, %d, %v, want [full], 1", ids(page), total, err)
+		}
+
+		// files that have reached their download limit are expired as well
+		isExpired := true
+		page, total, err = db.QueryFiles(&FileFilter{Expired: &isExpired})
+		if err != nil || total != 2 || !reflect.DeepEqual(ids(page), []string{"exhausted", "expired"}) {
+			t.Errorf("QueryFiles(expired) = %v, %d, %v, want [exhausted expired], 2", ids(page), total, err)
+		}
+		page, total, err = db.QueryFiles(&FileFilter{Expired: &notExpired})
+		if err != nil || total != 2 || !reflect.DeepEqual(ids(page), []string{"full", "never"}) {
+			t.Errorf("QueryFiles(not expired) = %v, %d, %v, want [full never], 2", ids(page), total, err)
+		}
+
+		usage, err := db.GetTokenUsage("alice")
+		if err != nil || *usage != (TokenUsage{Files: 2, Bytes: 50}) {
+			t.Errorf("GetTokenUsage() = %+v, %v, want 2 files with 50 bytes", usage, err)
+		}
+
+		ok, err := db.UpdateExpiration("expired", -1)
+		if err != nil || !ok {
+			t.Errorf("UpdateExpiration() = %v, %v, want true", ok, err)
+		}
+		ok, err = db.UpdateExpiration("missing", -1)
+		if err != nil || ok {
+			t.Errorf("UpdateExpiration(missing) = %v, %v, want false", ok, err)
+		}
+		got, _ = db.GetFile("expired")
+		if got.ExpiresAt != -1 {
+			t.Errorf("expiration has not been updated")
+		}
+
+		for i := 1; i <= 2; i++ {
+			got, err = db.IncrementDownloads("full")
+			if err != nil || got.Downloads != int64(i) {
+				t.Fatalf("IncrementDownloads() = %+v, %v, want %d downloads", got, err, i)
+			}
+		}
+		_, err = db.IncrementDownloads("full")
+		if !errors.Is(err, ErrDownloadLimitReached) {
+			t.Errorf("IncrementDownloads() error = %v, want ErrDownloadLimitReached", err)
+		}
+		got, err = db.IncrementDownloads("never")
+		if err != nil || got.Downloads != 1 {
+			t.Errorf("IncrementDownloads() without limit = %+v, %v", got, err)
+		}
+
+		ok, err = db.DeleteFile("full")
+		if err != nil || !ok {
+			t.Errorf("DeleteFile() = %v, %v, want true", ok, err)
+		}
+		ok, err = db.DeleteFile("full")
+		if err != nil || ok {
+			t.Errorf("DeleteFile() again = %v, %v, want false", ok, err)
+		}
+	})
+}
+
+func sortedIds(sfs []*StoredFile) []string {
+	result := ids(sfs)
+	sort.Strings(result)
+	return result
+}
+
+func ids(sfs []*StoredFile) []string {
+	result := []string{}
+	for _, sf := range sfs {
+		result = append(result, sf.Id)
+	}
+	return result
+}
@@ -3,6 +3,7 @@ package storage
 import (
 	"io"
 	"os"
+	"time"
 )
 
 type FileSystem interface {
@@ -10,10 +11,27 @@ type FileSystem interface {
 	// with given name.
 	// Always returns if the file was partly written to disk.
 	CreateFile(r io.Reader, name string) (bool, error)
-	
+
 	DeleteFile(id string) error
-	GetFile(id string) (*os.File, error)
+
+	// MoveFile renames the file, replacing the file
+	// with the new name if it already exists.
+	MoveFile(from string, to string) error
+
+	// GetFile opens the file with given id. The returned file
+	// is seekable, so that it can be streamed to the client partially.
+	// Returns an error that matches os.ErrNotExist if the file does not exist.
+	GetFile(id string) (io.ReadSeekCloser, error)
 	Exists(id string) (bool, error)
+
+	// ListFiles returns the names and modification times of all files.
+	ListFiles() ([]FileInfo, error)
+}
+
+// FileInfo describes a file of a FileSystem.
+type FileInfo struct {
+	Name    string
+	ModTime time.Time
 }
 
 type LocalFileSystem struct {
@@ -45,7 +63,11 @@ func (l LocalFileSystem) DeleteFile(id string) error {
 	return os.Remove(l.FolderPath + id)
 }
 
-func (l LocalFileSystem) GetFile(id string) (*os.File, error) {
+func (l LocalFileSystem) MoveFile(from string, to string) error {
+	return os.Rename(l.FolderPath+from, l.FolderPath+to)
+}
+
+func (l LocalFileSystem) GetFile(id string) (io.ReadSeekCloser, error) {
 	return os.Open(l.FolderPath + id)
 }
 
@@ -57,6 +79,33 @@ func (l LocalFileSystem) Exists(id string) (bool, error) {
 	return true, err
 }
 
+func (l LocalFileSystem) ListFiles() ([]FileInfo, error) {
+	entries, err := os.ReadDir(l.FolderPath)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	var files []FileInfo
+	for _, entry := range entries {
+		if !entry.Type().IsRegular() {
+			continue
+		}
+		info, err := entry.Info()
+		if os.IsNotExist(err) {
+			// deleted in the meantime
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		files = append(files, FileInfo{Name: entry.Name(), ModTime: info.ModTime()})
+	}
+	return files, nil
+}
+
 func NewLocalFileStorage(path string) *LocalFileSystem {
 	return &LocalFileSystem{FolderPath: path}
 }
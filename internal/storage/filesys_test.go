@@ -0,0 +1,138 @@
+package storage
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"math/rand"
+	"os"
+	"sort"
+	"strings"
+	"testing"
+)
+
+// testFileSystem checks the behaviour every FileSystem has to have.
+func testFileSystem(t *testing.T, fs FileSystem) {
+	content := randomBytes(t, 6*1024*1024+123)
+
+	written, err := fs.CreateFile(bytes.NewReader(content), "file")
+	if err != nil || !written {
+		t.Fatalf("CreateFile() = %v, %v", written, err)
+	}
+	assertFileContent(t, fs, "file", content)
+
+	ok, err := fs.Exists("file")
+	if err != nil || !ok {
+		t.Errorf("Exists(file) = %v, %v, want true", ok, err)
+	}
+	ok, err = fs.Exists("missing")
+	if err != nil || ok {
+		t.Errorf("Exists(missing) = %v, %v, want false", ok, err)
+	}
+	_, err = fs.GetFile("missing")
+	if !errors.Is(err, os.ErrNotExist) {
+		t.Errorf("GetFile(missing) error = %v, want os.ErrNotExist", err)
+	}
+
+	// seeking is needed for range requests
+	f, err := fs.GetFile("file")
+	if err != nil {
+		t.Fatalf("GetFile() error = %v", err)
+	}
+	defer f.Close()
+	_, err = f.Seek(5*1024*1024, io.SeekStart)
+	if err != nil {
+		t.Fatalf("Seek() error = %v", err)
+	}
+	part := make([]byte, 1000)
+	_, err = io.ReadFull(f, part)
+	if err != nil || !bytes.Equal(part, content[5*1024*1024:5*1024*1024+1000]) {
+		t.Errorf("content after Seek() does not match (error = %v)", err)
+	}
+	size, err := f.Seek(0, io.SeekEnd)
+	if err != nil || size != int64(len(content)) {
+		t.Errorf("Seek(0, io.SeekEnd) = %d, %v, want %d", size, err, len(content))
+	}
+
+	err = fs.MoveFile("file", "moved")
+	if err != nil {
+		t.Fatalf("MoveFile() error = %v", err)
+	}
+	assertFileContent(t, fs, "moved", content)
+	ok, _ = fs.Exists("file")
+	if ok {
+		t.Errorf("file still exists after MoveFile()")
+	}
+
+	_, err = fs.CreateFile(strings.NewReader(""), "empty")
+	if err != nil {
+		t.Fatalf("CreateFile(empty) error = %v", err)
+	}
+	assertFileContent(t, fs, "empty", []byte{})
+
+	infos, err := fs.ListFiles()
+	if err != nil {
+		t.Fatalf("ListFiles() error = %v", err)
+	}
+	var names []string
+	for _, info := range infos {
+		names = append(names, info.Name)
+		if info.ModTime.IsZero() {
+			t.Errorf("ListFiles() returned no modification time for %s", info.Name)
+		}
+	}
+	sort.Strings(names)
+	if strings.Join(names, ",") != "empty,moved" {
+		t.Errorf("ListFiles() = %v, want [empty moved]", names)
+	}
+
+	err = fs.DeleteFile("moved")
+	if err != nil {
+		t.Fatalf("DeleteFile() error = %v", err)
+	}
+	ok, _ = fs.Exists("moved")
+	if ok {
+		t.Errorf("file still exists after DeleteFile()")
+	}
+}
+
+func TestLocalFileSystem(t *testing.T) {
+	testFileSystem(t, NewLocalFileStorage(t.TempDir()+"/"))
+}
+
+func TestS3FileSystem(t *testing.T) {
+	fs, fake := newFakeS3FileSystem(t, "files/")
+	testFileSystem(t, fs)
+
+	// objects outside of the prefix don't belong to us
+	if got := strings.Join(fake.objects("aqua"), ","); got != "files/empty" {
+		t.Errorf("objects = %s, want files/empty", got)
+	}
+}
+
+func assertFileContent(t *testing.T, fs FileSystem, name string, want []byte) {
+	t.Helper()
+
+	f, err := fs.GetFile(name)
+	if err != nil {
+		t.Fatalf("GetFile(%s) error = %v", name, err)
+	}
+	defer f.Close()
+
+	got, err := io.ReadAll(f)
+	if err != nil {
+		t.Fatalf("could not read %s: %v", name, err)
+	}
+	if !bytes.Equal(got, want) {
+		t.Errorf("content of %s has %d bytes, want %d bytes", name, len(got), len(want))
+	}
+}
+
+func randomBytes(t *testing.T, n int) []byte {
+	data := make([]byte, n)
+	_, err := rand.New(rand.NewSource(int64(n))).Read(data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return data
+}
@@ -0,0 +1,207 @@
+package storage
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"k8s.io/klog"
+)
+
+var (
+	// ErrSchemaTooNew is returned if the database has been migrated
+	// by a newer version of aqua, which we can't safely work with.
+	ErrSchemaTooNew = errors.New("database schema is newer than supported")
+)
+
+// migration is a single versioned change of the database schema.
+// The statements have to work for every supported database,
+// so stick to standard SQL.
+type migration struct {
+	version     int
+	description string
+	statements  []string
+}
+
+// migrations is the ordered list of all schema changes. Never change
+// or remove an existing migration, always append a new one with
+// the next version instead.
+var migrations = []migration{
+	{
+		version:     1,
+		description: "create files table",
+		statements: []string{
+			// `if not exists`, because databases created before migrations
+			// were introduced already contain this table.
+			`create table if not exists files (
+				id text not null primary key,
+				uploaded_at bigint,
+				expires_at bigint,
+				mime_type varchar,
+				size bigint
+			)`,
+		},
+	},
+	{
+		version:     2,
+		description: "add deletion key to files",
+		statements: []string{
+			`alter table files add column deletion_key varchar not null default ''`,
+		},
+	},
+	{
+		version:     3,
+		description: "add uploading token to files",
+		statements: []string{
+			`alter table files add column token_id varchar not null default ''`,
+			`create index if not exists files_token_id on files(token_id)`,
+		},
+	},
+	{
+		version:     4,
+		description: "add download limit to files",
+		statements: []string{
+			`alter table files add column max_downloads bigint not null default 0`,
+			`alter table files add column downloads bigint not null default 0`,
+		},
+	},
+	{
+		version:     5,
+		description: "add password to files",
+		statements: []string{
+			`alter table files add column password_hash varchar not null default ''`,
+		},
+	},
+	{
+		version:     6,
+		description: "add encryption key to files",
+		statements: []string{
+			`alter table files add column key_id varchar not null default ''`,
+		},
+	},
+	{
+		version:     7,
+		description: "add content-addressed blobs",
+		statements: []string{
+			`create table if not exists blobs (
+				digest varchar primary key,
+				size bigint not null,
+				key_id varchar not null default '',
+				refs bigint not null
+			)`,
+			`alter table files add column digest varchar not null default ''`,
+			`create index if not exists files_digest on files(digest)`,
+		},
+	},
+	{
+		version:     8,
+		description: "add language of pastes to files",
+		statements: []string{
+			`alter table files add column language varchar not null default ''`,
+		},
+	},
+	{
+		version:     9,
+		description: "add names of blobs",
+		statements: []string{
+			`alter table blobs add column name varchar not null default ''`,
+			`update blobs set name = 'blob-' || digest`,
+			`alter table files add column blob_name varchar not null default ''`,
+			`update files set blob_name = 'blob-' || digest where digest <> ''`,
+		},
+	},
+}
+
+// latestSchemaVersion returns the version the database has
+// after applying all known migrations.
+func latestSchemaVersion() int {
+	if len(migrations) == 0 {
+		return 0
+	}
+	return migrations[len(migrations)-1].version
+}
+
+// migrate applies all migrations to given database that have not been
+// applied yet. Every migration runs in its own transaction, so that a failing
+// migration does not leave the schema in between two versions.
+//
+// lockStmt is executed at the start of every transaction, so that
+// multiple instances starting at the same time do not migrate concurrently.
+func migrate(db *sql.DB, bv bindVar, lockStmt string) error {
+	_, err := db.Exec(`create table if not exists schema_version (version integer not null)`)
+	if err != nil {
+		return fmt.Errorf("could not create schema version table: %v", err)
+	}
+
+	for _, m := range migrations {
+		applied, err := applyMigration(db, bv, lockStmt, m)
+		if err != nil {
+			return fmt.Errorf("could not apply migration %d (%s): %w", m.version, m.description, err)
+		}
+		if applied {
+			klog.Infof("Applied database migration %d (%s)", m.version, m.description)
+		}
+	}
+
+	// check the version again, to also catch databases
+	// that are newer than all of our migrations.
+	version, err := schemaVersion(db)
+	if err != nil {
+		return err
+	}
+	if version > latestSchemaVersion() {
+		return fmt.Errorf("%w: version is %d, but only %d is known", ErrSchemaTooNew, version, latestSchemaVersion())
+	}
+	return nil
+}
+
+// applyMigration applies given migration, if the current version
+// of the database is exactly the one before.
+func applyMigration(db *sql.DB, bv bindVar, lockStmt string, m migration) (bool, error) {
+	tx, err := db.Begin()
+	if err != nil {
+		return false, err
+	}
+	defer tx.Rollback()
+
+	if lockStmt != "" {
+		_, err = tx.Exec(lockStmt)
+		if err != nil {
+			return false, err
+		}
+	}
+
+	var version int
+	err = tx.QueryRow(`select coalesce(max(version), 0) from schema_version`).Scan(&version)
+	if err != nil {
+		return false, err
+	}
+	if version >= m.version {
+		return false, nil
+	}
+
+	for _, stmt := range m.statements {
+		_, err = tx.Exec(stmt)
+		if err != nil {
+			return false, err
+		}
+	}
+
+	_, err = tx.Exec(`delete from schema_version`)
+	if err != nil {
+		return false, err
+	}
+	_, err = tx.Exec(rebind(`insert into schema_version(version) values(?)`, bv), m.version)
+	if err != nil {
+		return false, err
+	}
+	return true, tx.Commit()
+}
+
+func schemaVersion(db *sql.DB) (int, error) {
+	var version int
+	err := db.QueryRow(`select coalesce(max(version), 0) from schema_version`).Scan(&version)
+	if err != nil {
+		return 0, err
+	}
+	return version, nil
+}
@@ -0,0 +1,164 @@
+package storage
+
+import (
+	"database/sql"
+	"errors"
+	"testing"
+)
+
+func openTestSqlite(t *testing.T) *sql.DB {
+	db, err := sql.Open("sqlite", t.TempDir()+"/files.db")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { db.Close() })
+	return db
+}
+
+func TestMigrateNewDatabase(t *testing.T) {
+	db := openTestSqlite(t)
+
+	// migrating twice must not change anything
+	for i := 0; i < 2; i++ {
+		err := migrate(db, questionMarkBindVar, "")
+		if err != nil {
+			t.Fatalf("migrate() error = %v", err)
+		}
+		version, err := schemaVersion(db)
+		if err != nil || version != latestSchemaVersion() {
+			t.Fatalf("schemaVersion() = %d, %v, want %d", version, err, latestSchemaVersion())
+		}
+	}
+
+	_, err := db.Exec(`select ` + fileColumns + ` from files`)
+	if err != nil {
+		t.Errorf("files table is missing columns: %v", err)
+	}
+}
+
+func TestMigrateDatabaseWithoutVersion(t *testing.T) {
+	db := openTestSqlite(t)
+
+	// the table as it has been created before the migrations
+	_, err := db.Exec(`create table files (id text not null primary key, uploaded_at bigint, expires_at bigint, mime_type varchar, size bigint)`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = db.Exec(`insert into files values('old', 1, -1, 'image/png', 42)`)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = migrate(db, questionMarkBindVar, "")
+	if err != nil {
+		t.Fatalf("migrate() error = %v", err)
+	}
+
+	s := &sqlFileMetaDatabase{}
+	err = s.open(db, questionMarkBindVar)
+	if err != nil {
+		t.Fatal(err)
+	}
+	sf, err := s.GetFile("old")
+	if err != nil || sf == nil {
+		t.Fatalf("GetFile() = %v, %v", sf, err)
+	}
+	if sf.Size != 42 || sf.MimeType != "image/png" || sf.TokenId != "" || sf.Digest != "" || sf.MaxDownloads != 0 {
+		t.Errorf("file has not been migrated correctly: %+v", sf)
+	}
+}
+
+func TestMigrateNewerDatabase(t *testing.T) {
+	db := openTestSqlite(t)
+	err := migrate(db, questionMarkBindVar, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = db.Exec(`update schema_version set version = ?`, latestSchemaVersion()+1)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = migrate(db, questionMarkBindVar, "")
+	if !errors.Is(err, ErrSchemaTooNew) {
+		t.Errorf("migrate() error = %v, want ErrSchemaTooNew", err)
+	}
+}
+
+func TestMigrateFailingMigration(t *testing.T) {
+	db := openTestSqlite(t)
+	err := migrate(db, questionMarkBindVar, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	latest := latestSchemaVersion()
+	original := migrations
+	migrations = append(migrations[:len(migrations):len(migrations)], migration{
+		version:     latest + 1,
+		description: "broken",
+		statements: []string{
+			`create table broken (id text)`,
+			`this is no sql`,
+		},
+	})
+	defer func() { migrations = original }()
+
+	err = migrate(db, questionMarkBindVar, "")
+	if err == nil {
+		t.Fatal("migrate() succeeded with broken migration")
+	}
+
+	// nothing of the migration has been applied
+	version, err := schemaVersion(db)
+	if err != nil || version != latest {
+		t.Errorf("schemaVersion() = %d, %v, want %d", version, err, latest)
+	}
+	_, err = db.Exec(`select * from broken`)
+	if err == nil {
+		t.Errorf("table of the failed migration exists")
+	}
+}
+
+func TestMigrateBlobNames(t *testing.T) {
+	db := openTestSqlite(t)
+
+	// blobs stored before their names were introduced
+	original := migrations
+	migrations = migrations[:8]
+	err := migrate(db, questionMarkBindVar, "")
+	migrations = original
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = db.Exec(`insert into blobs values('abc', 3, 'k1', 1)`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = db.Exec(`insert into files(id, uploaded_at, expires_at, mime_type, size, key_id, digest) values('deduplicated', 1, -1, 'text/plain', 3, 'k1', 'abc'), ('old', 1, -1, 'text/plain', 3, '', '')`)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = migrate(db, questionMarkBindVar, "")
+	if err != nil {
+		t.Fatalf("migrate() error = %v", err)
+	}
+	s := &sqlFileMetaDatabase{}
+	err = s.open(db, questionMarkBindVar)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// the blobs keep the name after their digest
+	b, err := s.GetBlob("abc")
+	if err != nil || b == nil || b.Name != "blob-abc" {
+		t.Errorf("GetBlob() = %+v, %v, want name blob-abc", b, err)
+	}
+	for id, want := range map[string]string{"deduplicated": "blob-abc", "old": "old"} {
+		sf, err := s.GetFile(id)
+		if err != nil || sf == nil || sf.fileName() != want {
+			t.Errorf("GetFile(%s) = %+v, %v, want physical file %s", id, sf, err, want)
+		}
+	}
+}
@@ -0,0 +1,290 @@
+package storage
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/superioz/aqua/internal/request"
+	"io"
+	"io/ioutil"
+	"k8s.io/klog"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+var (
+	ErrUploadNotFound = errors.New("upload not found")
+	ErrUploadLocked   = errors.New("upload is currently in use")
+	ErrOffsetMismatch = errors.New("offset does not match")
+)
+
+const (
+	partialInfoSuffix = ".info"
+	partialDataSuffix = ".bin"
+)
+
+// PartialUpload is an upload that has been created via the
+// resumable upload protocol, but whose content is possibly not
+// fully received yet.
+type PartialUpload struct {
+	Id          string `json:"id"`
+	Length      int64  `json:"length"`
+	Offset      int64  `json:"offset"`
+	ContentType string `json:"contentType"`
+
+	// Metadata is applied to the final stored file.
+	Metadata *request.RequestMetadata `json:"metadata"`
+
+	// ExpiresAt is the unix time when the upload gets discarded,
+	// if it has not been completed until then.
+	ExpiresAt int64 `json:"expiresAt"`
+
+	// Owner identifies the token that created this upload, so that
+	// nobody else can continue or inspect it.
+	Owner string `json:"owner"`
+
+	// FileName is set as soon as the upload is completed and
+	// stored as a normal file.
+	FileName string `json:"fileName,omitempty"`
+}
+
+// IsReceived returns if the whole content has been received.
+func (pu *PartialUpload) IsReceived() bool {
+	return pu.Offset == pu.Length
+}
+
+// IsComplete returns if the upload has been stored as file.
+func (pu *PartialUpload) IsComplete() bool {
+	return pu.FileName != ""
+}
+
+// PartialUploadStore keeps the state and the content of partial uploads
+// inside a local folder. Every upload consists of an info file with the
+// state and a data file the chunks are appended to.
+//
+// The folder and the locks belong to a single process, so every
+// request of an upload has to reach the same instance.
+type PartialUploadStore struct {
+	FolderPath string
+
+	mu sync.Mutex
+	// locked contains the ids of all uploads that are currently
+	// being written to, so that chunks can't be appended concurrently.
+	locked map[string]bool
+}
+
+func NewPartialUploadStore(path string) *PartialUploadStore {
+	return &PartialUploadStore{
+		FolderPath: path,
+		locked:     map[string]bool{},
+	}
+}
+
+// Create registers a new partial upload with an empty data file.
+func (s *PartialUploadStore) Create(pu *PartialUpload) error {
+	err := os.MkdirAll(s.FolderPath, os.ModePerm)
+	if err != nil {
+		return err
+	}
+
+	id, err := getRandomFileName(24)
+	if err != nil {
+		return err
+	}
+	pu.Id = id
+
+	f, err := os.Create(s.dataPath(id))
+	if err != nil {
+		return err
+	}
+	f.Close()
+
+	return s.writeInfo(pu)
+}
+
+// Get returns the partial upload with given id or ErrUploadNotFound.
+func (s *PartialUploadStore) Get(id string) (*PartialUpload, error) {
+	if !isValidUploadId(id) {
+		return nil, ErrUploadNotFound
+	}
+
+	data, err := ioutil.ReadFile(s.infoPath(id))
+	if os.IsNotExist(err) {
+		return nil, ErrUploadNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	var pu PartialUpload
+	err = json.Unmarshal(data, &pu)
+	if err != nil {
+		return nil, err
+	}
+	return &pu, nil
+}
+
+// Lock makes sure that only one request at a time
+// can modify the upload with given id.
+func (s *PartialUploadStore) Lock(id string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.locked[id] {
+		return ErrUploadLocked
+	}
+	s.locked[id] = true
+	return nil
+}
+
+func (s *PartialUploadStore) Unlock(id string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	delete(s.locked, id)
+}
+
+// Append writes the content of given reader to the end of the upload,
+// as long as the upload is not complete. The upload has to be locked
+// beforehand.
+//
+// The offset is always updated with the amount of bytes written, even if
+// the reader fails in between, so that the client can resume from there.
+func (s *PartialUploadStore) Append(pu *PartialUpload, offset int64, r io.Reader) error {
+	if pu.Offset != offset {
+		return ErrOffsetMismatch
+	}
+
+	f, err := os.OpenFile(s.dataPath(pu.Id), os.O_WRONLY, 0)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	// the data file could contain garbage after the offset
+	// if a previous write failed before the info was updated.
+	err = f.Truncate(pu.Offset)
+	if err != nil {
+		return err
+	}
+	_, err = f.Seek(pu.Offset, io.SeekStart)
+	if err != nil {
+		return err
+	}
+
+	n, copyErr := io.Copy(f, io.LimitReader(r, pu.Length-pu.Offset))
+	if n > 0 {
+		err = f.Sync()
+		if err != nil {
+			return err
+		}
+
+		pu.Offset += n
+		err = s.writeInfo(pu)
+		if err != nil {
+			return err
+		}
+	}
+	return copyErr
+}
+
+// Open opens the content of the upload for reading.
+func (s *PartialUploadStore) Open(pu *PartialUpload) (*os.File, error) {
+	return os.Open(s.dataPath(pu.Id))
+}
+
+// Complete marks the upload as stored with given file name and
+// removes its content, because it is not needed anymore. The info
+// stays until the upload expires, so that the client can still
+// retrieve the file name if the response got lost.
+func (s *PartialUploadStore) Complete(pu *PartialUpload, fileName string) error {
+	pu.FileName = fileName
+	err := s.writeInfo(pu)
+	if err != nil {
+		return err
+	}
+	return removeIfExists(s.dataPath(pu.Id))
+}
+
+// Delete removes the upload completely.
+func (s *PartialUploadStore) Delete(id string) error {
+	err := removeIfExists(s.dataPath(id))
+	if err != nil {
+		return err
+	}
+	return removeIfExists(s.infoPath(id))
+}
+
+// Cleanup deletes every upload that has expired.
+func (s *PartialUploadStore) Cleanup() error {
+	entries, err := ioutil.ReadDir(s.FolderPath)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	now := time.Now().Unix()
+	for _, entry := range entries {
+		if !strings.HasSuffix(entry.Name(), partialInfoSuffix) {
+			continue
+		}
+		id := strings.TrimSuffix(entry.Name(), partialInfoSuffix)
+
+		pu, err := s.Get(id)
+		if err != nil {
+			return fmt.Errorf("could not read upload with id=%s: %v", id, err)
+		}
+		if pu.ExpiresAt > now {
+			continue
+		}
+
+		err = s.Delete(id)
+		if err != nil {
+			return fmt.Errorf("could not delete upload with id=%s: %v", id, err)
+		}
+		klog.Infof("Delete partial upload %s (expired at %s)", id, time.Unix(pu.ExpiresAt, 0).String())
+	}
+	return nil
+}
+
+func (s *PartialUploadStore) writeInfo(pu *PartialUpload) error {
+	data, err := json.Marshal(pu)
+	if err != nil {
+		return err
+	}
+
+	// write to a temporary file first, so that a crash
+	// can't leave us with a half written info file.
+	tmpPath := s.infoPath(pu.Id) + ".tmp"
+	err = ioutil.WriteFile(tmpPath, data, 0644)
+	if err != nil {
+		return err
+	}
+	return os.Rename(tmpPath, s.infoPath(pu.Id))
+}
+
+func (s *PartialUploadStore) infoPath(id string) string {
+	return s.FolderPath + id + partialInfoSuffix
+}
+
+func (s *PartialUploadStore) dataPath(id string) string {
+	return s.FolderPath + id + partialDataSuffix
+}
+
+// isValidUploadId checks that the id can't be used
+// to access files outside of the upload folder.
+func isValidUploadId(id string) bool {
+	return id != "" && !strings.ContainsAny(id, "/\\.")
+}
+
+func removeIfExists(path string) error {
+	err := os.Remove(path)
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return nil
+}
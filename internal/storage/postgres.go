@@ -0,0 +1,47 @@
+package storage
+
+import (
+	"database/sql"
+
+	_ "github.com/lib/pq"
+)
+
+// postgresMigrationLock makes sure that only one instance at a time
+// migrates the database. The lock is released when the transaction ends.
+const postgresMigrationLock = `select pg_advisory_xact_lock(7364827)`
+
+// PostgresFileMetaDatabase stores the file metadata inside a
+// PostgreSQL database. Unlike the SqliteFileMetaDatabase it can
+// be shared by multiple instances of aqua.
+type PostgresFileMetaDatabase struct {
+	sqlFileMetaDatabase
+
+	Dsn string
+}
+
+func NewPostgresFileMetaDatabase(dsn string) *PostgresFileMetaDatabase {
+	return &PostgresFileMetaDatabase{
+		Dsn: dsn,
+	}
+}
+
+func (p *PostgresFileMetaDatabase) Connect() error {
+	db, err := sql.Open("postgres", p.Dsn)
+	if err != nil {
+		return err
+	}
+
+	err = db.Ping()
+	if err != nil {
+		db.Close()
+		return err
+	}
+
+	err = migrate(db, dollarBindVar, postgresMigrationLock)
+	if err != nil {
+		db.Close()
+		return err
+	}
+
+	return p.open(db, dollarBindVar)
+}
@@ -0,0 +1,355 @@
+package storage
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"github.com/superioz/aqua/internal/config"
+	"github.com/superioz/aqua/internal/mime"
+	"github.com/superioz/aqua/pkg/env"
+	"io"
+	"k8s.io/klog"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+var (
+	ErrReconcileRunning       = errors.New("reconciliation is already running")
+	ErrUnknownReconcilePolicy = errors.New("unknown reconcile policy")
+)
+
+// ReconcileReport is the result of a single reconciliation.
+type ReconcileReport struct {
+	Policy string `json:"policy"`
+
+	// Orphans are the names of physical files without metadata.
+	Orphans []string `json:"orphans"`
+
+	// Missing are the ids of files whose physical file is gone.
+	Missing []string `json:"missing"`
+
+	// Adopted are the ids of the files created for orphans.
+	Adopted []string `json:"adopted"`
+
+	// DeletedOrphans are the names of the orphans that have been deleted,
+	// DeletedMissing the ids of the files whose metadata has been deleted.
+	DeletedOrphans []string `json:"deletedOrphans"`
+	DeletedMissing []string `json:"deletedMissing"`
+}
+
+// Reconcile compares the physical files with the metadata and reports
+// physical files without metadata (orphans) and metadata without physical
+// files (missing). What happens to them depends on the policy:
+//
+//   - adopt creates metadata for the orphans, which expire after
+//     RECONCILE_EXPIRATION seconds. Incomplete uploads and thumbnails,
+//     whose file is gone or whose size is not allowed anymore, are deleted.
+//   - delete deletes the orphans.
+//   - leave only reports them.
+//
+// Incomplete uploads and thumbnails are only orphans, if they are older
+// than RECONCILE_TEMP_GRACE seconds, as they could still be written by
+// another instance.
+//
+// With adopt and delete, the metadata of missing files is deleted.
+// Files of quarantined blobs are not touched, see Scrub.
+//
+// Only one reconciliation can run at a time, otherwise
+// ErrReconcileRunning is returned.
+func (fs *FileStorage) Reconcile(policy string) (*ReconcileReport, error) {
+	err := checkReconcilePolicy(policy)
+	if err != nil {
+		return nil, err
+	}
+
+	if !atomic.CompareAndSwapInt32(&fs.reconciling, 0, 1) {
+		return nil, ErrReconcileRunning
+	}
+	defer atomic.StoreInt32(&fs.reconciling, 0)
+	return fs.reconcile(policy)
+}
+
+// StartReconcile runs Reconcile in the background and calls done with its
+// result. Returns ErrReconcileRunning, if a reconciliation is already running.
+func (fs *FileStorage) StartReconcile(policy string, done func(report *ReconcileReport, err error)) error {
+	err := checkReconcilePolicy(policy)
+	if err != nil {
+		return err
+	}
+
+	if !atomic.CompareAndSwapInt32(&fs.reconciling, 0, 1) {
+		return ErrReconcileRunning
+	}
+	go func() {
+		defer atomic.StoreInt32(&fs.reconciling, 0)
+		done(fs.reconcile(policy))
+	}()
+	return nil
+}
+
+// checkReconcilePolicy returns ErrUnknownReconcilePolicy,
+// if given policy is not known.
+func checkReconcilePolicy(policy string) error {
+	switch policy {
+	case config.ReconcilePolicyAdopt, config.ReconcilePolicyDelete, config.ReconcilePolicyLeave:
+		return nil
+	default:
+		return fmt.Errorf("%w %s", ErrUnknownReconcilePolicy, policy)
+	}
+}
+
+func (fs *FileStorage) reconcile(policy string) (*ReconcileReport, error) {
+	klog.Infof("Reconcile stored files (policy: %s)", policy)
+
+	// list the physical files first, so that everything stored
+	// afterwards already has metadata when we look at it.
+	infos, err := fs.fileSystem.ListFiles()
+	if err != nil {
+		return nil, fmt.Errorf("could not list files: %v", err)
+	}
+	files, err := fs.fileMetaDb.GetAllFiles()
+	if err != nil {
+		return nil, err
+	}
+	blobs, err := fs.fileMetaDb.GetAllBlobs()
+	if err != nil {
+		return nil, err
+	}
+
+	report := &ReconcileReport{
+		Policy:         policy,
+		Orphans:        []string{},
+		Missing:        []string{},
+		Adopted:        []string{},
+		DeletedOrphans: []string{},
+		DeletedMissing: []string{},
+	}
+
+	known := make(map[string]bool)
+	for _, sf := range files {
+		known[sf.fileName()] = true
+	}
+	for _, b := range blobs {
+		known[b.Name] = true
+	}
+
+	grace := time.Duration(env.IntOrDefault("RECONCILE_TEMP_GRACE", config.EnvDefaultReconcileTempGrace)) * time.Second
+	existing := make(map[string]bool)
+	quarantined := make(map[string]bool)
+	for _, info := range infos {
+		name := info.Name
+		existing[name] = true
+		if strings.HasPrefix(name, "quarantine-") {
+			if parts := strings.Split(name, "-"); len(parts) > 1 {
+				quarantined["blob-"+parts[1]] = true
+			}
+			continue
+		}
+		if known[name] {
+			continue
+		}
+		if source, size, ok := parseThumbnailName(name); ok && known[source] && isThumbnailSize(size) {
+			continue
+		}
+		if _, ok := fs.tempFiles.Load(name); ok {
+			// still being uploaded
+			continue
+		}
+		if isTempName(name) && time.Since(info.ModTime) < grace {
+			// could still be written by another instance
+			continue
+		}
+
+		klog.Warningf("File %s exists, but has no metadata", name)
+		report.Orphans = append(report.Orphans, name)
+		fs.repairOrphan(name, policy, report)
+	}
+
+	for _, sf := range files {
+		if existing[sf.fileName()] || quarantined[sf.fileName()] {
+			continue
+		}
+
+		// it might have been stored after the listing
+		ok, err := fs.fileSystem.Exists(sf.fileName())
+		if err != nil {
+			klog.Errorf("Could not check if file %s exists: %v", sf.Id, err)
+			continue
+		}
+		if ok {
+			continue
+		}
+
+		klog.Warningf("File %s has metadata, but does not exist", sf.Id)
+		report.Missing = append(report.Missing, sf.Id)
+		if policy == config.ReconcilePolicyLeave {
+			continue
+		}
+
+		err = fs.deleteFile(sf)
+		if err != nil {
+			klog.Errorf("Could not delete metadata of file %s: %v", sf.Id, err)
+			continue
+		}
+		report.DeletedMissing = append(report.DeletedMissing, sf.Id)
+	}
+
+	klog.Infof("Reconciled %d files (%d orphans, %d missing)", len(infos), len(report.Orphans), len(report.Missing))
+	return report, nil
+}
+
+// isTempName returns if the file is an incomplete upload or a thumbnail,
+// which are only temporary files that can be created again.
+func isTempName(name string) bool {
+	return strings.HasPrefix(name, "tmp-") || strings.HasPrefix(name, "thumb-")
+}
+
+// repairOrphan adopts or deletes the orphan according to the policy.
+func (fs *FileStorage) repairOrphan(name string, policy string, report *ReconcileReport) {
+	if policy == config.ReconcilePolicyLeave {
+		return
+	}
+
+	var digest string
+	if strings.HasPrefix(name, "blob-") {
+		// the name of an encrypted blob doesn't tell its digest
+		var err error
+		digest, err = fs.getOrphanDigest(name)
+		if err != nil {
+			klog.Errorf("Could not get digest of orphan %s: %v", name, err)
+			return
+		}
+
+		// the blob might have been stored again in the meantime
+		unlock := fs.blobLocks.lock(digest)
+		defer unlock()
+
+		b, err := fs.fileMetaDb.GetBlob(digest)
+		if err != nil {
+			klog.Errorf("Could not get blob %s: %v", digest, err)
+			return
+		}
+		if b != nil && b.Name == name {
+			return
+		}
+	}
+
+	// incomplete uploads and thumbnails can't be adopted
+	if policy == config.ReconcilePolicyDelete || isTempName(name) {
+		err := fs.fileSystem.DeleteFile(name)
+		if err != nil {
+			klog.Errorf("Could not delete orphan %s: %v", name, err)
+			return
+		}
+		klog.Infof("Delete orphan %s", name)
+		report.DeletedOrphans = append(report.DeletedOrphans, name)
+		return
+	}
+
+	sf, err := fs.adoptOrphan(name, digest)
+	if err != nil {
+		klog.Errorf("Could not adopt orphan %s: %v", name, err)
+		return
+	}
+	klog.Infof("Adopt orphan %s as file %s", name, sf.Id)
+	report.Adopted = append(report.Adopted, sf.Id)
+}
+
+// openOrphan opens given orphan, which has been encrypted
+// with any of the keys or not at all.
+func (fs *FileStorage) openOrphan(name string) (io.ReadSeekCloser, error) {
+	f, err := fs.fileSystem.GetFile(name)
+	if errors.Is(err, errFileNotEncrypted) {
+		// stored before the encryption has been enabled
+		f, err = fs.getFile(name, "")
+	}
+	return f, err
+}
+
+// getOrphanDigest returns the digest of the content of given orphan.
+func (fs *FileStorage) getOrphanDigest(name string) (string, error) {
+	f, err := fs.openOrphan(name)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+
+	h := sha256.New()
+	_, err = io.Copy(h, f)
+	if err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
+
+// adoptOrphan creates the metadata for given orphan. Blobs, which have
+// given digest, get a new file referencing them, all other files keep
+// their name as id. The blob has to be locked by the caller.
+func (fs *FileStorage) adoptOrphan(name string, digest string) (*StoredFile, error) {
+	f, err := fs.openOrphan(name)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	head := make([]byte, mime.HeaderSize)
+	n, err := io.ReadFull(f, head)
+	if err != nil && err != io.EOF && err != io.ErrUnexpectedEOF {
+		return nil, err
+	}
+	mimeType := mime.Detect(head[:n])
+	if mimeType == "" {
+		mimeType = "application/octet-stream"
+	}
+
+	size, err := f.Seek(0, io.SeekEnd)
+	if err != nil {
+		return nil, err
+	}
+
+	var keyId string
+	if dr, ok := f.(*decryptingReader); ok {
+		keyId = dr.keyId
+	}
+
+	now := time.Now().Unix()
+	sf := &StoredFile{
+		Id:         name,
+		UploadedAt: now,
+		ExpiresAt:  getExpiresAt(now, int64(env.IntOrDefault("RECONCILE_EXPIRATION", config.EnvDefaultReconcileExpiration))),
+		MimeType:   mimeType,
+		Size:       size,
+		KeyId:      keyId,
+	}
+
+	if digest != "" {
+		sf.Digest = digest
+		sf.BlobName = name
+		sf.Id, err = getRandomFileName(env.IntOrDefault("FILE_NAME_LENGTH", 8))
+		if err != nil {
+			return nil, err
+		}
+
+		b, err := fs.fileMetaDb.AcquireBlob(&Blob{Digest: digest, Size: size, KeyId: keyId, Name: name})
+		if err != nil {
+			return nil, err
+		}
+		if b.Name != name {
+			// the content is stored as another blob already
+			_, _ = fs.fileMetaDb.ReleaseBlob(digest, func() error { return nil })
+			return nil, fmt.Errorf("content is already stored as %s", b.Name)
+		}
+	}
+
+	err = fs.fileMetaDb.WriteFile(sf)
+	if err != nil {
+		if sf.Digest != "" {
+			// the physical blob stays, as it is still an orphan
+			_, _ = fs.fileMetaDb.ReleaseBlob(sf.Digest, func() error { return nil })
+		}
+		return nil, err
+	}
+	return sf, nil
+}
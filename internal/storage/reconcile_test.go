@@ -0,0 +1,50 @@
+package storage
+
+import (
+	"github.com/superioz/aqua/internal/config"
+	"io"
+	"testing"
+)
+
+func TestReconcileAdoptEncryptedBlob(t *testing.T) {
+	runWithDatabases(t, func(t *testing.T, db FileMetaDatabase) {
+		fs := newTestFileStorage(t, db)
+		fs.fileSystem = newTestEncryptedFileSystem(t, t.TempDir()+"/", "k1")
+		lost := storeTestFile(t, fs, "lost content")
+
+		// the metadata is lost, e.g. because of a crash
+		_, err := db.DeleteFile(lost.Id)
+		if err != nil {
+			t.Fatal(err)
+		}
+		_, err = db.ReleaseBlob(lost.Digest, func() error { return nil })
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		report, err := fs.Reconcile(config.ReconcilePolicyAdopt)
+		if err != nil {
+			t.Fatalf("Reconcile() error = %v", err)
+		}
+		if len(report.Orphans) != 1 || report.Orphans[0] != lost.BlobName || len(report.Adopted) != 1 {
+			t.Fatalf("Reconcile() = %+v, want the blob to be adopted", report)
+		}
+
+		// the digest is taken from the content, not from the name
+		sf, f, err := fs.OpenFile(report.Adopted[0])
+		if err != nil {
+			t.Fatalf("OpenFile() of adopted file error = %v", err)
+		}
+		content, err := io.ReadAll(f)
+		f.Close()
+		if err != nil || string(content) != "lost content" || sf.Digest != lost.Digest || sf.KeyId != "k1" {
+			t.Errorf("adopted file = %+v with %q, %v, want the lost file", sf, content, err)
+		}
+
+		// nothing is left to reconcile
+		report, err = fs.Reconcile(config.ReconcilePolicyAdopt)
+		if err != nil || len(report.Orphans) != 0 || len(report.Missing) != 0 {
+			t.Errorf("second Reconcile() = %+v, %v, want nothing to do", report, err)
+		}
+	})
+}
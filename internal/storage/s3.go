@@ -0,0 +1,162 @@
+package storage
+
+import (
+	"context"
+	"fmt"
+	"github.com/minio/minio-go/v7"
+	"github.com/minio/minio-go/v7/pkg/credentials"
+	"io"
+	"net/http"
+	"os"
+	"strings"
+)
+
+// S3Config contains everything needed to connect to
+// an S3-compatible object storage, e.g. AWS S3 or MinIO.
+type S3Config struct {
+	Endpoint        string
+	Region          string
+	Bucket          string
+	AccessKeyId     string
+	SecretAccessKey string
+	UseSSL          bool
+
+	// Prefix is prepended to every object name, so that
+	// the bucket can be shared with other applications.
+	Prefix string
+
+	// PartSize is the size of a single part in a multipart upload.
+	// Only one part at a time is held in memory.
+	PartSize uint64
+}
+
+// S3FileSystem stores the files as objects inside an S3 bucket.
+// Unlike the LocalFileSystem it can be shared by multiple instances
+// of aqua at the same time.
+type S3FileSystem struct {
+	client *minio.Client
+	config *S3Config
+}
+
+func NewS3FileSystem(cfg *S3Config) (*S3FileSystem, error) {
+	client, err := minio.New(cfg.Endpoint, &minio.Options{
+		Creds:  credentials.NewStaticV4(cfg.AccessKeyId, cfg.SecretAccessKey, ""),
+		Secure: cfg.UseSSL,
+		Region: cfg.Region,
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	ctx := context.Background()
+	ok, err := client.BucketExists(ctx, cfg.Bucket)
+	if err != nil {
+		return nil, fmt.Errorf("could not check if bucket %s exists: %v", cfg.Bucket, err)
+	}
+	if !ok {
+		err = client.MakeBucket(ctx, cfg.Bucket, minio.MakeBucketOptions{Region: cfg.Region})
+		if err != nil {
+			return nil, fmt.Errorf("could not create bucket %s: %v", cfg.Bucket, err)
+		}
+	}
+
+	return &S3FileSystem{
+		client: client,
+		config: cfg,
+	}, nil
+}
+
+func (s *S3FileSystem) CreateFile(r io.Reader, name string) (bool, error) {
+	// we don't know the size of the reader beforehand, so the
+	// client uploads it part by part. A failed multipart upload
+	// is aborted, so nothing is left behind in the bucket.
+	_, err := s.client.PutObject(context.Background(), s.config.Bucket, s.objectName(name), r, -1, minio.PutObjectOptions{
+		PartSize: s.config.PartSize,
+	})
+	if err != nil {
+		return false, err
+	}
+	return true, nil
+}
+
+func (s *S3FileSystem) DeleteFile(id string) error {
+	return s.client.RemoveObject(context.Background(), s.config.Bucket, s.objectName(id), minio.RemoveObjectOptions{})
+}
+
+func (s *S3FileSystem) MoveFile(from string, to string) error {
+	// objects can't be renamed, but at least the copy happens
+	// inside of the storage. Compose instead of copy, as a single
+	// copy is limited to 5GB.
+	ctx := context.Background()
+	_, err := s.client.ComposeObject(ctx, minio.CopyDestOptions{
+		Bucket: s.config.Bucket,
+		Object: s.objectName(to),
+	}, minio.CopySrcOptions{
+		Bucket: s.config.Bucket,
+		Object: s.objectName(from),
+	})
+	if err != nil {
+		return err
+	}
+	return s.client.RemoveObject(ctx, s.config.Bucket, s.objectName(from), minio.RemoveObjectOptions{})
+}
+
+func (s *S3FileSystem) GetFile(id string) (io.ReadSeekCloser, error) {
+	ctx := context.Background()
+	obj, err := s.client.GetObject(ctx, s.config.Bucket, s.objectName(id), minio.GetObjectOptions{})
+	if err != nil {
+		return nil, err
+	}
+
+	// the object is fetched lazily, so we have to stat it
+	// to know if it exists at all.
+	_, err = obj.Stat()
+	if err != nil {
+		obj.Close()
+		if isNoSuchKey(err) {
+			return nil, fmt.Errorf("object %s: %w", id, os.ErrNotExist)
+		}
+		return nil, err
+	}
+	return obj, nil
+}
+
+func (s *S3FileSystem) Exists(id string) (bool, error) {
+	_, err := s.client.StatObject(context.Background(), s.config.Bucket, s.objectName(id), minio.StatObjectOptions{})
+	if err != nil {
+		if isNoSuchKey(err) {
+			return false, nil
+		}
+		return false, err
+	}
+	return true, nil
+}
+
+func (s *S3FileSystem) ListFiles() ([]FileInfo, error) {
+	var files []FileInfo
+	for obj := range s.client.ListObjects(context.Background(), s.config.Bucket, minio.ListObjectsOptions{
+		Prefix:    s.config.Prefix,
+		Recursive: true,
+	}) {
+		if obj.Err != nil {
+			return nil, obj.Err
+		}
+
+		// everything deeper down does not belong to us
+		name := strings.TrimPrefix(obj.Key, s.config.Prefix)
+		if name == "" || strings.Contains(name, "/") {
+			continue
+		}
+		files = append(files, FileInfo{Name: name, ModTime: obj.LastModified})
+	}
+	return files, nil
+}
+
+func (s *S3FileSystem) objectName(id string) string {
+	return s.config.Prefix + id
+}
+
+func isNoSuchKey(err error) bool {
+	resp := minio.ToErrorResponse(err)
+	return resp.Code == "NoSuchKey" || resp.StatusCode == http.StatusNotFound
+}
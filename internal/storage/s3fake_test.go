@@ -0,0 +1,270 @@
+package storage
+
+import (
+	"bytes"
+	"crypto/md5"
+	"encoding/hex"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// fakeS3 is an in-process S3 server, which implements just enough of
+// the API for the S3FileSystem. Signatures are not checked.
+type fakeS3 struct {
+	mu      sync.Mutex
+	buckets map[string]map[string]*fakeS3Object
+	uploads map[string]map[int][]byte
+	nextId  int
+}
+
+type fakeS3Object struct {
+	data    []byte
+	modTime time.Time
+}
+
+// newFakeS3FileSystem starts a fake S3 server and returns
+// a file system, that stores its files in it.
+func newFakeS3FileSystem(t *testing.T, prefix string) (*S3FileSystem, *fakeS3) {
+	fake := &fakeS3{
+		buckets: map[string]map[string]*fakeS3Object{},
+		uploads: map[string]map[int][]byte{},
+	}
+	srv := httptest.NewServer(fake)
+	t.Cleanup(srv.Close)
+
+	fs, err := NewS3FileSystem(&S3Config{
+		Endpoint:        strings.TrimPrefix(srv.URL, "http://"),
+		Region:          "us-east-1",
+		Bucket:          "aqua",
+		AccessKeyId:     "access",
+		SecretAccessKey: "secret",
+		Prefix:          prefix,
+		PartSize:        5 * 1024 * 1024,
+	})
+	if err != nil {
+		t.Fatalf("could not create s3 file system: %v", err)
+	}
+	return fs, fake
+}
+
+// objects returns the names of all objects in the bucket.
+func (f *fakeS3) objects(bucket string) []string {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	var names []string
+	for name := range f.buckets[bucket] {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+func (f *fakeS3) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	path := strings.TrimPrefix(r.URL.Path, "/")
+	bucket, key := path, ""
+	if i := strings.Index(path, "/"); i >= 0 {
+		bucket, key = path[:i], path[i+1:]
+	}
+	q := r.URL.Query()
+
+	if key == "" {
+		f.serveBucket(w, r, bucket, q)
+		return
+	}
+	objects, ok := f.buckets[bucket]
+	if !ok {
+		writeS3Error(w, http.StatusNotFound, "NoSuchBucket")
+		return
+	}
+
+	switch {
+	case r.Method == http.MethodPost && q.Has("uploads"):
+		f.nextId++
+		id := strconv.Itoa(f.nextId)
+		f.uploads[id] = map[int][]byte{}
+		writeS3Xml(w, struct {
+			XMLName  xml.Name `xml:"InitiateMultipartUploadResult"`
+			Bucket   string
+			Key      string
+			UploadId string
+		}{Bucket: bucket, Key: key, UploadId: id})
+	case r.Method == http.MethodPut && q.Has("uploadId"):
+		parts, ok := f.uploads[q.Get("uploadId")]
+		if !ok {
+			writeS3Error(w, http.StatusNotFound, "NoSuchUpload")
+			return
+		}
+		n, _ := strconv.Atoi(q.Get("partNumber"))
+		if r.Header.Get("X-Amz-Copy-Source") == "" {
+			data, _ := io.ReadAll(r.Body)
+			parts[n] = data
+			w.Header().Set("ETag", etag(data))
+			return
+		}
+
+		// the objects are moved by copying them part by part
+		src, ok := f.copySource(r, bucket)
+		if !ok {
+			writeS3Error(w, http.StatusNotFound, "NoSuchKey")
+			return
+		}
+		data := src.data
+		var start, end int
+		if _, err := fmt.Sscanf(r.Header.Get("X-Amz-Copy-Source-Range"), "bytes=%d-%d", &start, &end); err == nil {
+			data = data[start : end+1]
+		}
+		parts[n] = data
+		writeS3Xml(w, struct {
+			XMLName      xml.Name `xml:"CopyPartResult"`
+			ETag         string
+			LastModified string
+		}{ETag: etag(data), LastModified: time.Now().UTC().Format(time.RFC3339)})
+	case r.Method == http.MethodPost && q.Has("uploadId"):
+		parts, ok := f.uploads[q.Get("uploadId")]
+		if !ok {
+			writeS3Error(w, http.StatusNotFound, "NoSuchUpload")
+			return
+		}
+		var numbers []int
+		for n := range parts {
+			numbers = append(numbers, n)
+		}
+		sort.Ints(numbers)
+		var data []byte
+		for _, n := range numbers {
+			data = append(data, parts[n]...)
+		}
+		delete(f.uploads, q.Get("uploadId"))
+		objects[key] = &fakeS3Object{data: data, modTime: time.Now()}
+		writeS3Xml(w, struct {
+			XMLName xml.Name `xml:"CompleteMultipartUploadResult"`
+			Bucket  string
+			Key     string
+			ETag    string
+		}{Bucket: bucket, Key: key, ETag: etag(data)})
+	case r.Method == http.MethodDelete && q.Has("uploadId"):
+		delete(f.uploads, q.Get("uploadId"))
+		w.WriteHeader(http.StatusNoContent)
+	case r.Method == http.MethodPut && r.Header.Get("X-Amz-Copy-Source") != "":
+		src, ok := f.copySource(r, bucket)
+		if !ok {
+			writeS3Error(w, http.StatusNotFound, "NoSuchKey")
+			return
+		}
+		obj := &fakeS3Object{data: src.data, modTime: time.Now()}
+		objects[key] = obj
+		writeS3Xml(w, struct {
+			XMLName      xml.Name `xml:"CopyObjectResult"`
+			ETag         string
+			LastModified string
+		}{ETag: etag(obj.data), LastModified: obj.modTime.UTC().Format(time.RFC3339)})
+	case r.Method == http.MethodPut:
+		data, _ := io.ReadAll(r.Body)
+		objects[key] = &fakeS3Object{data: data, modTime: time.Now()}
+		w.Header().Set("ETag", etag(data))
+	case r.Method == http.MethodGet || r.Method == http.MethodHead:
+		obj, ok := objects[key]
+		if !ok {
+			writeS3Error(w, http.StatusNotFound, "NoSuchKey")
+			return
+		}
+		w.Header().Set("ETag", etag(obj.data))
+		w.Header().Set("Last-Modified", obj.modTime.UTC().Format(http.TimeFormat))
+		w.Header().Set("Content-Type", "application/octet-stream")
+		http.ServeContent(w, r, key, obj.modTime, bytes.NewReader(obj.data))
+	case r.Method == http.MethodDelete:
+		delete(objects, key)
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		writeS3Error(w, http.StatusNotImplemented, "NotImplemented")
+	}
+}
+
+// copySource returns the object that should be copied by the request.
+func (f *fakeS3) copySource(r *http.Request, bucket string) (*fakeS3Object, bool) {
+	source, _ := url.PathUnescape(strings.TrimPrefix(r.Header.Get("X-Amz-Copy-Source"), "/"))
+	obj, ok := f.buckets[bucket][strings.TrimPrefix(source, bucket+"/")]
+	return obj, ok
+}
+
+func (f *fakeS3) serveBucket(w http.ResponseWriter, r *http.Request, bucket string, q url.Values) {
+	objects, ok := f.buckets[bucket]
+	switch r.Method {
+	case http.MethodHead:
+		if !ok {
+			w.WriteHeader(http.StatusNotFound)
+		}
+	case http.MethodPut:
+		if !ok {
+			f.buckets[bucket] = map[string]*fakeS3Object{}
+		}
+	case http.MethodGet:
+		if !ok {
+			writeS3Error(w, http.StatusNotFound, "NoSuchBucket")
+			return
+		}
+		type content struct {
+			Key          string
+			LastModified string
+			ETag         string
+			Size         int64
+		}
+		result := struct {
+			XMLName     xml.Name `xml:"ListBucketResult"`
+			Name        string
+			Prefix      string
+			KeyCount    int
+			MaxKeys     int
+			IsTruncated bool
+			Contents    []content
+		}{Name: bucket, Prefix: q.Get("prefix"), MaxKeys: 1000}
+		for key, obj := range objects {
+			if !strings.HasPrefix(key, q.Get("prefix")) {
+				continue
+			}
+			result.Contents = append(result.Contents, content{
+				Key:          key,
+				LastModified: obj.modTime.UTC().Format(time.RFC3339),
+				ETag:         etag(obj.data),
+				Size:         int64(len(obj.data)),
+			})
+		}
+		sort.Slice(result.Contents, func(i, j int) bool {
+			return result.Contents[i].Key < result.Contents[j].Key
+		})
+		result.KeyCount = len(result.Contents)
+		writeS3Xml(w, result)
+	default:
+		writeS3Error(w, http.StatusNotImplemented, "NotImplemented")
+	}
+}
+
+func writeS3Xml(w http.ResponseWriter, v interface{}) {
+	w.Header().Set("Content-Type", "application/xml")
+	_ = xml.NewEncoder(w).Encode(v)
+}
+
+func writeS3Error(w http.ResponseWriter, status int, code string) {
+	w.Header().Set("Content-Type", "application/xml")
+	w.WriteHeader(status)
+	_, _ = fmt.Fprintf(w, "<Error><Code>%s</Code><Message>%s</Message></Error>", code, code)
+}
+
+func etag(data []byte) string {
+	sum := md5.Sum(data)
+	return `"` + hex.EncodeToString(sum[:]) + `"`
+}
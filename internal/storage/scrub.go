@@ -0,0 +1,160 @@
+package storage
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"github.com/superioz/aqua/internal/metrics"
+	"io"
+	"k8s.io/klog"
+	"os"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	ScrubResultOk      = "ok"
+	ScrubResultCorrupt = "corrupt"
+	ScrubResultMissing = "missing"
+)
+
+var ErrScrubRunning = errors.New("scrub is already running")
+
+// ScrubReport is the result of a single scrub.
+type ScrubReport struct {
+	Checked int `json:"checked"`
+
+	// Corrupt and Missing contain the digests
+	// of the blobs that failed the check.
+	Corrupt []string `json:"corrupt"`
+	Missing []string `json:"missing"`
+
+	// Quarantined contains the digests of the corrupt
+	// blobs, that have been moved out of the way.
+	Quarantined []string `json:"quarantined"`
+}
+
+// quarantineName returns the name the corrupt blob with given name is moved to.
+func quarantineName(name string) string {
+	return fmt.Sprintf("quarantine-%s-%d", strings.TrimPrefix(name, "blob-"), time.Now().Unix())
+}
+
+// Scrub reads every blob and checks if its content still matches its
+// digest. Mismatches are logged and reported via metrics. If quarantine
+// is true, corrupt blobs are moved aside, so that they are not served
+// anymore. Files that have been stored before the deduplication don't
+// have a digest and are not checked.
+//
+// Only one scrub can run at a time, otherwise ErrScrubRunning is returned.
+func (fs *FileStorage) Scrub(quarantine bool) (*ScrubReport, error) {
+	if !atomic.CompareAndSwapInt32(&fs.scrubbing, 0, 1) {
+		return nil, ErrScrubRunning
+	}
+	defer atomic.StoreInt32(&fs.scrubbing, 0)
+	return fs.scrub(quarantine)
+}
+
+// StartScrub runs Scrub in the background and calls done with its
+// result. Returns ErrScrubRunning, if a scrub is already running.
+func (fs *FileStorage) StartScrub(quarantine bool, done func(report *ScrubReport, err error)) error {
+	if !atomic.CompareAndSwapInt32(&fs.scrubbing, 0, 1) {
+		return ErrScrubRunning
+	}
+	go func() {
+		defer atomic.StoreInt32(&fs.scrubbing, 0)
+		done(fs.scrub(quarantine))
+	}()
+	return nil
+}
+
+func (fs *FileStorage) scrub(quarantine bool) (*ScrubReport, error) {
+	klog.Infoln("Scrub stored files")
+	blobs, err := fs.fileMetaDb.GetAllBlobs()
+	if err != nil {
+		return nil, err
+	}
+
+	report := &ScrubReport{
+		Corrupt:     []string{},
+		Missing:     []string{},
+		Quarantined: []string{},
+	}
+	for _, b := range blobs {
+		result, err := fs.checkBlob(b)
+		if err != nil {
+			// can't tell if the blob is fine or not
+			klog.Errorf("Could not check blob %s: %v", b.Digest, err)
+			continue
+		}
+		report.Checked++
+		metrics.IncBlobsScrubbed(result)
+
+		switch result {
+		case ScrubResultMissing:
+			klog.Errorf("Blob %s is missing", b.Digest)
+			report.Missing = append(report.Missing, b.Digest)
+		case ScrubResultCorrupt:
+			klog.Errorf("Blob %s is corrupt, its content does not match its digest", b.Digest)
+			report.Corrupt = append(report.Corrupt, b.Digest)
+			if !quarantine {
+				continue
+			}
+
+			err = fs.quarantineBlob(b)
+			if err != nil {
+				klog.Errorf("Could not quarantine blob %s: %v", b.Digest, err)
+				continue
+			}
+			report.Quarantined = append(report.Quarantined, b.Digest)
+		}
+	}
+
+	klog.Infof("Scrubbed %d blobs (%d corrupt, %d missing)", report.Checked, len(report.Corrupt), len(report.Missing))
+	return report, nil
+}
+
+// checkBlob hashes the content of the blob and compares it with its digest.
+func (fs *FileStorage) checkBlob(b *Blob) (string, error) {
+	f, err := fs.getFile(b.Name, b.KeyId)
+	if errors.Is(err, os.ErrNotExist) {
+		return ScrubResultMissing, nil
+	}
+	if errors.Is(err, errEncryptedFileCorrupt) {
+		return ScrubResultCorrupt, nil
+	}
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+
+	h := sha256.New()
+	_, err = io.Copy(h, f)
+	if errors.Is(err, errEncryptedFileCorrupt) {
+		return ScrubResultCorrupt, nil
+	}
+	if err != nil {
+		return "", err
+	}
+
+	if hex.EncodeToString(h.Sum(nil)) != b.Digest {
+		return ScrubResultCorrupt, nil
+	}
+	return ScrubResultOk, nil
+}
+
+// quarantineBlob moves the corrupt blob aside. The files referencing
+// it are not served anymore, until the same content is uploaded again.
+func (fs *FileStorage) quarantineBlob(b *Blob) error {
+	unlock := fs.blobLocks.lock(b.Digest)
+	defer unlock()
+
+	name := quarantineName(b.Name)
+	err := fs.fileSystem.MoveFile(b.Name, name)
+	if err != nil {
+		return err
+	}
+	klog.Warningf("Moved corrupt blob %s to %s", b.Digest, name)
+	return nil
+}
@@ -0,0 +1,42 @@
+package storage
+
+import (
+	"errors"
+	"testing"
+)
+
+func TestStartScrub(t *testing.T) {
+	fs := newTestFileStorage(t, newTestSqliteDatabase(t))
+	storeTestFile(t, fs, "content")
+
+	release := make(chan struct{})
+	finished := make(chan *ScrubReport, 1)
+	err := fs.StartScrub(false, func(report *ScrubReport, err error) {
+		<-release
+		if err != nil {
+			t.Errorf("scrub error = %v", err)
+		}
+		finished <- report
+	})
+	if err != nil {
+		t.Fatalf("StartScrub() error = %v", err)
+	}
+
+	// only one scrub runs at a time
+	err = fs.StartScrub(false, func(*ScrubReport, error) {
+		t.Errorf("second scrub has been started")
+	})
+	if !errors.Is(err, ErrScrubRunning) {
+		t.Errorf("StartScrub() while running error = %v, want ErrScrubRunning", err)
+	}
+	_, err = fs.Scrub(false)
+	if !errors.Is(err, ErrScrubRunning) {
+		t.Errorf("Scrub() while running error = %v, want ErrScrubRunning", err)
+	}
+
+	close(release)
+	report := <-finished
+	if report == nil || report.Checked != 1 || len(report.Corrupt) != 0 || len(report.Missing) != 0 {
+		t.Errorf("report = %+v, want 1 checked blob", report)
+	}
+}
@@ -1,27 +1,132 @@
 package storage
 
 import (
+	"bytes"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
 	"encoding/base64"
+	"encoding/hex"
 	"errors"
 	"fmt"
 	"github.com/google/uuid"
 	"github.com/superioz/aqua/internal/config"
 	"github.com/superioz/aqua/internal/metrics"
 	"github.com/superioz/aqua/internal/request"
+	"github.com/superioz/aqua/internal/sanitize"
 	"github.com/superioz/aqua/pkg/env"
+	"golang.org/x/crypto/bcrypt"
+	"io"
 	"k8s.io/klog"
+	"os"
 	"strings"
+	"sync"
 	"time"
 
 	_ "modernc.org/sqlite"
 )
 
+var (
+	ErrFileNotFound         = errors.New("file not found")
+	ErrFileExpired          = errors.New("file has expired")
+	ErrDownloadLimitReached = errors.New("download limit reached")
+)
+
+// MaxPasswordLength is the maximum length of a file password in
+// bytes, as bcrypt ignores everything after that.
+const MaxPasswordLength = 72
+
 type StoredFile struct {
-	Id         string
-	UploadedAt int64
-	ExpiresAt  int64
-	MimeType   string
-	Size       int64
+	Id         string `json:"id"`
+	UploadedAt int64  `json:"uploadedAt"`
+	ExpiresAt  int64  `json:"expiresAt"`
+	MimeType   string `json:"mimeType"`
+	Size       int64  `json:"size"`
+
+	// DeletionKey is the secret that allows to delete the file without
+	// any other authorization. It is only known directly after
+	// storing the file, afterwards only its hash is available.
+	DeletionKey     string `json:"-"`
+	DeletionKeyHash string `json:"-"`
+
+	// TokenId identifies the token the file was uploaded with.
+	TokenId string `json:"tokenId"`
+
+	// MaxDownloads is the amount of downloads after which the
+	// file is deleted. Zero means unlimited.
+	MaxDownloads int64 `json:"maxDownloads"`
+	Downloads    int64 `json:"downloads"`
+
+	// PasswordHash is the bcrypt hash of the password that is
+	// needed to download the file. Empty if there is none.
+	PasswordHash string `json:"-"`
+
+	// KeyId is the id of the key the file has been encrypted
+	// with. Empty if the file is not encrypted.
+	KeyId string `json:"keyId"`
+
+	// Digest is the hex encoded SHA-256 of the content, which
+	// identifies the blob the content is stored in.
+	Digest string `json:"digest"`
+
+	// BlobName is the name of the blob inside of the file system.
+	// Empty for files stored before the deduplication.
+	BlobName string `json:"-"`
+
+	// Language is the programming language of a paste, which is
+	// used for the syntax highlighting. Empty if unknown.
+	Language string `json:"language"`
+}
+
+// StoreOptions contains everything that has been
+// decided about a file before storing it.
+type StoreOptions struct {
+	// Expiration in seconds from now on or config.ExpireNever.
+	Expiration   int64
+	TokenId      string
+	MaxDownloads int64
+
+	// Password that is needed to download the file, if not empty.
+	Password string
+
+	// StripMetadata removes metadata like EXIF from images,
+	// see sanitize.StripMetadata.
+	StripMetadata bool
+
+	// Language of a paste, see StoredFile.Language.
+	Language string
+}
+
+// IsExpired returns if the file has expired, even
+// if it has not been cleaned up yet.
+func (sf *StoredFile) IsExpired() bool {
+	return sf.ExpiresAt >= 0 && sf.ExpiresAt <= time.Now().Unix()
+}
+
+// IsExhausted returns if the file has reached its download limit.
+func (sf *StoredFile) IsExhausted() bool {
+	return sf.MaxDownloads > 0 && sf.Downloads >= sf.MaxDownloads
+}
+
+// CheckDeletionKey returns if given key is the deletion key of this file.
+func (sf *StoredFile) CheckDeletionKey(key string) bool {
+	if sf.DeletionKeyHash == "" || key == "" {
+		return false
+	}
+	return subtle.ConstantTimeCompare([]byte(hashDeletionKey(key)), []byte(sf.DeletionKeyHash)) == 1
+}
+
+// HasPassword returns if the file can only be downloaded with a password.
+func (sf *StoredFile) HasPassword() bool {
+	return sf.PasswordHash != ""
+}
+
+// CheckPassword returns if given password is the password of this file.
+func (sf *StoredFile) CheckPassword(password string) bool {
+	if !sf.HasPassword() || password == "" {
+		return false
+	}
+	return bcrypt.CompareHashAndPassword([]byte(sf.PasswordHash), []byte(password)) == nil
 }
 
 func (sf *StoredFile) String() string {
@@ -34,23 +139,146 @@ func (sf *StoredFile) String() string {
 type FileStorage struct {
 	fileMetaDb FileMetaDatabase
 	fileSystem FileSystem
+
+	// blobLocks makes sure that a blob is not deleted, while a new
+	// file with the same content is stored or a thumbnail is created.
+	blobLocks keyLocks
+
+	// tempFiles contains the temporary files of
+	// uploads, that are currently being stored.
+	tempFiles sync.Map
+
+	// thumbnailSlots limits how many images are decoded at the
+	// same time to create thumbnails, as they can be quite large.
+	thumbnailSlots chan struct{}
+
+	// scrubbing and reconciling are 1 while a
+	// scrub or a reconciliation is running.
+	scrubbing   int32
+	reconciling int32
 }
 
 func NewFileStorage() *FileStorage {
-	metaDbFilePath := env.StringOrDefault("FILE_META_DB_PATH", config.EnvDefaultMetaDbPath)
-	fileMetaDb := NewSqliteFileMetaDatabase(metaDbFilePath)
-	err := fileMetaDb.Connect()
+	fileMetaDb, err := newFileMetaDatabase()
+	if err != nil {
+		klog.Fatalf("Could not create file meta db: %v", err)
+	}
+	err = fileMetaDb.Connect()
+	if errors.Is(err, ErrSchemaTooNew) {
+		// we would risk corrupting data we don't understand
+		klog.Fatalf("Refusing to start: %v", err)
+	}
 	if err != nil {
 		klog.Errorf("Could not connect to file meta db: %v", err)
 	}
 
-	fileStoragePath := env.StringOrDefault("FILE_STORAGE_PATH", config.EnvDefaultFileStoragePath)
-	fileSystem := NewLocalFileStorage(fileStoragePath)
+	fileSystem, err := newFileSystem()
+	if err != nil {
+		klog.Fatalf("Could not create file system: %v", err)
+	}
 
 	return &FileStorage{
-		fileMetaDb: fileMetaDb,
-		fileSystem: fileSystem,
+		fileMetaDb:     fileMetaDb,
+		fileSystem:     fileSystem,
+		thumbnailSlots: make(chan struct{}, maxInt(1, env.IntOrDefault("THUMBNAIL_CONCURRENCY", config.EnvDefaultThumbnailConcurrency))),
+	}
+}
+
+// newFileMetaDatabase creates the meta database as configured
+// by the environment variable FILE_META_DB_TYPE.
+func newFileMetaDatabase() (FileMetaDatabase, error) {
+	dbType := env.StringOrDefault("FILE_META_DB_TYPE", config.EnvDefaultMetaDbType)
+	switch dbType {
+	case config.MetaDbTypeSqlite:
+		metaDbFilePath := env.StringOrDefault("FILE_META_DB_PATH", config.EnvDefaultMetaDbPath)
+		return NewSqliteFileMetaDatabase(metaDbFilePath), nil
+	case config.MetaDbTypePostgres:
+		dsn, ok := env.String("FILE_META_DB_DSN")
+		if !ok {
+			return nil, errors.New("FILE_META_DB_DSN has to be set for postgres")
+		}
+		return NewPostgresFileMetaDatabase(dsn), nil
+	default:
+		return nil, fmt.Errorf("unknown file meta db type %s", dbType)
+	}
+}
+
+// newFileSystem creates the file system as configured by the
+// environment variable FILE_STORAGE_TYPE. If ENCRYPTION_KEYS is set,
+// the files are encrypted before they are written to it.
+func newFileSystem() (FileSystem, error) {
+	fs, err := newPlainFileSystem()
+	if err != nil {
+		return nil, err
+	}
+
+	rawKeys, ok := env.String("ENCRYPTION_KEYS")
+	if !ok || rawKeys == "" {
+		return fs, nil
+	}
+	keys, keyId, err := ParseEncryptionKeys(rawKeys)
+	if err != nil {
+		return nil, err
+	}
+	return NewEncryptedFileSystem(fs, keys, env.StringOrDefault("ENCRYPTION_KEY_ID", keyId))
+}
+
+// newPlainFileSystem creates the file system as configured
+// by the environment variable FILE_STORAGE_TYPE.
+func newPlainFileSystem() (FileSystem, error) {
+	storageType := env.StringOrDefault("FILE_STORAGE_TYPE", config.EnvDefaultFileStorageType)
+	switch storageType {
+	case config.FileStorageTypeLocal:
+		fileStoragePath := env.StringOrDefault("FILE_STORAGE_PATH", config.EnvDefaultFileStoragePath)
+		return NewLocalFileStorage(fileStoragePath), nil
+	case config.FileStorageTypeS3:
+		return NewS3FileSystem(&S3Config{
+			Endpoint:        env.StringOrDefault("S3_ENDPOINT", ""),
+			Region:          env.StringOrDefault("S3_REGION", ""),
+			Bucket:          env.StringOrDefault("S3_BUCKET", "aqua"),
+			AccessKeyId:     env.StringOrDefault("S3_ACCESS_KEY_ID", ""),
+			SecretAccessKey: env.StringOrDefault("S3_SECRET_ACCESS_KEY", ""),
+			UseSSL:          env.BoolOrDefault("S3_USE_SSL", true),
+			Prefix:          env.StringOrDefault("S3_PREFIX", ""),
+			PartSize:        uint64(env.IntOrDefault("S3_PART_SIZE", config.EnvDefaultS3PartSize)) * 1024 * 1024,
+		})
+	default:
+		return nil, fmt.Errorf("unknown file storage type %s", storageType)
+	}
+}
+
+// Close closes the connection to the meta database.
+func (fs *FileStorage) Close() error {
+	return fs.fileMetaDb.Close()
+}
+
+// OpenFile returns the metadata of the file with given id and opens
+// the physical file, regardless of where it is stored.
+//
+// Only files with metadata are returned, otherwise ErrFileNotFound.
+// If the file has expired, ErrFileExpired is returned, even if the
+// file has not been cleaned up yet.
+func (fs *FileStorage) OpenFile(id string) (*StoredFile, io.ReadSeekCloser, error) {
+	sf, err := fs.fileMetaDb.GetFile(id)
+	if err != nil {
+		return nil, nil, err
+	}
+	if sf == nil {
+		return nil, nil, ErrFileNotFound
+	}
+	if sf.IsExpired() || sf.IsExhausted() {
+		return sf, nil, ErrFileExpired
 	}
+
+	f, err := fs.getFile(sf.fileName(), sf.KeyId)
+	if errors.Is(err, os.ErrNotExist) {
+		klog.Warningf("File %s has metadata, but does not exist", sf.Id)
+		return nil, nil, ErrFileNotFound
+	}
+	if err != nil {
+		return nil, nil, err
+	}
+	return sf, f, nil
 }
 
 // Cleanup uses the meta database to check for all files
@@ -67,70 +295,282 @@ func (fs *FileStorage) Cleanup() error {
 	}
 
 	for _, file := range expiredFiles {
-		if file.ExpiresAt < 0 {
+		if !file.IsExpired() && !file.IsExhausted() {
 			continue
 		}
 
-		// check if file doesn't exist anymore
-		ok, err := fs.fileSystem.Exists(file.Id)
+		err = fs.deleteFile(file)
 		if err != nil {
-			return fmt.Errorf("could not check if file exists with id=%s: %v", file.Id, err)
+			return err
 		}
-		if ok {
-			// file exists
-			// delete this file
-			err = fs.fileSystem.DeleteFile(file.Id)
-			if err != nil {
-				return fmt.Errorf("could not delete file with id=%s: %v", file.Id, err)
-			}
+
+		if file.IsExhausted() {
+			klog.Infof("Delete file %s (downloaded %d times)", file.Id, file.Downloads)
+		} else {
+			klog.Infof("Delete file %s (expired at %s)", file.Id, time.Unix(file.ExpiresAt, 0).String())
 		}
+		metrics.IncFilesExpired()
+	}
+	return nil
+}
 
-		err = fs.fileMetaDb.DeleteFile(file.Id)
+// GetFile returns the metadata of the file with given id
+// or nil, if the file does not exist.
+func (fs *FileStorage) GetFile(id string) (*StoredFile, error) {
+	return fs.fileMetaDb.GetFile(id)
+}
+
+// ListFiles returns all files matching given filter and
+// the total amount of matching files.
+func (fs *FileStorage) ListFiles(filter *FileFilter) ([]*StoredFile, int64, error) {
+	return fs.fileMetaDb.QueryFiles(filter)
+}
+
+// RegisterDownload counts a download of the file. Returns the updated
+// file or ErrDownloadLimitReached if the file can't be downloaded anymore.
+func (fs *FileStorage) RegisterDownload(sf *StoredFile) (*StoredFile, error) {
+	return fs.fileMetaDb.IncrementDownloads(sf.Id)
+}
+
+// GetTokenUsage returns how many files the token currently stores.
+func (fs *FileStorage) GetTokenUsage(tokenId string) (*TokenUsage, error) {
+	return fs.fileMetaDb.GetTokenUsage(tokenId)
+}
+
+// SetExpiration lets the file with given id expire in `expiration` seconds
+// from now on, or never if it is config.ExpireNever.
+// Returns nil if the file does not exist.
+func (fs *FileStorage) SetExpiration(id string, expiration int64) (*StoredFile, error) {
+	ok, err := fs.fileMetaDb.UpdateExpiration(id, getExpiresAt(time.Now().Unix(), expiration))
+	if err != nil || !ok {
+		return nil, err
+	}
+	return fs.fileMetaDb.GetFile(id)
+}
+
+// DeleteFile deletes the file with given id.
+// Returns false if the file did not exist.
+func (fs *FileStorage) DeleteFile(id string) (bool, error) {
+	sf, err := fs.fileMetaDb.GetFile(id)
+	if err != nil {
+		return false, err
+	}
+	if sf == nil {
+		return false, nil
+	}
+	return true, fs.deleteFile(sf)
+}
+
+// deleteFile deletes the metadata of the file and the physical file,
+// if no other file with the same content exists.
+func (fs *FileStorage) deleteFile(sf *StoredFile) error {
+	unlock := fs.fileLock(sf)
+	defer unlock()
+
+	if sf.Digest == "" {
+		return fs.deletePlainFile(sf)
+	}
+
+	ok, err := fs.fileMetaDb.DeleteFile(sf.Id)
+	if err != nil {
+		return fmt.Errorf("could not delete file with id=%s: %v", sf.Id, err)
+	}
+	if !ok {
+		// deleted in the meantime, so the blob has been released already
+		return nil
+	}
+	return fs.releaseBlob(sf.Digest, sf.BlobName)
+}
+
+// deletePlainFile deletes a file that has been stored before
+// the deduplication and therefore has its own physical file.
+// The file has to be locked by the caller.
+func (fs *FileStorage) deletePlainFile(sf *StoredFile) error {
+	// check if file doesn't exist anymore
+	ok, err := fs.fileSystem.Exists(sf.Id)
+	if err != nil {
+		return fmt.Errorf("could not check if file exists with id=%s: %v", sf.Id, err)
+	}
+	if ok {
+		// file exists
+		// delete this file
+		err = fs.fileSystem.DeleteFile(sf.Id)
 		if err != nil {
-			return fmt.Errorf("could not delete file with id=%s: %v", file.Id, err)
+			return fmt.Errorf("could not delete file with id=%s: %v", sf.Id, err)
 		}
+	} else {
+		klog.Warningf("File %s has metadata, but does not exist", sf.Id)
+	}
+	fs.deleteThumbnails(sf.Id)
 
-		klog.Infof("Delete file %s (expired at %s)", file.Id, time.Unix(file.ExpiresAt, 0).String())
-		metrics.IncFilesExpired()
+	_, err = fs.fileMetaDb.DeleteFile(sf.Id)
+	if err != nil {
+		return fmt.Errorf("could not delete file with id=%s: %v", sf.Id, err)
 	}
 	return nil
 }
 
-func (fs *FileStorage) StoreFile(rff *request.RequestFormFile, expiration int64) (*StoredFile, error) {
+func (fs *FileStorage) StoreFile(rff *request.RequestFormFile, opts *StoreOptions) (*StoredFile, error) {
 	name, err := getRandomFileName(env.IntOrDefault("FILE_NAME_LENGTH", 8))
 	if err != nil {
 		return nil, errors.New("could not generate random name")
 	}
 
-	_, err = fs.fileSystem.CreateFile(rff.File, name)
+	deletionKey, err := generateDeletionKey()
+	if err != nil {
+		return nil, errors.New("could not generate deletion key")
+	}
+
+	var passwordHash string
+	if opts.Password != "" {
+		hash, err := bcrypt.GenerateFromPassword([]byte(opts.Password), bcrypt.DefaultCost)
+		if err != nil {
+			return nil, fmt.Errorf("could not hash password: %v", err)
+		}
+		passwordHash = string(hash)
+	}
+
+	r, size, err := sanitizeFile(rff, opts)
+	if err != nil {
+		return nil, err
+	}
+
+	// the content is hashed while it is written to a temporary file,
+	// which is turned into the blob afterwards.
+	tmpName := tempName(name)
+	fs.tempFiles.Store(tmpName, true)
+	defer fs.tempFiles.Delete(tmpName)
+
+	h := sha256.New()
+	written, err := fs.fileSystem.CreateFile(io.TeeReader(r, h), tmpName)
 	if err != nil {
 		klog.Error(err)
+		if written {
+			fs.deleteTempFile(tmpName)
+		}
 		return nil, errors.New("could not save file to system")
 	}
 
-	currentTime := time.Now().Unix()
-	expAt := currentTime + expiration
-	if expiration == config.ExpireNever {
-		expAt = config.ExpireNever
+	digest := hex.EncodeToString(h.Sum(nil))
+	blob, err := fs.storeBlob(tmpName, &Blob{
+		Digest: digest,
+		Size:   size,
+		KeyId:  fs.keyId(),
+		Name:   fs.newBlobName(digest),
+	})
+	if err != nil {
+		klog.Error(err)
+		return nil, errors.New("could not save file to system")
 	}
 
+	currentTime := time.Now().Unix()
+	expAt := getExpiresAt(currentTime, opts.Expiration)
+
 	sf := &StoredFile{
-		Id:         name,
-		UploadedAt: currentTime,
-		ExpiresAt:  expAt,
-		MimeType:   rff.ContentType,
-		Size:       rff.ContentLength,
+		Id:              name,
+		UploadedAt:      currentTime,
+		ExpiresAt:       expAt,
+		MimeType:        rff.ContentType,
+		Size:            size,
+		DeletionKey:     deletionKey,
+		DeletionKeyHash: hashDeletionKey(deletionKey),
+		TokenId:         opts.TokenId,
+		MaxDownloads:    opts.MaxDownloads,
+		PasswordHash:    passwordHash,
+		KeyId:           blob.KeyId,
+		Digest:          blob.Digest,
+		BlobName:        blob.Name,
+		Language:        opts.Language,
 	}
 
-	// write to meta database
+	// write to meta database. If that fails, the physical file
+	// is deleted again, unless it is used by another file.
 	err = fs.fileMetaDb.WriteFile(sf)
 	if err != nil {
+		fs.rollbackBlob(blob)
 		return nil, err
 	}
 
 	return sf, nil
 }
 
+// sanitizeFile returns the content of the file that is stored and its size.
+// SVGs are always sanitized, images only if their metadata should be removed.
+func sanitizeFile(rff *request.RequestFormFile, opts *StoreOptions) (io.Reader, int64, error) {
+	svg := rff.ContentType == "image/svg+xml"
+	strip := opts.StripMetadata && sanitize.CanStripMetadata(rff.ContentType)
+	if !svg && !strip {
+		return rff.File, rff.ContentLength, nil
+	}
+
+	// the whole file is needed to parse it
+	data, err := io.ReadAll(rff.File)
+	if err != nil {
+		return nil, 0, fmt.Errorf("could not read file: %v", err)
+	}
+	if svg {
+		data, err = sanitize.SVG(data)
+		if err != nil {
+			return nil, 0, fmt.Errorf("could not sanitize svg: %w", err)
+		}
+	} else {
+		maxPixels := int64(env.IntOrDefault("STRIP_METADATA_MAX_PIXELS", config.EnvDefaultStripMetadataMaxPixels))
+		data, err = sanitize.StripMetadata(data, rff.ContentType, maxPixels)
+		if err != nil {
+			return nil, 0, fmt.Errorf("could not strip metadata: %w", err)
+		}
+	}
+	return bytes.NewReader(data), int64(len(data)), nil
+}
+
+// keyId returns the id of the key new files are
+// encrypted with or an empty string.
+func (fs *FileStorage) keyId() string {
+	if efs, ok := fs.fileSystem.(*EncryptedFileSystem); ok {
+		return efs.KeyId()
+	}
+	return ""
+}
+
+// getFile opens the physical file with given name, which has been encrypted
+// with the key with given id, or not at all if the id is empty.
+func (fs *FileStorage) getFile(name string, keyId string) (io.ReadSeekCloser, error) {
+	if efs, ok := fs.fileSystem.(*EncryptedFileSystem); ok {
+		return efs.GetFileWithKey(name, keyId)
+	}
+	if keyId != "" {
+		return nil, fmt.Errorf("file %s: %w %s", name, ErrUnknownEncryptionKey, keyId)
+	}
+	return fs.fileSystem.GetFile(name)
+}
+
+// getExpiresAt returns the time at which a file
+// expires `expiration` seconds after `now`.
+func getExpiresAt(now int64, expiration int64) int64 {
+	if expiration == config.ExpireNever {
+		return config.ExpireNever
+	}
+	return now + expiration
+}
+
+// generateDeletionKey returns a random key, that is
+// long enough to not be guessable.
+func generateDeletionKey() (string, error) {
+	b := make([]byte, 24)
+	_, err := rand.Read(b)
+	if err != nil {
+		return "", err
+	}
+	return base64.RawURLEncoding.EncodeToString(b), nil
+}
+
+// hashDeletionKey hashes the key, so that it is not stored in plain text.
+// The key is random enough to not need a salt or a slow hash function.
+func hashDeletionKey(key string) string {
+	sum := sha256.Sum256([]byte(key))
+	return hex.EncodeToString(sum[:])
+}
+
 var escaper = strings.NewReplacer("9", "99", "-", "90", "_", "91")
 
 // getRandomFileName returns a random string with a fixed size
@@ -0,0 +1,310 @@
+package storage
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"github.com/superioz/aqua/internal/config"
+	"github.com/superioz/aqua/pkg/env"
+	"image"
+	"image/color"
+	"image/jpeg"
+	"image/png"
+	"io"
+	"k8s.io/klog"
+	"os"
+	"strconv"
+	"strings"
+
+	_ "image/gif"
+)
+
+var (
+	ErrInvalidThumbnailSize = errors.New("invalid thumbnail size")
+	ErrThumbnailUnsupported = errors.New("no thumbnail available for this file")
+)
+
+// thumbnailTypes are the mime types thumbnails can be created for.
+var thumbnailTypes = map[string]bool{
+	"image/png":  true,
+	"image/jpeg": true,
+	"image/gif":  true,
+}
+
+// HasThumbnail returns if thumbnails can be created for files of given type.
+func HasThumbnail(mimeType string) bool {
+	return thumbnailTypes[mimeType]
+}
+
+// ThumbnailMimeType returns the type of the thumbnails of files with
+// given type. JPEGs stay JPEGs, everything else becomes a PNG, so
+// that transparency is kept.
+func ThumbnailMimeType(mimeType string) string {
+	if mimeType == "image/jpeg" {
+		return "image/jpeg"
+	}
+	return "image/png"
+}
+
+// ThumbnailSizes returns the allowed thumbnail sizes in pixels,
+// as configured by THUMBNAIL_SIZES. Invalid entries are ignored.
+func ThumbnailSizes() []int {
+	var sizes []int
+	for _, s := range strings.Split(env.StringOrDefault("THUMBNAIL_SIZES", config.EnvDefaultThumbnailSizes), ",") {
+		size, err := strconv.Atoi(strings.TrimSpace(s))
+		if err != nil || size <= 0 {
+			continue
+		}
+		sizes = append(sizes, size)
+	}
+	return sizes
+}
+
+// thumbnailName returns the name of the thumbnail of the
+// physical file with given name inside of the file system.
+func thumbnailName(source string, size int) string {
+	return fmt.Sprintf("thumb-%d-%s", size, source)
+}
+
+// parseThumbnailName returns the name of the physical file, that the
+// thumbnail with given name has been created for, and its size.
+func parseThumbnailName(name string) (string, int, bool) {
+	if !strings.HasPrefix(name, "thumb-") {
+		return "", 0, false
+	}
+	parts := strings.SplitN(name, "-", 3)
+	if len(parts) != 3 {
+		return "", 0, false
+	}
+	size, err := strconv.Atoi(parts[1])
+	if err != nil {
+		return "", 0, false
+	}
+	return parts[2], size, true
+}
+
+// OpenThumbnail opens the thumbnail of the file, that fits into a square
+// of given size. Images smaller than that are not scaled up. The thumbnail
+// is created on first use and cached next to the file, until the file is
+// deleted.
+//
+// Returns ErrInvalidThumbnailSize if the size is not one of ThumbnailSizes
+// and ErrThumbnailUnsupported if the file is no image that can be decoded.
+func (fs *FileStorage) OpenThumbnail(sf *StoredFile, size int) (io.ReadSeekCloser, error) {
+	if !isThumbnailSize(size) {
+		return nil, ErrInvalidThumbnailSize
+	}
+	if !HasThumbnail(sf.MimeType) {
+		return nil, ErrThumbnailUnsupported
+	}
+
+	// the file must not be deleted while its thumbnail is created,
+	// otherwise the thumbnail would be left behind.
+	unlock := fs.fileLock(sf)
+	defer unlock()
+
+	name := thumbnailName(sf.fileName(), size)
+	f, err := fs.fileSystem.GetFile(name)
+	if err == nil {
+		return f, nil
+	}
+	// thumbnails created before the encryption has
+	// been enabled are replaced by encrypted ones.
+	if !errors.Is(err, os.ErrNotExist) && !errors.Is(err, errFileNotEncrypted) {
+		return nil, err
+	}
+
+	fs.thumbnailSlots <- struct{}{}
+	err = fs.createThumbnail(sf, size, name)
+	<-fs.thumbnailSlots
+	if err != nil {
+		return nil, err
+	}
+	return fs.fileSystem.GetFile(name)
+}
+
+// createThumbnail scales the image down and writes it to the file
+// with given name.
+func (fs *FileStorage) createThumbnail(sf *StoredFile, size int, name string) error {
+	f, err := fs.getFile(sf.fileName(), sf.KeyId)
+	if errors.Is(err, os.ErrNotExist) {
+		return ErrFileNotFound
+	}
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	// check the dimensions first, so that we don't
+	// have to decode images that are way too large.
+	cfg, _, err := image.DecodeConfig(f)
+	if err != nil {
+		return fmt.Errorf("%w: %v", ErrThumbnailUnsupported, err)
+	}
+	maxPixels := int64(env.IntOrDefault("THUMBNAIL_MAX_PIXELS", config.EnvDefaultThumbnailMaxPixels))
+	if int64(cfg.Width)*int64(cfg.Height) > maxPixels {
+		return fmt.Errorf("%w: image has more than %d pixels", ErrThumbnailUnsupported, maxPixels)
+	}
+
+	_, err = f.Seek(0, io.SeekStart)
+	if err != nil {
+		return err
+	}
+	img, _, err := image.Decode(f)
+	if err != nil {
+		return fmt.Errorf("%w: %v", ErrThumbnailUnsupported, err)
+	}
+
+	var buf bytes.Buffer
+	thumb := scaleImage(img, size)
+	if ThumbnailMimeType(sf.MimeType) == "image/jpeg" {
+		err = jpeg.Encode(&buf, thumb, &jpeg.Options{Quality: 85})
+	} else {
+		err = png.Encode(&buf, thumb)
+	}
+	if err != nil {
+		return err
+	}
+
+	// written to a temporary file first, so that
+	// a partly written thumbnail is never served.
+	tmpName := tempName(name)
+	fs.tempFiles.Store(tmpName, true)
+	defer fs.tempFiles.Delete(tmpName)
+
+	written, err := fs.fileSystem.CreateFile(&buf, tmpName)
+	if err != nil {
+		if written {
+			fs.deleteTempFile(tmpName)
+		}
+		return fmt.Errorf("could not write thumbnail %s: %v", name, err)
+	}
+	err = fs.fileSystem.MoveFile(tmpName, name)
+	if err != nil {
+		fs.deleteTempFile(tmpName)
+		return fmt.Errorf("could not write thumbnail %s: %v", name, err)
+	}
+	klog.Infof("Created thumbnail %s of file %s", name, sf.Id)
+	return nil
+}
+
+// deleteThumbnails deletes the thumbnails of the physical file with
+// given name. Thumbnails of sizes, that are not allowed anymore, are
+// left to the reconciliation.
+func (fs *FileStorage) deleteThumbnails(source string) {
+	for _, size := range ThumbnailSizes() {
+		name := thumbnailName(source, size)
+		err := fs.fileSystem.DeleteFile(name)
+		if err != nil && !errors.Is(err, os.ErrNotExist) {
+			klog.Warningf("Could not delete thumbnail %s: %v", name, err)
+		}
+	}
+}
+
+func isThumbnailSize(size int) bool {
+	for _, s := range ThumbnailSizes() {
+		if s == size {
+			return true
+		}
+	}
+	return false
+}
+
+// scaleImage scales the image down, so that it fits into a square of
+// given size. Every pixel of the thumbnail is the average of the pixels
+// it covers in the original image.
+func scaleImage(img image.Image, size int) image.Image {
+	b := img.Bounds()
+	w, h := b.Dx(), b.Dy()
+	if w > size || h > size {
+		if w >= h {
+			w, h = size, maxInt(1, h*size/b.Dx())
+		} else {
+			w, h = maxInt(1, w*size/b.Dy()), size
+		}
+	}
+
+	pixel := pixelFunc(img)
+	dst := image.NewRGBA(image.Rect(0, 0, w, h))
+	for y := 0; y < h; y++ {
+		y0, y1 := y*b.Dy()/h, maxInt((y+1)*b.Dy()/h, y*b.Dy()/h+1)
+		for x := 0; x < w; x++ {
+			x0, x1 := x*b.Dx()/w, maxInt((x+1)*b.Dx()/w, x*b.Dx()/w+1)
+
+			// premultiplied colors, so transparent
+			// pixels don't darken their neighbours.
+			var r, g, bl, a, n uint64
+			for sy := y0; sy < y1; sy++ {
+				for sx := x0; sx < x1; sx++ {
+					pr, pg, pb, pa := pixel(b.Min.X+sx, b.Min.Y+sy)
+					r += uint64(pr)
+					g += uint64(pg)
+					bl += uint64(pb)
+					a += uint64(pa)
+					n++
+				}
+			}
+
+			i := y*dst.Stride + x*4
+			dst.Pix[i] = uint8(r / n)
+			dst.Pix[i+1] = uint8(g / n)
+			dst.Pix[i+2] = uint8(bl / n)
+			dst.Pix[i+3] = uint8(a / n)
+		}
+	}
+	return dst
+}
+
+// pixelFunc returns a function, which returns the premultiplied 8-bit
+// color of a pixel of the image. The types returned by the decoders are
+// read directly, as img.At allocates for every single pixel.
+func pixelFunc(img image.Image) func(x, y int) (uint32, uint32, uint32, uint32) {
+	switch img := img.(type) {
+	case *image.RGBA:
+		return func(x, y int) (uint32, uint32, uint32, uint32) {
+			p := img.Pix[img.PixOffset(x, y):]
+			return uint32(p[0]), uint32(p[1]), uint32(p[2]), uint32(p[3])
+		}
+	case *image.NRGBA:
+		return func(x, y int) (uint32, uint32, uint32, uint32) {
+			p := img.Pix[img.PixOffset(x, y):]
+			a := uint32(p[3])
+			return uint32(p[0]) * a / 0xff, uint32(p[1]) * a / 0xff, uint32(p[2]) * a / 0xff, a
+		}
+	case *image.YCbCr:
+		return func(x, y int) (uint32, uint32, uint32, uint32) {
+			ci := img.COffset(x, y)
+			r, g, b := color.YCbCrToRGB(img.Y[img.YOffset(x, y)], img.Cb[ci], img.Cr[ci])
+			return uint32(r), uint32(g), uint32(b), 0xff
+		}
+	case *image.Gray:
+		return func(x, y int) (uint32, uint32, uint32, uint32) {
+			v := uint32(img.Pix[img.PixOffset(x, y)])
+			return v, v, v, 0xff
+		}
+	case *image.Paletted:
+		palette := make([][4]uint32, len(img.Palette))
+		for i, c := range img.Palette {
+			r, g, b, a := c.RGBA()
+			palette[i] = [4]uint32{r >> 8, g >> 8, b >> 8, a >> 8}
+		}
+		return func(x, y int) (uint32, uint32, uint32, uint32) {
+			i := int(img.Pix[img.PixOffset(x, y)])
+			if i >= len(palette) {
+				return 0, 0, 0, 0
+			}
+			return palette[i][0], palette[i][1], palette[i][2], palette[i][3]
+		}
+	}
+	return func(x, y int) (uint32, uint32, uint32, uint32) {
+		r, g, b, a := img.At(x, y).RGBA()
+		return r >> 8, g >> 8, b >> 8, a >> 8
+	}
+}
+
+func maxInt(a int, b int) int {
+	if a > b {
+		return a
+	}
+	return b
+}
@@ -0,0 +1,137 @@
+package middleware
+
+import (
+	"github.com/gin-gonic/gin"
+	"golang.org/x/time/rate"
+	"math"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+)
+
+const (
+	// limiterIdleTimeout is the time after which the bucket of
+	// a key is forgotten, if no request has been made with it.
+	limiterIdleTimeout = 10 * time.Minute
+)
+
+// RateLimit is the limit for a single request.
+type RateLimit struct {
+	// Kind groups the keys, e.g. `token` or `ip`.
+	Kind string
+
+	// Key identifies the bucket, that the request takes a token from.
+	Key string
+
+	// PerMinute is the amount of tokens, that are refilled every minute.
+	PerMinute float64
+
+	// Burst is the size of the bucket, i.e. how many requests
+	// can be made at once.
+	Burst int
+}
+
+// RateLimitFunc returns the limit that applies to the request
+// or nil, if the request is not limited at all.
+type RateLimitFunc func(c *gin.Context) *RateLimit
+
+// RateLimiter limits requests with a token bucket per key.
+type RateLimiter struct {
+	// OnReject is called whenever a request has been rejected.
+	OnReject func(rl *RateLimit)
+
+	mu       sync.Mutex
+	limiters map[string]*limiterEntry
+}
+
+type limiterEntry struct {
+	limiter  *rate.Limiter
+	lastSeen time.Time
+}
+
+func NewRateLimiter() *RateLimiter {
+	rl := &RateLimiter{
+		limiters: map[string]*limiterEntry{},
+	}
+	go func() {
+		for range time.Tick(time.Minute) {
+			rl.removeIdle()
+		}
+	}()
+	return rl
+}
+
+// RateLimit is the middleware that rejects requests with 429 and a
+// Retry-After header, if the bucket of the request is empty.
+func (rl *RateLimiter) RateLimit(f RateLimitFunc) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		limit := f(c)
+		if limit == nil || limit.PerMinute <= 0 {
+			c.Next()
+			return
+		}
+
+		now := time.Now()
+		r := rl.getLimiter(limit, now).ReserveN(now, 1)
+		if delay := r.DelayFrom(now); !r.OK() || delay > 0 {
+			// we don't wait, so give the token back
+			r.CancelAt(now)
+
+			retryAfter := int(math.Ceil(delay.Seconds()))
+			if !r.OK() || retryAfter < 1 {
+				retryAfter = 1
+			}
+			if rl.OnReject != nil {
+				rl.OnReject(limit)
+			}
+
+			c.Header("Retry-After", strconv.Itoa(retryAfter))
+			c.AbortWithStatusJSON(http.StatusTooManyRequests, gin.H{"msg": "too many requests"})
+			return
+		}
+
+		c.Next()
+	}
+}
+
+// getLimiter returns the limiter of the key and creates it, if it
+// doesn't exist yet. Its limit is updated, if it has changed.
+func (rl *RateLimiter) getLimiter(limit *RateLimit, now time.Time) *rate.Limiter {
+	rl.mu.Lock()
+	defer rl.mu.Unlock()
+
+	key := limit.Kind + ":" + limit.Key
+	perSecond := rate.Limit(limit.PerMinute / 60)
+	burst := limit.Burst
+	if burst < 1 {
+		burst = 1
+	}
+
+	entry, ok := rl.limiters[key]
+	if !ok {
+		entry = &limiterEntry{limiter: rate.NewLimiter(perSecond, burst)}
+		rl.limiters[key] = entry
+	} else {
+		// the limit could have been changed by a config reload
+		if entry.limiter.Limit() != perSecond {
+			entry.limiter.SetLimitAt(now, perSecond)
+		}
+		if entry.limiter.Burst() != burst {
+			entry.limiter.SetBurstAt(now, burst)
+		}
+	}
+	entry.lastSeen = now
+	return entry.limiter
+}
+
+func (rl *RateLimiter) removeIdle() {
+	rl.mu.Lock()
+	defer rl.mu.Unlock()
+
+	for key, entry := range rl.limiters {
+		if time.Since(entry.lastSeen) > limiterIdleTimeout {
+			delete(rl.limiters, key)
+		}
+	}
+}
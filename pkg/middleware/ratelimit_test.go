@@ -0,0 +1,100 @@
+package middleware
+
+import (
+	"github.com/gin-gonic/gin"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"testing"
+)
+
+// newTestRouter returns a router, whose requests are limited
+// per value of the Key header with given limit.
+func newTestRouter(rl *RateLimiter, perMinute float64, burst int) *gin.Engine {
+	gin.SetMode(gin.TestMode)
+	r := gin.New()
+	r.Use(rl.RateLimit(func(c *gin.Context) *RateLimit {
+		key := c.GetHeader("Key")
+		if key == "" {
+			return nil
+		}
+		return &RateLimit{Kind: "test", Key: key, PerMinute: perMinute, Burst: burst}
+	}))
+	r.GET("/", func(c *gin.Context) {
+		c.Status(http.StatusOK)
+	})
+	return r
+}
+
+func request(r http.Handler, key string) *httptest.ResponseRecorder {
+	req := httptest.NewRequest(http.MethodGet, "/", nil)
+	if key != "" {
+		req.Header.Set("Key", key)
+	}
+	w := httptest.NewRecorder()
+	r.ServeHTTP(w, req)
+	return w
+}
+
+func TestRateLimit(t *testing.T) {
+	rl := NewRateLimiter()
+	var rejected []*RateLimit
+	rl.OnReject = func(limit *RateLimit) {
+		rejected = append(rejected, limit)
+	}
+	r := newTestRouter(rl, 1, 3)
+
+	for i := 0; i < 3; i++ {
+		if w := request(r, "a"); w.Code != http.StatusOK {
+			t.Fatalf("request %d within burst = %d, want 200", i, w.Code)
+		}
+	}
+
+	w := request(r, "a")
+	if w.Code != http.StatusTooManyRequests {
+		t.Fatalf("request after burst = %d, want 429", w.Code)
+	}
+	// a new token is available after a minute
+	retryAfter, err := strconv.Atoi(w.Header().Get("Retry-After"))
+	if err != nil || retryAfter < 1 || retryAfter > 60 {
+		t.Errorf("Retry-After = %q, want between 1 and 60", w.Header().Get("Retry-After"))
+	}
+	if len(rejected) != 1 || rejected[0].Key != "a" {
+		t.Errorf("OnReject has been called with %v, want the limit of a", rejected)
+	}
+
+	// every key has its own bucket
+	if w = request(r, "b"); w.Code != http.StatusOK {
+		t.Errorf("request with other key = %d, want 200", w.Code)
+	}
+	for i := 0; i < 10; i++ {
+		if w = request(r, ""); w.Code != http.StatusOK {
+			t.Fatalf("request without limit = %d, want 200", w.Code)
+		}
+	}
+}
+
+func TestRateLimitDisabled(t *testing.T) {
+	r := newTestRouter(NewRateLimiter(), 0, 1)
+	for i := 0; i < 10; i++ {
+		if w := request(r, "a"); w.Code != http.StatusOK {
+			t.Fatalf("request %d = %d, want 200", i, w.Code)
+		}
+	}
+}
+
+func TestRateLimitChanged(t *testing.T) {
+	rl := NewRateLimiter()
+	if w := request(newTestRouter(rl, 1, 3), "a"); w.Code != http.StatusOK {
+		t.Fatalf("first request = %d, want 200", w.Code)
+	}
+
+	// e.g. after the config has been reloaded
+	r := newTestRouter(rl, 1, 1)
+	if w := request(r, "a"); w.Code != http.StatusOK {
+		t.Errorf("request with decreased burst = %d, want 200", w.Code)
+	}
+	if w := request(r, "a"); w.Code != http.StatusTooManyRequests {
+		t.Errorf("request after decreased burst = %d, want 429", w.Code)
+	}
+}
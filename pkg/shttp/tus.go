@@ -0,0 +1,176 @@
+package shttp
+
+import (
+	"encoding/base64"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	tusVersion = "1.0.0"
+
+	// HeaderFileName contains the name of the stored
+	// file, as soon as the upload is complete.
+	HeaderFileName = "Aqua-File-Name"
+)
+
+// TusUpload uploads the file via the tus resumable upload protocol. First the
+// upload is created at given url and then the file is sent in chunks with `chunkSize` bytes.
+// If sending a chunk fails, the current offset is requested from the server and the
+// upload resumes from there, until it failed `maxRetries` times in a row.
+//
+// Returns the response of the request which sent the last chunk. If only the
+// response got lost, the response of the request for the offset is returned,
+// which contains the name of the stored file as well.
+func TusUpload(client *http.Client, createUrl string, file *os.File, metadata map[string]string, header map[string]string, chunkSize int64, maxRetries int) (*http.Response, error) {
+	stat, err := file.Stat()
+	if err != nil {
+		return nil, err
+	}
+	size := stat.Size()
+
+	uploadUrl, err := createTusUpload(client, createUrl, size, metadata, header)
+	if err != nil {
+		return nil, err
+	}
+
+	var offset int64
+	retries := 0
+	for {
+		res, err := patchTusChunk(client, uploadUrl, file, offset, chunkSize, header)
+		if err == nil {
+			offset, err = strconv.ParseInt(res.Header.Get("Upload-Offset"), 10, 64)
+			if err == nil && offset == size {
+				return res, nil
+			}
+			res.Body.Close()
+			if err == nil {
+				retries = 0
+				continue
+			}
+		}
+
+		retries++
+		if retries > maxRetries {
+			return nil, fmt.Errorf("giving up after %d retries: %v", maxRetries, err)
+		}
+		time.Sleep(time.Duration(retries) * time.Second)
+
+		// ask the server how much it received, because
+		// the chunk could have been partly written.
+		res, err = getTusOffset(client, uploadUrl, header)
+		if err != nil {
+			return nil, err
+		}
+		offset, err = strconv.ParseInt(res.Header.Get("Upload-Offset"), 10, 64)
+		if err != nil {
+			return nil, err
+		}
+		if offset == size && res.Header.Get(HeaderFileName) != "" {
+			return res, nil
+		}
+		// otherwise the file could not be stored, which
+		// is tried again by sending an empty chunk.
+	}
+}
+
+func createTusUpload(client *http.Client, createUrl string, size int64, metadata map[string]string, header map[string]string) (string, error) {
+	req, err := http.NewRequest("POST", createUrl, nil)
+	if err != nil {
+		return "", err
+	}
+	setHeader(req, header)
+	req.Header.Set("Upload-Length", strconv.FormatInt(size, 10))
+	req.Header.Set("Upload-Metadata", encodeTusMetadata(metadata))
+
+	res, err := client.Do(req)
+	if err != nil {
+		return "", err
+	}
+	defer res.Body.Close()
+	if res.StatusCode != http.StatusCreated {
+		return "", fmt.Errorf("bad status code: %d", res.StatusCode)
+	}
+
+	// the location can be relative to the url of the creation
+	base, err := url.Parse(createUrl)
+	if err != nil {
+		return "", err
+	}
+	loc, err := base.Parse(res.Header.Get("Location"))
+	if err != nil {
+		return "", err
+	}
+	return loc.String(), nil
+}
+
+func patchTusChunk(client *http.Client, uploadUrl string, file *os.File, offset int64, chunkSize int64, header map[string]string) (*http.Response, error) {
+	chunk := io.NewSectionReader(file, offset, chunkSize)
+	req, err := http.NewRequest("PATCH", uploadUrl, chunk)
+	if err != nil {
+		return nil, err
+	}
+	setHeader(req, header)
+	req.Header.Set("Content-Type", "application/offset+octet-stream")
+	req.Header.Set("Upload-Offset", strconv.FormatInt(offset, 10))
+
+	res, err := client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	if res.StatusCode != http.StatusNoContent {
+		res.Body.Close()
+		return nil, fmt.Errorf("bad status code: %d", res.StatusCode)
+	}
+	return res, nil
+}
+
+// getTusOffset returns the response of the request for the current
+// offset of the upload. The body is already closed.
+func getTusOffset(client *http.Client, uploadUrl string, header map[string]string) (*http.Response, error) {
+	req, err := http.NewRequest("HEAD", uploadUrl, nil)
+	if err != nil {
+		return nil, err
+	}
+	setHeader(req, header)
+
+	res, err := client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	res.Body.Close()
+	if res.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("bad status code: %d", res.StatusCode)
+	}
+	return res, nil
+}
+
+func setHeader(req *http.Request, header map[string]string) {
+	req.Header.Set("Tus-Resumable", tusVersion)
+	for key, val := range header {
+		req.Header.Set(key, val)
+	}
+}
+
+// encodeTusMetadata encodes the metadata as
+// comma-separated key value pairs with base64 encoded values.
+func encodeTusMetadata(metadata map[string]string) string {
+	keys := make([]string, 0, len(metadata))
+	for key := range metadata {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	pairs := make([]string, 0, len(keys))
+	for _, key := range keys {
+		pairs = append(pairs, key+" "+base64.StdEncoding.EncodeToString([]byte(metadata[key])))
+	}
+	return strings.Join(pairs, ",")
+}